@@ -0,0 +1,154 @@
+package xmlsig
+
+import (
+	"crypto"
+	"crypto/x509"
+)
+
+// DigestAlgorithm is the URI of a digest method, such as the DigestAlgorithm of
+// SignerOptions. It is a string, so the URI of a supported method the constants
+// below don't cover can be used as well. An unsupported URI is rejected when
+// the Signer is created.
+type DigestAlgorithm = string
+
+// SignatureAlgorithm is the URI of a signature method, such as the
+// SignatureAlgorithm of SignerOptions. As with DigestAlgorithm, any supported
+// URI can be used.
+type SignatureAlgorithm = string
+
+// CanonicalizationAlgorithm is the URI of a canonicalization method, such as
+// the CanonicalizationAlgorithm of SignerOptions. As with DigestAlgorithm, any
+// supported URI can be used.
+type CanonicalizationAlgorithm = string
+
+// Digest method URIs for the DigestAlgorithm of SignerOptions.
+const (
+	DigestSHA1     DigestAlgorithm = "http://www.w3.org/2000/09/xmldsig#sha1"
+	DigestSHA256   DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha256"
+	DigestSHA384   DigestAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	DigestSHA512   DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha512"
+	DigestSHA3_256 DigestAlgorithm = "http://www.w3.org/2007/05/xmldsig-more#sha3-256"
+	DigestSHA3_384 DigestAlgorithm = "http://www.w3.org/2007/05/xmldsig-more#sha3-384"
+	DigestSHA3_512 DigestAlgorithm = "http://www.w3.org/2007/05/xmldsig-more#sha3-512"
+)
+
+// Signature method URIs for the SignatureAlgorithm of SignerOptions.
+const (
+	SigRSASHA1     SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	SigRSASHA256   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	SigRSASHA384   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"
+	SigRSASHA512   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	SigDSASHA1     SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#dsa-sha1"
+	SigDSASHA256   SignatureAlgorithm = "http://www.w3.org/2009/xmldsig11#dsa-sha256"
+	SigECDSASHA1   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1"
+	SigECDSASHA256 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	SigECDSASHA384 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	SigECDSASHA512 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	// SigEd25519 is the EdDSA URI of RFC 9231, formerly an xmldsig-more draft.
+	SigEd25519 SignatureAlgorithm = "http://www.w3.org/2021/04/xmldsig-more#eddsa-ed25519"
+
+	SigHMACSHA1   SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#hmac-sha1"
+	SigHMACSHA256 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha256"
+	SigHMACSHA384 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha384"
+	SigHMACSHA512 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha512"
+)
+
+// Canonicalization method URIs for the CanonicalizationAlgorithm of
+// SignerOptions.
+const (
+	CanonExclusive               CanonicalizationAlgorithm = xMLexcC14Namespace
+	CanonExclusiveWithComments   CanonicalizationAlgorithm = xMLexcC14WithComments
+	CanonInclusive               CanonicalizationAlgorithm = c14n10Namespace
+	CanonInclusiveWithComments   CanonicalizationAlgorithm = c14n10WithCommentsNamespace
+	CanonInclusive11             CanonicalizationAlgorithm = c14n11Namespace
+	CanonInclusive11WithComments CanonicalizationAlgorithm = c14n11WithCommentsNamespace
+)
+
+// digestMethods are the supported digest methods along with the hash each
+// uses. The first is the default.
+var digestMethods = []struct {
+	uri  DigestAlgorithm
+	hash crypto.Hash
+}{
+	{DigestSHA1, crypto.SHA1},
+	{DigestSHA256, crypto.SHA256},
+	{DigestSHA384, crypto.SHA384},
+	{DigestSHA512, crypto.SHA512},
+	{DigestSHA3_256, crypto.SHA3_256},
+	{DigestSHA3_384, crypto.SHA3_384},
+	{DigestSHA3_512, crypto.SHA3_512},
+}
+
+// hmacKey is the key type of the HMAC signature methods, which sign with a
+// shared key rather than a certificate's key.
+const hmacKey = x509.UnknownPublicKeyAlgorithm
+
+// signatureMethods are the supported signature methods along with the type of
+// key each signs with and the hash it uses. The first method for a key type is
+// its default.
+var signatureMethods = []struct {
+	uri     SignatureAlgorithm
+	keyType x509.PublicKeyAlgorithm
+	hash    crypto.Hash
+}{
+	{SigRSASHA1, x509.RSA, crypto.SHA1},
+	{SigRSASHA256, x509.RSA, crypto.SHA256},
+	{SigRSASHA384, x509.RSA, crypto.SHA384},
+	{SigRSASHA512, x509.RSA, crypto.SHA512},
+	{SigDSASHA1, x509.DSA, crypto.SHA1},
+	{SigDSASHA256, x509.DSA, crypto.SHA256},
+	{SigECDSASHA256, x509.ECDSA, crypto.SHA256},
+	{SigECDSASHA1, x509.ECDSA, crypto.SHA1},
+	{SigECDSASHA384, x509.ECDSA, crypto.SHA384},
+	{SigECDSASHA512, x509.ECDSA, crypto.SHA512},
+	// Ed25519 signs the message itself rather than a digest of it
+	{SigEd25519, x509.Ed25519, 0},
+	{SigHMACSHA256, hmacKey, crypto.SHA256},
+	{SigHMACSHA1, hmacKey, crypto.SHA1},
+	{SigHMACSHA384, hmacKey, crypto.SHA384},
+	{SigHMACSHA512, hmacKey, crypto.SHA512},
+}
+
+// lookupSignatureMethod returns the signature method for keys of the type, or
+// their default when alg is empty, and whether there are any for the type.
+func lookupSignatureMethod(keyType x509.PublicKeyAlgorithm, alg SignatureAlgorithm) (*algorithm, bool) {
+	known := false
+	for _, method := range signatureMethods {
+		if method.keyType != keyType {
+			continue
+		}
+		if alg == "" || alg == method.uri {
+			return &algorithm{method.uri, method.hash}, true
+		}
+		known = true
+	}
+	return nil, known
+}
+
+// AlgorithmHash returns the hash used by a digest or signature method URI, and
+// whether the URI is one of those. Ed25519 signs without a separate digest, so
+// SigEd25519 doesn't have one.
+func AlgorithmHash(uri string) (crypto.Hash, bool) {
+	for _, method := range digestMethods {
+		if method.uri == uri {
+			return method.hash, true
+		}
+	}
+	for _, method := range signatureMethods {
+		if method.uri == uri && method.hash != 0 {
+			return method.hash, true
+		}
+	}
+	return 0, false
+}
+
+// DigestAlgorithmURI returns the digest method URI for the hash, and whether
+// there is one.
+func DigestAlgorithmURI(hash crypto.Hash) (DigestAlgorithm, bool) {
+	for _, method := range digestMethods {
+		if method.hash == hash {
+			return method.uri, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+package xmlsig
+
+import (
+	"crypto"
+	"crypto/x509"
+	"testing"
+)
+
+func TestAlgorithmConstants(t *testing.T) {
+	digests := map[DigestAlgorithm]crypto.Hash{
+		DigestSHA1:     crypto.SHA1,
+		DigestSHA256:   crypto.SHA256,
+		DigestSHA384:   crypto.SHA384,
+		DigestSHA512:   crypto.SHA512,
+		DigestSHA3_256: crypto.SHA3_256,
+		DigestSHA3_384: crypto.SHA3_384,
+		DigestSHA3_512: crypto.SHA3_512,
+	}
+	for uri, hash := range digests {
+		alg, err := pickDigestAlgorithm(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg.name != uri || alg.hash != hash {
+			t.Fatalf("expected %s to use %v but got %s using %v", uri, hash, alg.name, alg.hash)
+		}
+	}
+	signatures := []struct {
+		uri     SignatureAlgorithm
+		keyType x509.PublicKeyAlgorithm
+		hash    crypto.Hash
+	}{
+		{SigRSASHA1, x509.RSA, crypto.SHA1},
+		{SigRSASHA256, x509.RSA, crypto.SHA256},
+		{SigRSASHA384, x509.RSA, crypto.SHA384},
+		{SigRSASHA512, x509.RSA, crypto.SHA512},
+		{SigDSASHA1, x509.DSA, crypto.SHA1},
+		{SigDSASHA256, x509.DSA, crypto.SHA256},
+		{SigECDSASHA1, x509.ECDSA, crypto.SHA1},
+		{SigECDSASHA256, x509.ECDSA, crypto.SHA256},
+		{SigECDSASHA384, x509.ECDSA, crypto.SHA384},
+		{SigECDSASHA512, x509.ECDSA, crypto.SHA512},
+		{SigEd25519, x509.Ed25519, 0},
+	}
+	for _, test := range signatures {
+		alg, err := pickSignatureAlgorithm(test.keyType, test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg.name != test.uri || alg.hash != test.hash {
+			t.Fatalf("expected %s to use %v but got %s using %v", test.uri, test.hash, alg.name, alg.hash)
+		}
+	}
+	hmacs := map[SignatureAlgorithm]crypto.Hash{
+		SigHMACSHA1:   crypto.SHA1,
+		SigHMACSHA256: crypto.SHA256,
+		SigHMACSHA384: crypto.SHA384,
+		SigHMACSHA512: crypto.SHA512,
+	}
+	for uri, hash := range hmacs {
+		alg, err := pickHMACAlgorithm(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg.name != uri || alg.hash != hash {
+			t.Fatalf("expected %s to use %v but got %s using %v", uri, hash, alg.name, alg.hash)
+		}
+	}
+	canonicalizations := []struct {
+		uri                 string
+		exclusive, comments bool
+	}{
+		{CanonExclusive, true, false},
+		{CanonExclusiveWithComments, true, true},
+		{CanonInclusive, false, false},
+		{CanonInclusiveWithComments, false, true},
+		{CanonInclusive11, false, false},
+		{CanonInclusive11WithComments, false, true},
+	}
+	for _, test := range canonicalizations {
+		c, err := pickCanonicalization(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.name != test.uri || c.exclusive != test.exclusive || c.comments != test.comments {
+			t.Fatalf("expected %s to be exclusive %t with comments %t", test.uri, test.exclusive, test.comments)
+		}
+	}
+
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{
+		SignatureAlgorithm:        SigRSASHA256,
+		DigestAlgorithm:           DigestSHA512,
+		CanonicalizationAlgorithm: CanonInclusive11,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.SignedInfo.SignatureMethod.Algorithm != SigRSASHA256 ||
+		sig.SignedInfo.Reference.DigestMethod.Algorithm != DigestSHA512 ||
+		sig.SignedInfo.CanonicalizationMethod.Algorithm != CanonInclusive11 {
+		t.Fatalf("expected the constants to be emitted but got %+v", sig.SignedInfo)
+	}
+}
+
+func TestAlgorithmHash(t *testing.T) {
+	digests := []DigestAlgorithm{DigestSHA1, DigestSHA256, DigestSHA384, DigestSHA512, DigestSHA3_256, DigestSHA3_384, DigestSHA3_512}
+	for _, uri := range digests {
+		alg, err := pickDigestAlgorithm(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash, ok := AlgorithmHash(uri); !ok || hash != alg.hash {
+			t.Fatalf("expected %s to map to %v but got %v", uri, alg.hash, hash)
+		}
+		if reverse, ok := DigestAlgorithmURI(alg.hash); !ok || reverse != uri {
+			t.Fatalf("expected %v to map back to %s but got %s", alg.hash, uri, reverse)
+		}
+	}
+	keyTypes := []x509.PublicKeyAlgorithm{x509.RSA, x509.DSA, x509.ECDSA}
+	for _, uri := range DefaultAllowedSignatureMethods {
+		var alg *algorithm
+		for _, keyType := range keyTypes {
+			if a, err := pickSignatureAlgorithm(keyType, uri); err == nil {
+				alg = a
+			}
+		}
+		if a, err := pickHMACAlgorithm(uri); err == nil {
+			alg = a
+		}
+		hash, ok := AlgorithmHash(uri)
+		if uri == SigEd25519 {
+			if ok {
+				t.Fatalf("expected %s not to have a hash but got %v", uri, hash)
+			}
+			continue
+		}
+		if alg == nil || !ok || hash != alg.hash {
+			t.Fatalf("expected %s to map to the hash it signs with but got %v", uri, hash)
+		}
+	}
+	if _, ok := AlgorithmHash("urn:unknown"); ok {
+		t.Fatal("expected an unknown URI not to have a hash")
+	}
+	if _, ok := DigestAlgorithmURI(crypto.MD5); ok {
+		t.Fatal("expected MD5 not to have a digest method")
+	}
+}
@@ -0,0 +1,54 @@
+package xmlsig
+
+import (
+	"encoding/xml"
+	"runtime"
+	"sync"
+)
+
+// SignBatch signs each of docs with the signer on a pool of workers, one for
+// each CPU the program may use. A []byte is signed with SignDocument, which
+// needs the signer to be a DocumentSigner, and its result is the signed
+// document. Anything else is signed with CreateSignature and its result is the
+// Signature marshalled as XML, to be embedded by the caller. The results and
+// errors are in the order of docs.
+func SignBatch(signer Signer, docs []interface{}) ([][]byte, []error) {
+	results := make([][]byte, len(docs))
+	errs := make([]error, len(docs))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(docs) {
+		workers = len(docs)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = signBatchItem(signer, docs[i])
+			}
+		}()
+	}
+	for i := range docs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, errs
+}
+
+func signBatchItem(signer Signer, doc interface{}) ([]byte, error) {
+	if data, ok := doc.([]byte); ok {
+		documentSigner, ok := signer.(DocumentSigner)
+		if !ok {
+			return nil, errNotDocumentSigner
+		}
+		return documentSigner.SignDocument(data)
+	}
+	signature, err := signer.CreateSignature(doc)
+	if err != nil {
+		return nil, err
+	}
+	return xml.Marshal(signature)
+}
@@ -0,0 +1,59 @@
+package xmlsig
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestSignBatch signs concurrently, so run it with -race to check that the
+// signer has no mutable state shared between signatures.
+func TestSignBatch(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureAlgorithm: SigRSASHA256, DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []interface{}
+	for i := 0; i < 64; i++ {
+		if i%2 == 0 {
+			docs = append(docs, []byte(fmt.Sprintf(`<doc ID="_d%d"><item>%d</item></doc>`, i, i)))
+		} else {
+			docs = append(docs, &Envelope{ID: fmt.Sprintf("_e%d", i), Data: fmt.Sprint(i)})
+		}
+	}
+	docs[10] = []byte("<doc>")
+	results, errs := SignBatch(signer, docs)
+	if len(results) != len(docs) || len(errs) != len(docs) {
+		t.Fatalf("expected %d results but got %d and %d errors", len(docs), len(results), len(errs))
+	}
+	for i, doc := range docs {
+		if i == 10 {
+			if !errors.Is(errs[i], ErrMalformedDocument) {
+				t.Fatalf("expected ErrMalformedDocument for document 10 but got %v", errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("document %d: %v", i, errs[i])
+		}
+		signed := results[i]
+		id := fmt.Sprintf("_d%d", i)
+		if envelope, ok := doc.(*Envelope); ok {
+			// embed the Signature the result is for
+			signature := &Signature{}
+			if err := xml.Unmarshal(results[i], signature); err != nil {
+				t.Fatal(err)
+			}
+			envelope.Signature = signature
+			if signed, err = xml.Marshal(envelope); err != nil {
+				t.Fatal(err)
+			}
+			id = envelope.ID
+		}
+		verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{id}})
+		if err := verifier.Verify(signed); err != nil {
+			t.Fatalf("document %d: %v", i, err)
+		}
+	}
+}
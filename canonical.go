@@ -3,118 +3,1219 @@ package xmlsig
 import (
 	"bufio"
 	"bytes"
+	"crypto"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"reflect"
 	"sort"
 	"strings"
 )
 
+// Canonicalization algorithms. Each can be used as the CanonicalizationMethod
+// of SignedInfo and as a reference transform.
+const (
+	c14n10Namespace             = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	c14n10WithCommentsNamespace = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments"
+	c14n11Namespace             = "http://www.w3.org/2006/12/xml-c14n11"
+	c14n11WithCommentsNamespace = "http://www.w3.org/2006/12/xml-c14n11#WithComments"
+	xMLexcC14WithComments       = "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"
+)
+
+// CanonicalizeHook changes canonical bytes before they are digested or
+// signed. A signature made with a hook only verifies when the verifier applies
+// the same hook, so it breaks interoperability with other implementations and
+// is only for integrating with verifiers that normalize in a bespoke way.
+type CanonicalizeHook func([]byte) ([]byte, error)
+
+// apply runs the hook to the canonical bytes when there is one.
+func (hook CanonicalizeHook) apply(data []byte) ([]byte, error) {
+	if hook == nil {
+		return data, nil
+	}
+	return hook(data)
+}
+
+// canonicalization describes how a canonicalization algorithm renders XML.
+type canonicalization struct {
+	name      string
+	exclusive bool
+	comments  bool
+	// inclusive lists the prefixes rendered as with inclusive canonicalization
+	// when exclusive is set. The empty prefix is the default namespace.
+	inclusive []string
+	// idAttributes, when set, are the only attributes that identify elements
+	idAttributes []xml.Name
+	// charsetReader converts input declared in another encoding to UTF-8
+	charsetReader func(charset string, input io.Reader) (io.Reader, error)
+	// renameApex renders the apex with apexPrefix for its namespace, which is
+	// the default namespace when apexPrefix is empty
+	renameApex bool
+	apexPrefix string
+	// stripWhitespace leaves out text that is only whitespace unless
+	// xml:space="preserve" applies to it
+	stripWhitespace bool
+	// sizeHint is the expected size of the canonical form
+	sizeHint int
+	// version11 applies the rules of Canonical XML 1.1, under which the apex
+	// of a document subset only inherits xml:lang and xml:space, and gets an
+	// xml:base resolved against those of its ancestors
+	version11 bool
+}
+
+func pickCanonicalization(alg string) (*canonicalization, error) {
+	switch alg {
+	case "":
+		fallthrough
+	case xMLexcC14Namespace:
+		return &canonicalization{name: xMLexcC14Namespace, exclusive: true, comments: false}, nil
+	case xMLexcC14WithComments:
+		return &canonicalization{name: xMLexcC14WithComments, exclusive: true, comments: true}, nil
+	case c14n10Namespace:
+		return &canonicalization{name: c14n10Namespace, exclusive: false, comments: false}, nil
+	case c14n10WithCommentsNamespace:
+		return &canonicalization{name: c14n10WithCommentsNamespace, exclusive: false, comments: true}, nil
+	case c14n11Namespace:
+		return &canonicalization{name: c14n11Namespace, exclusive: false, comments: false, version11: true}, nil
+	case c14n11WithCommentsNamespace:
+		return &canonicalization{name: c14n11WithCommentsNamespace, exclusive: false, comments: true, version11: true}, nil
+	}
+	return nil, errors.New("xmlsig does not support the specified canonicalization algorithm")
+}
+
+// withoutComments returns the canonicalization used for a same-document
+// reference. Dereferencing a URI of "" or "#id" removes comments from the
+// node-set, so they are left out even by the WithComments algorithms.
+func (c *canonicalization) withoutComments() *canonicalization {
+	if !c.comments {
+		return c
+	}
+	without := *c
+	without.comments = false
+	return &without
+}
+
+// withPrefixList returns the canonicalization for an InclusiveNamespaces
+// PrefixList, which only applies to exclusive canonicalization.
+func (c *canonicalization) withPrefixList(list string) (*canonicalization, error) {
+	if !c.exclusive {
+		return nil, errors.New("xmlsig can only use inclusive namespaces with exclusive canonicalization")
+	}
+	var prefixes []string
+	for _, prefix := range strings.Fields(list) {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	with := *c
+	with.inclusive = prefixes
+	return &with, nil
+}
+
+// withCharsetReader returns the canonicalization reading input that isn't
+// UTF-8 with the charset reader.
+func (c *canonicalization) withCharsetReader(charsetReader func(string, io.Reader) (io.Reader, error)) *canonicalization {
+	with := *c
+	with.charsetReader = charsetReader
+	return &with
+}
+
+// withApexPrefix returns the canonicalization rendering the apex with the
+// prefix for its namespace, or in the default namespace for #default. An empty
+// prefix renders the apex as written.
+func (c *canonicalization) withApexPrefix(prefix string) (*canonicalization, error) {
+	if strings.HasPrefix(strings.ToLower(prefix), "xml") || strings.Contains(prefix, ":") {
+		return nil, fmt.Errorf("xmlsig can not use %s as the apex prefix", prefix)
+	}
+	with := *c
+	with.renameApex = prefix != ""
+	with.apexPrefix = strings.TrimPrefix(prefix, "#default")
+	return &with, nil
+}
+
+// withoutWhitespace returns the canonicalization leaving out text that is
+// only whitespace.
+func (c *canonicalization) withoutWhitespace() *canonicalization {
+	with := *c
+	with.stripWhitespace = true
+	return &with
+}
+
+// withSizeHint returns the canonicalization allocating buffers for canonical
+// forms of the size.
+func (c *canonicalization) withSizeHint(size int) *canonicalization {
+	with := *c
+	with.sizeHint = size
+	return &with
+}
+
+// withIDAttributes returns the canonicalization identifying elements only by
+// the attributes with the names.
+func (c *canonicalization) withIDAttributes(names []xml.Name) *canonicalization {
+	with := *c
+	with.idAttributes = names
+	return &with
+}
+
+// transform returns the Algorithm element describing the canonicalization,
+// including its InclusiveNamespaces PrefixList if there is one.
+func (c *canonicalization) transform() Algorithm {
+	alg := Algorithm{Algorithm: c.name}
+	if len(c.inclusive) > 0 {
+		prefixes := make([]string, len(c.inclusive))
+		for i, prefix := range c.inclusive {
+			if prefix == "" {
+				prefix = "#default"
+			}
+			prefixes[i] = prefix
+		}
+		alg.InclusiveNamespaces = &InclusiveNamespaces{PrefixList: strings.Join(prefixes, " ")}
+	}
+	return alg
+}
+
+// subset selects the part of a document to canonicalize using the positions
+// of elements in document order, starting at zero for the document element.
+type subset struct {
+	// apex is the element to canonicalize along with its descendants, or -1
+	// for the whole document.
+	apex int
+	// exclude is an element left out along with its descendants, such as an
+	// enveloped signature, or -1.
+	exclude int
+}
+
+var wholeDocument = subset{-1, -1}
+
 /* canonicalize produces canonical XML when marshalling the data structure
 provided as data. Go's xml encoder generates something that's pretty close,
 but it repeats namespace declarations for each element which isn't correct.
 It also doesn't sort attribute names.
 */
 func canonicalize(data interface{}) ([]byte, string, error) {
-	// write the item to a buffer
-	var buffer, out bytes.Buffer
-	writer := bufio.NewWriter(&buffer)
-	encoder := xml.NewEncoder(writer)
-	err := encoder.Encode(data)
+	c, _ := pickCanonicalization("")
+	return c.canonicalize(data)
+}
+
+func (c *canonicalization) canonicalize(data interface{}) ([]byte, string, error) {
+	return c.canonicalizeInScope(data, nil)
+}
+
+// canonicalizeInScope canonicalizes data as if it were within an element where
+// the namespace declarations of scope, mapping prefixes to namespaces, apply.
+func (c *canonicalization) canonicalizeInScope(data interface{}, scope map[string]string) ([]byte, string, error) {
+	var out bytes.Buffer
+	out.Grow(c.sizeHint)
+	id, err := c.writeValueInScope(&out, data, scope)
 	if err != nil {
 		return nil, "", err
 	}
-	encoder.Flush()
+	return out.Bytes(), id, nil
+}
+
+// writeValueInScope writes the canonical form of data, marshalled as XML
+// unless it is a CanonicalSource, to w, as canonicalizeInScope does.
+func (c *canonicalization) writeValueInScope(w io.Writer, data interface{}, scope map[string]string) (string, error) {
+	// write the item to a buffer
+	var buffer bytes.Buffer
+	buffer.Grow(c.sizeHint)
+	if source, ok := data.(CanonicalSource); ok {
+		doc, err := readSource(source)
+		if err != nil {
+			return "", err
+		}
+		buffer.Write(doc)
+	} else if err := xml.NewEncoder(&buffer).Encode(data); err != nil {
+		return "", err
+	}
 	// read it back in
-	decoder := xml.NewDecoder(bytes.NewReader(buffer.Bytes()))
+	return c.writeInScope(w, &buffer, wholeDocument, scope)
+}
+
+// write writes the canonical form of the subset of the XML read from r to w.
+// It returns the ID of the apex, or of the document element for the whole
+// document, if it has one.
+func (c *canonicalization) write(w io.Writer, r io.Reader, nodes subset) (string, error) {
+	return c.writeInScope(w, r, nodes, nil)
+}
+
+// Canonicalize returns the canonical form of data, which is either a value to
+// marshal as XML or a []byte holding an XML document. Only the document
+// element is rendered, so the UTF-8 bytes have no XML declaration and nothing
+// before or after the element, which makes them suitable as the plaintext of
+// an XML Encryption Element. Exclusive XML Canonicalization is used.
+func Canonicalize(data interface{}) (_ []byte, err error) {
+	defer recoverPanic(&err, nil)
+	c, _ := pickCanonicalization("")
+	doc, ok := data.([]byte)
+	if !ok {
+		canonical, _, err := c.canonicalize(data)
+		return canonical, err
+	}
+	var out bytes.Buffer
+	if _, err := c.write(&out, bytes.NewReader(doc), subset{0, -1}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// DetectReferenceID returns the ID of the element a signature of data would
+// reference, which is the document element of data, or "" when it doesn't have
+// one. As with Canonicalize, data is either a value to marshal as XML or a
+// []byte holding an XML document. Attributes named ID or Id, or ending in Id,
+// are taken as IDs.
+func DetectReferenceID(element interface{}) (_ string, err error) {
+	defer recoverPanic(&err, nil)
+	doc, ok := element.([]byte)
+	if !ok {
+		if doc, err = xml.Marshal(element); err != nil {
+			return "", err
+		}
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return "", ErrEmptyDocument
+		}
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return elementID(start, nil), nil
+		}
+	}
+}
+
+// CanonicalizeTo writes the canonical form of the element of doc with the ID,
+// and its descendants, to w, or of the whole document when id is empty. The
+// canonical bytes are written as they are produced, so w can be a hash.Hash
+// to digest a large element without holding its canonical form in memory.
+// Exclusive XML Canonicalization is used.
+func CanonicalizeTo(w io.Writer, doc []byte, id string) (err error) {
+	defer recoverPanic(&err, nil)
+	nodes := wholeDocument
+	if id != "" {
+		index, err := indexDocument(doc, nil)
+		if err != nil {
+			return err
+		}
+		if nodes.apex, err = index.lookupID(id); err != nil {
+			return err
+		}
+	}
+	c, _ := pickCanonicalization("")
+	_, err = c.write(w, bytes.NewReader(doc), nodes)
+	return err
+}
+
+// MinifyForSigning returns the canonical form of doc without the text that is
+// only whitespace, such as the indentation of a pretty-printed document, unless
+// xml:space="preserve" applies to it. Line endings are normalized to line
+// feeds. Signing the result with SignDocument digests exactly these bytes, so
+// they can be previewed and stored. Exclusive XML Canonicalization is used.
+func MinifyForSigning(doc []byte) (_ []byte, err error) {
+	defer recoverPanic(&err, nil)
+	c, _ := pickCanonicalization("")
+	c = c.withoutWhitespace()
+	var out bytes.Buffer
+	if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// digest computes the digest of the canonical form of the subset by writing
+// it straight into the hash.
+func (c *canonicalization) digest(hash crypto.Hash, r io.Reader, nodes subset) ([]byte, error) {
+	h := hash.New()
+	if _, err := c.write(h, r, nodes); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// canonWriter is written the canonical form. Writers such as a bytes.Buffer
+// that already implement it are written directly, others through a
+// bufio.Writer.
+type canonWriter interface {
+	io.Writer
+	io.StringWriter
+	io.ByteWriter
+}
+
+// writeInScope is write for XML within an element where the namespace
+// declarations of scope apply.
+func (c *canonicalization) writeInScope(w io.Writer, r io.Reader, nodes subset, scope map[string]string) (string, error) {
+	// Raw tokens keep the prefixes as written so they can be reproduced. The
+	// namespace declarations in scope are tracked on the stack instead.
+	decoder := xml.NewDecoder(&attrWhitespaceReader{r: r})
+	decoder.CharsetReader = c.charsetReader
 	namespaces := &stack{}
-	outWriter := bufio.NewWriter(&out)
-	firstElem := true
+	if scope != nil {
+		namespaces.Push(&nsFrame{declared: scope})
+	}
+	outWriter, direct := w.(canonWriter)
+	var buffered *bufio.Writer
+	if !direct {
+		buffered = bufio.NewWriter(w)
+		outWriter = buffered
+	}
+	position, depth := -1, 0
+	apexDepth, excludeDepth, renamedDepth := -1, -1, -1
+	// renamed is the frame of an apex rendered in the default namespace, whose
+	// unprefixed descendants are kept in the outerDefault namespace
+	var renamed *nsFrame
+	outerDefault := ""
+	afterRoot := false
 	id := ""
 	for {
-		token, err := decoder.Token()
-		if err != nil {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return "", err
+		}
+		// Whole documents include nodes outside the document element
+		visible := (nodes.apex < 0 || apexDepth > 0) && excludeDepth < 0
 		switch t := token.(type) {
 		case xml.StartElement:
-			// Check the first element for an ID to include in the reference
-			if firstElem {
-				firstElem = false
-				for i := range t.Attr {
-					localName := t.Attr[i].Name.Local
-					if localName == "ID" || localName == "Id" || strings.HasSuffix(localName, "Id") {
-						id = t.Attr[i].Value
-					}
+			position++
+			depth++
+			if c.renameApex && (position == nodes.apex || (nodes.apex < 0 && position == 0)) {
+				outerDefault = defaultNamespace(t, namespaces)
+				if t, err = renamePrefix(t, namespaces, c.apexPrefix); err != nil {
+					return "", err
 				}
+				renamedDepth = depth
+			} else if renamed != nil && t.Name.Space == "" && !declaresDefault(t) && innermostDefault(namespaces) == renamed {
+				t.Attr = append(t.Attr, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: outerDefault})
+			}
+			if position == nodes.apex {
+				apexDepth = depth
+				visible = true
+			}
+			if position == nodes.exclude {
+				excludeDepth = depth
+				visible = false
+			}
+			c.writeStartElement(outWriter, t, namespaces, visible, position == nodes.apex)
+			if depth == renamedDepth && c.apexPrefix == "" {
+				if top, _ := namespaces.Top(); top.(*nsFrame).declared[""] != outerDefault {
+					renamed = top.(*nsFrame)
+				}
+			}
+			if position == nodes.apex || (nodes.apex < 0 && position == 0) {
+				// Check the apex for an ID to include in the reference
+				id = c.elementID(t, namespaces)
 			}
-			writeStartElement(outWriter, t, namespaces)
 
 		case xml.EndElement:
 			namespaces.Pop()
-			if !strings.HasPrefix(t.Name.Space, "http") {
-				fmt.Fprintf(outWriter, "</%s:%s>", t.Name.Space, t.Name.Local)
-			} else {
-				fmt.Fprintf(outWriter, "</%s>", t.Name.Local)
+			if depth == renamedDepth {
+				t.Name.Space = c.apexPrefix
+			}
+			if visible {
+				outWriter.WriteString("</")
+				writeName(outWriter, t.Name)
+				outWriter.WriteByte('>')
+			}
+			if depth == excludeDepth {
+				excludeDepth = -1
 			}
+			if depth == apexDepth {
+				apexDepth = -1
+			}
+			depth--
+			afterRoot = depth == 0
 
 		case xml.CharData:
-			outWriter.Write(t)
+			if c.stripWhitespace && len(bytes.Trim(t, " \t\r\n")) == 0 && !preservesSpace(namespaces) {
+				continue
+			}
+			// Text outside of the document element isn't part of the document
+			if visible && depth > 0 {
+				textEscaper.WriteString(outWriter, string(t))
+			}
+
+		case xml.Comment:
+			if visible && c.comments {
+				writeOutsideRoot(outWriter, depth, afterRoot, func() {
+					outWriter.WriteString("<!--")
+					outWriter.Write(t)
+					outWriter.WriteString("-->")
+				})
+			}
+
+		case xml.ProcInst:
+			// The XML declaration isn't part of the canonical form
+			if visible && t.Target != "xml" {
+				writeOutsideRoot(outWriter, depth, afterRoot, func() {
+					writeProcInst(outWriter, t)
+				})
+			}
 		}
 	}
-	outWriter.Flush()
-	return out.Bytes(), id, nil
+	if position < 0 {
+		return "", ErrEmptyDocument
+	}
+	if buffered != nil {
+		return id, buffered.Flush()
+	}
+	return id, nil
+}
+
+// writeOutsideRoot writes a comment or processing instruction, separating it
+// from the document element with a line feed when it appears outside of it.
+func writeOutsideRoot(writer canonWriter, depth int, afterRoot bool, write func()) {
+	if depth == 0 && afterRoot {
+		writer.WriteByte('\n')
+	}
+	write()
+	if depth == 0 && !afterRoot {
+		fmt.Fprint(writer, "\n")
+	}
+}
+
+// elementID returns the ID of an element read as a raw token, once its
+// namespace declarations are on the stack. Configured ID attributes are
+// matched by namespace, so the attribute prefixes are resolved first.
+func (c *canonicalization) elementID(start xml.StartElement, namespaces *stack) string {
+	if len(c.idAttributes) == 0 {
+		return elementID(start, nil)
+	}
+	attrs := make([]xml.Attr, len(start.Attr))
+	for i, att := range start.Attr {
+		attrs[i] = att
+		switch att.Name.Space {
+		case "", "xmlns":
+		case "xml":
+			attrs[i].Name.Space = xmlNamespace
+		default:
+			if uri, ok := lookupNamespace(namespaces, att.Name.Space, false); ok {
+				attrs[i].Name.Space = uri
+			}
+		}
+	}
+	start.Attr = attrs
+	return elementID(start, c.idAttributes)
+}
+
+// elementID returns the value of the attribute identifying the element, whose
+// attribute names must have their namespaces resolved. With idAttributes, it is
+// the first attribute of the element with one of those names. Otherwise
+// attributes named ID or Id, or ending in Id, are matched and the last wins.
+func elementID(start xml.StartElement, idAttributes []xml.Name) string {
+	if len(idAttributes) > 0 {
+		for _, att := range start.Attr {
+			for _, name := range idAttributes {
+				if att.Name == name {
+					return att.Value
+				}
+			}
+		}
+		return ""
+	}
+	id := ""
+	for i := range start.Attr {
+		if isNamespaceDeclaration(start.Attr[i].Name) {
+			continue
+		}
+		localName := start.Attr[i].Name.Local
+		if localName == "ID" || localName == "Id" || strings.HasSuffix(localName, "Id") {
+			id = start.Attr[i].Value
+		}
+	}
+	return id
 }
 
-func writeNameSapce(namespaces *stack, writer io.Writer, start xml.StartElement) {
-	currentNs, err := namespaces.Top()
-	namespace := start.Name.Space
+// CanonicalizeField produces canonical XML for the field of the struct data
+// named fieldName, along with the ID of that element if it has one. The field
+// is marshalled with the element name it would have inside data, so callers can
+// sign a sub-element, such as the Assertion of a Response, without extracting it.
+func CanonicalizeField(data interface{}, fieldName string) (_ []byte, _ string, err error) {
+	defer recoverPanic(&err, nil)
+	c, _ := pickCanonicalization("")
+	return c.canonicalizeField(data, fieldName)
+}
+
+func (c *canonicalization) canonicalizeField(data interface{}, fieldName string) ([]byte, string, error) {
+	field, start, err := structField(data, fieldName)
 	if err != nil {
-		// No namespaces yet declare ours
-		if strings.HasPrefix(namespace, "http") {
-			fmt.Fprintf(writer, " %s=\"%s\"", "xmlns", namespace)
+		return nil, "", err
+	}
+	return c.canonicalize(fieldElement{field, start})
+}
+
+// CanonicalizeNodeSet produces canonical XML for the node-set made of the
+// elements of doc with the IDs and their descendants, such as the siblings
+// selected by an XPath filtered reference. The elements are rendered in
+// document order, each with its namespace context worked out independently,
+// and an element within another is only rendered once. Exclusive XML
+// Canonicalization is used.
+func CanonicalizeNodeSet(doc []byte, ids ...string) (_ []byte, err error) {
+	defer recoverPanic(&err, nil)
+	index, err := indexDocument(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]int, len(ids))
+	for i, id := range ids {
+		if positions[i], err = index.lookupID(id); err != nil {
+			return nil, err
 		}
-	} else {
-		// Different namespace declare ours
-		if currentNs != namespace {
-			if strings.HasPrefix(namespace, "http") {
-				fmt.Fprintf(writer, " %s=\"%s\"", "xmlns", namespace)
+	}
+	c, _ := pickCanonicalization("")
+	var out bytes.Buffer
+	if err := c.writeNodeSet(&out, doc, index, positions); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeNodeSet writes the concatenated canonical form of the elements at the
+// positions along with their descendants.
+func (c *canonicalization) writeNodeSet(w io.Writer, doc []byte, index *document, positions []int) error {
+	sorted := append([]int(nil), positions...)
+	sort.Ints(sorted)
+	for i, pos := range sorted {
+		covered := false
+		for _, previous := range sorted[:i] {
+			if previous == pos || index.contains(previous, pos) {
+				covered = true
 			}
 		}
+		if covered {
+			continue
+		}
+		if _, err := c.write(w, bytes.NewReader(doc), subset{pos, -1}); err != nil {
+			return err
+		}
 	}
-	namespaces.Push(namespace)
+	return nil
 }
 
-func writeStartElement(writer io.Writer, start xml.StartElement, namespaces *stack) {
-	if !strings.HasPrefix(start.Name.Space, "http") {
-		fmt.Fprintf(writer, "<%s:%s", start.Name.Space, start.Name.Local)
-	} else {
-		fmt.Fprintf(writer, "<%s", start.Name.Local)
+// fieldElement marshals a struct field using the start element it has within
+// its parent.
+type fieldElement struct {
+	value interface{}
+	start *xml.StartElement
+}
+
+// MarshalXML is part of xml.Marshaler.
+func (f fieldElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if f.start == nil {
+		return e.Encode(f.value)
 	}
-	sort.Sort(canonAtt(start.Attr))
+	return e.EncodeElement(f.value, *f.start)
+}
 
-	writeNameSapce(namespaces, writer, start)
+// structField looks up fieldName in the struct data. The returned start
+// element is nil when the field's type names its own element via XMLName.
+func structField(data interface{}, fieldName string) (interface{}, *xml.StartElement, error) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil, errors.New("xmlsig cannot canonicalize a field of a nil value")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, nil, errors.New("xmlsig can only canonicalize fields of a struct")
+	}
+	sf, ok := v.Type().FieldByName(fieldName)
+	if !ok {
+		return nil, nil, fmt.Errorf("xmlsig could not find field %s", fieldName)
+	}
+	if sf.PkgPath != "" {
+		return nil, nil, fmt.Errorf("xmlsig cannot canonicalize unexported field %s", fieldName)
+	}
+	fv := v.FieldByIndex(sf.Index)
+	if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface) && fv.IsNil() {
+		return nil, nil, fmt.Errorf("xmlsig cannot canonicalize nil field %s", fieldName)
+	}
+	if namesItself(fv) {
+		return fv.Interface(), nil, nil
+	}
+	tag := sf.Tag.Get("xml")
+	if tag == "-" {
+		return nil, nil, fmt.Errorf("xmlsig cannot canonicalize field %s because it is not marshalled", fieldName)
+	}
+	if i := strings.Index(tag, ","); i >= 0 {
+		if tag[i:] != ",omitempty" {
+			return nil, nil, fmt.Errorf("xmlsig cannot canonicalize field %s because it is not an element", fieldName)
+		}
+		tag = tag[:i]
+	}
+	if strings.Contains(tag, ">") {
+		return nil, nil, fmt.Errorf("xmlsig cannot canonicalize field %s because it uses a parent path", fieldName)
+	}
+	start := &xml.StartElement{Name: xml.Name{Local: sf.Name}}
+	if i := strings.LastIndex(tag, " "); i >= 0 {
+		start.Name.Space, tag = tag[:i], tag[i+1:]
+	}
+	if tag != "" {
+		start.Name.Local = tag
+	}
+	return fv.Interface(), start, nil
+}
 
-	nsmap := make(map[string]string)
+// namesItself reports whether the XMLName field of v determines its element
+// name, which takes precedence over the tag of the field holding v.
+func namesItself(v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	sf, ok := v.Type().FieldByName("XMLName")
+	if !ok {
+		return false
+	}
+	if tag := strings.Split(sf.Tag.Get("xml"), ","); tag[0] != "" {
+		return true
+	}
+	name, ok := v.FieldByIndex(sf.Index).Interface().(xml.Name)
+	return ok && name.Local != ""
+}
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;",
+		"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// attrWhitespaceReader normalizes the attribute values of the XML read through
+// it as an XML processor does: a literal tab, line feed, carriage return or
+// CR LF pair becomes a space. The decoder replaces character references before
+// the canonical form is written, so this has to be done on the raw input for
+// references such as &#xA; to be kept rather than normalized.
+type attrWhitespaceReader struct {
+	r     io.Reader
+	state markupState
+	// quote is the delimiter of the attribute value being read
+	quote byte
+	// depth counts the angle brackets open within a directive
+	depth int
+	// last holds the two bytes before the current one to find the end of
+	// comments, CDATA sections and processing instructions
+	last [2]byte
+	// afterCR is set when an attribute value's carriage return was replaced,
+	// so that a line feed following it is dropped
+	afterCR bool
+}
+
+// markupState is where in the markup an attrWhitespaceReader is.
+type markupState int
+
+const (
+	inText markupState = iota
+	inOpen
+	inBang
+	inTag
+	inComment
+	inCDATA
+	inProcInst
+	inDirective
+)
+
+// Read is part of io.Reader. The input is rewritten in place, which only ever
+// drops bytes.
+func (a *attrWhitespaceReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	w := 0
+	for _, b := range p[:n] {
+		if a.state == inTag && a.quote != 0 {
+			switch b {
+			case '\n':
+				if a.afterCR {
+					a.afterCR = false
+					continue
+				}
+				b = ' '
+			case '\r':
+				a.afterCR = true
+				p[w] = ' '
+				w++
+				continue
+			case '\t':
+				b = ' '
+			case a.quote:
+				a.quote = 0
+			}
+			a.afterCR = false
+		} else {
+			a.step(b)
+		}
+		a.last[0], a.last[1] = a.last[1], b
+		p[w] = b
+		w++
+	}
+	return w, err
+}
+
+// step moves the reader past b outside of an attribute value.
+func (a *attrWhitespaceReader) step(b byte) {
+	switch a.state {
+	case inText:
+		if b == '<' {
+			a.state = inOpen
+		}
+	case inOpen:
+		switch b {
+		case '!':
+			a.state = inBang
+		case '?':
+			a.state = inProcInst
+		default:
+			a.state = inTag
+		}
+	case inBang:
+		switch b {
+		case '-':
+			a.state = inComment
+		case '[':
+			a.state = inCDATA
+		default:
+			a.state, a.depth = inDirective, 1
+		}
+	case inTag:
+		switch b {
+		case '"', '\'':
+			a.quote = b
+		case '>':
+			a.state = inText
+		}
+	case inComment:
+		if b == '>' && a.last == [2]byte{'-', '-'} {
+			a.state = inText
+		}
+	case inCDATA:
+		if b == '>' && a.last == [2]byte{']', ']'} {
+			a.state = inText
+		}
+	case inProcInst:
+		if b == '>' && a.last[1] == '?' {
+			a.state = inText
+		}
+	case inDirective:
+		switch {
+		case a.quote != 0:
+			if b == a.quote {
+				a.quote = 0
+			}
+		case b == '"' || b == '\'':
+			a.quote = b
+		case b == '<':
+			a.depth++
+		case b == '>':
+			if a.depth--; a.depth == 0 {
+				a.state = inText
+			}
+		}
+	}
+}
+
+// nsFrame holds the namespaces an element declares in the input and those
+// rendered on it in the canonical output. Both are keyed by prefix, with the
+// empty prefix standing for the default namespace.
+type nsFrame struct {
+	declared map[string]string
+	rendered map[string]string
+	// xmlAttrs holds the attributes in the xml namespace, such as xml:lang, the
+	// element has in the input, keyed by local name.
+	xmlAttrs map[string]string
+}
+
+// lookupNamespace finds the namespace bound to prefix by the elements on the
+// stack, in the canonical output when rendered is set or in the input otherwise.
+func lookupNamespace(namespaces *stack, prefix string, rendered bool) (string, bool) {
+	for i := namespaces.Len() - 1; i >= 0; i-- {
+		frame := (*namespaces)[i].(*nsFrame)
+		bindings := frame.declared
+		if rendered {
+			bindings = frame.rendered
+		}
+		if uri, ok := bindings[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// preservesSpace reports whether xml:space="preserve" applies to the content
+// of the innermost element on the stack.
+func preservesSpace(namespaces *stack) bool {
+	for i := namespaces.Len() - 1; i >= 0; i-- {
+		if space, ok := (*namespaces)[i].(*nsFrame).xmlAttrs["space"]; ok {
+			return space == "preserve"
+		}
+	}
+	return false
+}
+
+// declaredPrefixes lists the prefixes declared by the elements on the stack.
+// They are sorted so that nothing depends on the order of map iteration.
+func declaredPrefixes(namespaces *stack) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, f := range *namespaces {
+		for prefix := range f.(*nsFrame).declared {
+			if !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// namespacesInScope returns the namespace declarations in scope for the
+// children of the element at the position in document order.
+func namespacesInScope(doc []byte, position int) (map[string]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	namespaces := &stack{}
+	for i := 0; ; {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			frame := &nsFrame{declared: make(map[string]string)}
+			for _, att := range t.Attr {
+				if att.Name.Space == "xmlns" {
+					frame.declared[att.Name.Local] = att.Value
+				} else if isNamespaceDeclaration(att.Name) {
+					frame.declared[""] = att.Value
+				}
+			}
+			namespaces.Push(frame)
+			if i == position {
+				scope := make(map[string]string)
+				for _, prefix := range declaredPrefixes(namespaces) {
+					scope[prefix], _ = lookupNamespace(namespaces, prefix, false)
+				}
+				return scope, nil
+			}
+			i++
+		case xml.EndElement:
+			namespaces.Pop()
+		}
+	}
+}
+
+// renamePrefix returns the start element with its name using the prefix for
+// its namespace, or the default namespace when prefix is empty, and declaring
+// the namespace unless it already does.
+func renamePrefix(start xml.StartElement, namespaces *stack, prefix string) (xml.StartElement, error) {
+	uri, ok := "", false
 	for _, att := range start.Attr {
-		// Skip xmlns declarations they're handled above
-		if "xmlns" == att.Name.Local {
+		if isNamespaceDeclaration(att.Name) && declaredPrefix(att.Name) == start.Name.Space {
+			uri, ok = att.Value, true
+		}
+	}
+	if !ok {
+		uri, _ = lookupNamespace(namespaces, start.Name.Space, false)
+	}
+	if uri == "" && prefix != "" {
+		return start, fmt.Errorf("xmlsig can not render %s with a prefix as it has no namespace", start.Name.Local)
+	}
+	declared := uri == "" && prefix == ""
+	attrs := make([]xml.Attr, 0, len(start.Attr)+1)
+	for _, att := range start.Attr {
+		if isNamespaceDeclaration(att.Name) && declaredPrefix(att.Name) == prefix {
+			if att.Value != uri {
+				return start, fmt.Errorf("xmlsig can not render %s with the prefix %s bound to another namespace", start.Name.Local, prefix)
+			}
+			declared = true
+		}
+		attrs = append(attrs, att)
+	}
+	if !declared {
+		name := xml.Name{Space: "xmlns", Local: prefix}
+		if prefix == "" {
+			name = xml.Name{Local: "xmlns"}
+		}
+		attrs = append(attrs, xml.Attr{Name: name, Value: uri})
+	}
+	start.Name.Space = prefix
+	start.Attr = attrs
+	return start, nil
+}
+
+// defaultNamespace returns the default namespace that applies to the start
+// element in the input.
+func defaultNamespace(start xml.StartElement, namespaces *stack) string {
+	for _, att := range start.Attr {
+		if att.Name.Space == "" && att.Name.Local == "xmlns" {
+			return att.Value
+		}
+	}
+	uri, _ := lookupNamespace(namespaces, "", false)
+	return uri
+}
+
+// declaresDefault reports whether the start element declares the default
+// namespace.
+func declaresDefault(start xml.StartElement) bool {
+	for _, att := range start.Attr {
+		if att.Name.Space == "" && att.Name.Local == "xmlns" {
+			return true
+		}
+	}
+	return false
+}
+
+// innermostDefault returns the frame of the innermost element on the stack
+// declaring the default namespace, or nil.
+func innermostDefault(namespaces *stack) *nsFrame {
+	for i := namespaces.Len() - 1; i >= 0; i-- {
+		frame := (*namespaces)[i].(*nsFrame)
+		if _, ok := frame.declared[""]; ok {
+			return frame
+		}
+	}
+	return nil
+}
+
+// declaredPrefix returns the prefix a namespace declaration binds, which is
+// empty for the default namespace.
+func declaredPrefix(name xml.Name) string {
+	if name.Space == "" {
+		return ""
+	}
+	return name.Local
+}
+
+func isNamespaceDeclaration(name xml.Name) bool {
+	return name.Space == "xmlns" || (name.Space == "" && name.Local == "xmlns")
+}
+
+// writeName writes the name as qualifiedName returns it.
+func writeName(writer canonWriter, name xml.Name) {
+	if name.Space != "" {
+		writer.WriteString(name.Space)
+		writer.WriteByte(':')
+	}
+	writer.WriteString(name.Local)
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// writeNamespaces determines the namespace declarations to render for the
+// prefixes used by an element. A declaration is only rendered when the prefix
+// isn't already bound to the same namespace in the output, so a prefix bound
+// to a different namespace than in an ancestor is declared again.
+func writeNamespaces(namespaces *stack, frame *nsFrame, prefixes []string) []xml.Attr {
+	var decls []xml.Attr
+	for _, prefix := range prefixes {
+		if prefix == "xml" {
 			continue
 		}
-		// is this a declaration for an attribute namespace
-		if "xmlns" == att.Name.Space {
-			fmt.Fprintf(writer, " xmlns:%s=\"%s\"", att.Name.Local, att.Value)
-			nsmap[att.Value] = att.Name.Local
+		if _, done := frame.rendered[prefix]; done {
 			continue
 		}
-		// is attribute namespaced?
-		if att.Name.Space == "" {
-			fmt.Fprintf(writer, " %s=\"%s\"", att.Name.Local, att.Value)
+		uri, declared := lookupNamespace(namespaces, prefix, false)
+		if !declared && prefix != "" {
+			// An undeclared prefix is passed through as written
+			continue
+		}
+		current, _ := lookupNamespace(namespaces, prefix, true)
+		if current == uri {
+			continue
+		}
+		if frame.rendered == nil {
+			frame.rendered = make(map[string]string)
+		}
+		frame.rendered[prefix] = uri
+		if prefix == "" {
+			decls = append(decls, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: uri})
 		} else {
-			fmt.Fprintf(writer, " %s:%s=\"%s\"", nsmap[att.Name.Space], att.Name.Local, att.Value)
+			decls = append(decls, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: uri})
 		}
 	}
-	fmt.Fprint(writer, ">")
+	return decls
+}
+
+func (c *canonicalization) writeStartElement(writer canonWriter, start xml.StartElement, namespaces *stack, visible, apex bool) {
+	frame := &nsFrame{}
+	var attrs []xml.Attr
+	if apex && !c.exclusive {
+		attrs = c.inheritedXMLAttrs(start, namespaces)
+	}
+	for _, att := range start.Attr {
+		if apex && c.version11 && !c.exclusive && att.Name.Space == "xml" && att.Name.Local == "base" {
+			// the inherited attributes include the resolved xml:base
+			continue
+		}
+		if att.Name.Space == "xml" {
+			if frame.xmlAttrs == nil {
+				frame.xmlAttrs = make(map[string]string)
+			}
+			frame.xmlAttrs[att.Name.Local] = att.Value
+		}
+		if isNamespaceDeclaration(att.Name) {
+			if frame.declared == nil {
+				frame.declared = make(map[string]string)
+			}
+			if att.Name.Space == "" {
+				frame.declared[""] = att.Value
+			} else {
+				frame.declared[att.Name.Local] = att.Value
+			}
+			continue
+		}
+		attrs = append(attrs, att)
+	}
+	namespaces.Push(frame)
+	if !visible {
+		// The declarations still apply to visible descendants
+		return
+	}
+	writer.WriteByte('<')
+	writeName(writer, start.Name)
+
+	// Attributes are sorted by namespace rather than prefix, so resolve them
+	// and remember the prefix each one was written with. Each prefix is only
+	// looked up once however many attributes use it. The maps are only made
+	// for elements with prefixed attributes, which most elements don't have.
+	used := []string{start.Name.Space}
+	var resolved map[string]string
+	var prefixMap map[xml.Name]string
+	for i, att := range attrs {
+		prefix := att.Name.Space
+		if prefix == "" {
+			continue
+		}
+		if resolved == nil {
+			resolved = make(map[string]string)
+			prefixMap = make(map[xml.Name]string)
+		}
+		uri, seen := resolved[prefix]
+		if !seen {
+			used = append(used, prefix)
+			var ok bool
+			uri, ok = lookupNamespace(namespaces, prefix, false)
+			if prefix == "xml" {
+				uri, ok = xmlNamespace, true
+			}
+			if !ok {
+				uri = prefix
+			}
+			resolved[prefix] = uri
+		}
+		attrs[i].Name.Space = uri
+		prefixMap[attrs[i].Name] = prefix
+	}
+	if !c.exclusive {
+		// Inclusive canonicalization renders every namespace in scope, not
+		// just those the element uses
+		used = append(used, declaredPrefixes(namespaces)...)
+	} else {
+		// Namespaces in the PrefixList are rendered whether they are used or
+		// not, so the apex declares them if they are in scope
+		used = append(used, c.inclusive...)
+	}
+	attrs = append(writeNamespaces(namespaces, frame, used), attrs...)
+	sort.Sort(canonAtt(attrs))
+
+	for _, att := range attrs {
+		writer.WriteByte(' ')
+		switch {
+		case att.Name.Space == "xmlns":
+			writer.WriteString("xmlns:")
+		case att.Name.Space != "":
+			writer.WriteString(prefixMap[att.Name])
+			writer.WriteByte(':')
+		}
+		writer.WriteString(att.Name.Local)
+		writer.WriteString("=\"")
+		attrEscaper.WriteString(writer, att.Value)
+		writer.WriteByte('"')
+	}
+	writer.WriteByte('>')
+}
+
+// inheritedXMLAttrs returns the attributes in the xml namespace that the apex
+// of a document subset inherits from ancestors outside the subset, which
+// inclusive canonicalization renders on the apex unless it has them itself.
+// Canonical XML 1.1 only inherits xml:lang and xml:space.
+func (c *canonicalization) inheritedXMLAttrs(start xml.StartElement, namespaces *stack) []xml.Attr {
+	inherited := make(map[string]string)
+	var bases []string
+	for _, f := range *namespaces {
+		for local, value := range f.(*nsFrame).xmlAttrs {
+			inherited[local] = value
+		}
+		if base, ok := f.(*nsFrame).xmlAttrs["base"]; ok {
+			bases = append(bases, base)
+		}
+	}
+	for _, att := range start.Attr {
+		if att.Name.Space == "xml" {
+			delete(inherited, att.Name.Local)
+			if att.Name.Local == "base" {
+				bases = append(bases, att.Value)
+			}
+		}
+	}
+	var attrs []xml.Attr
+	for local, value := range inherited {
+		if c.version11 && local != "lang" && local != "space" {
+			continue
+		}
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Space: "xml", Local: local}, Value: value})
+	}
+	if c.version11 && len(bases) > 0 {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Space: "xml", Local: "base"}, Value: joinBases(bases)})
+	}
+	return attrs
+}
+
+// joinBases resolves each xml:base against the ones before it, outermost
+// first, for the xml:base fixup of Canonical XML 1.1. Relative bases are
+// joined without removing leading .. segments, which can't be resolved.
+func joinBases(bases []string) string {
+	joined := bases[0]
+	for _, base := range bases[1:] {
+		parent, err := url.Parse(joined)
+		if err != nil {
+			joined = base
+			continue
+		}
+		ref, err := url.Parse(base)
+		switch {
+		case err != nil || ref.IsAbs() || strings.HasPrefix(base, "/"):
+			joined = base
+		case parent.IsAbs():
+			joined = parent.ResolveReference(ref).String()
+		default:
+			joined = joined[:strings.LastIndex(joined, "/")+1] + base
+		}
+	}
+	return joined
+}
+
+func writeProcInst(writer io.Writer, pi xml.ProcInst) {
+	if len(pi.Inst) == 0 {
+		fmt.Fprintf(writer, "<?%s?>", pi.Target)
+		return
+	}
+	fmt.Fprintf(writer, "<?%s %s?>", pi.Target, pi.Inst)
 }
 
 // Attributes must be sorted as part of canonicalization. This type implements sort.Interface for a slice of xml.Attr.
@@ -130,31 +1231,29 @@ func (att canonAtt) Swap(i, j int) {
 	att[i], att[j] = att[j], att[i]
 }
 
-// Less is part of sort.Interface.
+// Less is part of sort.Interface. The default namespace declaration goes
+// first, then the other declarations by prefix, then the attributes by
+// namespace URI and local name.
 func (att canonAtt) Less(i, j int) bool {
 	iName := att[i].Name
 	jName := att[j].Name
-	// xmlns without prefix goes first
-	if iName.Local == "xmlns" {
-		return true
+	if iRank, jRank := attributeRank(iName), attributeRank(jName); iRank != jRank {
+		return iRank < jRank
 	}
-	if jName.Local == "xmlns" {
-		return false
-	}
-	// namespace declarations go next sorted by prefix
-	if iName.Space == "xmlns" {
-		if jName.Space != "xmlns" {
-			return true
-		}
-		return iName.Local < jName.Local
-	}
-	if jName.Space == "xmlns" {
-		// we know iName Space isn't xmlns
-		return false
-	}
-	// Lastly sort by attribute name namespace first
 	if iName.Space != jName.Space {
 		return iName.Space < jName.Space
 	}
 	return iName.Local < jName.Local
 }
+
+// attributeRank orders the kinds of attribute, so that comparing within a
+// kind never has to consider the others.
+func attributeRank(name xml.Name) int {
+	switch {
+	case name.Space == "" && name.Local == "xmlns":
+		return 0
+	case name.Space == "xmlns":
+		return 1
+	}
+	return 2
+}
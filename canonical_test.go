@@ -1,8 +1,17 @@
 package xmlsig
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 type Root struct {
@@ -61,3 +70,642 @@ func TestCanonicalization(t *testing.T) {
 		t.Fatalf("expected output of %s but got %s", expected, actual)
 	}
 }
+
+type PrefixRoot struct {
+	XMLName   xml.Name `xml:"p:root"`
+	Namespace string   `xml:"xmlns:p,attr"`
+	Child     PrefixChild
+	Sibling   string `xml:"p:sibling"`
+}
+
+type PrefixChild struct {
+	XMLName    xml.Name `xml:"p:child"`
+	Namespace  string   `xml:"xmlns:p,attr"`
+	Grandchild string   `xml:"p:grandchild"`
+}
+
+func TestCanonicalizationPrefixRebinding(t *testing.T) {
+	element := &PrefixRoot{
+		Namespace: "urn:a",
+		Child:     PrefixChild{Namespace: "urn:b", Grandchild: "data"},
+		Sibling:   "data",
+	}
+	data, _, err := canonicalize(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := string(data)
+	expected := `<p:root xmlns:p="urn:a"><p:child xmlns:p="urn:b"><p:grandchild>data</p:grandchild></p:child><p:sibling>data</p:sibling></p:root>`
+	if actual != expected {
+		t.Fatalf("expected output of %s but got %s", expected, actual)
+	}
+}
+
+func TestCanonicalizationEscaping(t *testing.T) {
+	element := &Root{B: `"a" & <b>`, Child: Child{Data: `1 < 2 & "3" > 2`}}
+	data, _, err := canonicalize(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := string(data)
+	expected := `<root xmlns="tns" xmlns:attr="http://someotherns/for/attr" xmlns:be="anotherns/be" b="&quot;a&quot; &amp; &lt;b>" be:a="" attr:a=""><child>1 &lt; 2 &amp; "3" &gt; 2</child></root>`
+	if actual != expected {
+		t.Fatalf("expected output of %s but got %s", expected, actual)
+	}
+}
+
+func TestExclusiveCanonicalizationPrefixList(t *testing.T) {
+	// The element is canonicalized as part of the document, so the
+	// namespaces declared by root are in scope but not visibly utilized
+	doc := `<root xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b" xmlns:c="urn:c"><a:child ID="x"><b:item>text</b:item></a:child></root>`
+	for _, test := range []struct {
+		prefixList string
+		expected   string
+	}{
+		{"", `<a:child xmlns:a="urn:a" ID="x"><b:item xmlns:b="urn:b">text</b:item></a:child>`},
+		{"#default", `<a:child xmlns="urn:default" xmlns:a="urn:a" ID="x"><b:item xmlns:b="urn:b">text</b:item></a:child>`},
+		{"b  c", `<a:child xmlns:a="urn:a" xmlns:b="urn:b" xmlns:c="urn:c" ID="x"><b:item>text</b:item></a:child>`},
+		{"#default b d", `<a:child xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b" ID="x"><b:item>text</b:item></a:child>`},
+	} {
+		c, err := pickCanonicalization(xMLexcC14Namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err = c.withPrefixList(test.prefixList); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if _, err := c.write(&out, strings.NewReader(doc), subset{1, -1}); err != nil {
+			t.Fatal(err)
+		}
+		if actual := out.String(); actual != test.expected {
+			t.Fatalf("expected output of %s for %q but got %s", test.expected, test.prefixList, actual)
+		}
+	}
+	c, _ := pickCanonicalization(c14n10Namespace)
+	if _, err := c.withPrefixList("a"); err == nil {
+		t.Fatal("expected an error for a prefix list with inclusive canonicalization")
+	}
+}
+
+func TestCanonAttOrdering(t *testing.T) {
+	spaces := []string{"", "xmlns", "urn:a", "urn:b", "x"}
+	locals := []string{"xmlns", "a", "b", "Id"}
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		attrs := make(canonAtt, 2+random.Intn(8))
+		for i := range attrs {
+			attrs[i].Name = xml.Name{Space: spaces[random.Intn(len(spaces))], Local: locals[random.Intn(len(locals))]}
+		}
+		for i := range attrs {
+			if attrs.Less(i, i) {
+				t.Fatalf("%v is less than itself", attrs[i].Name)
+			}
+			for j := range attrs {
+				if attrs.Less(i, j) && attrs.Less(j, i) {
+					t.Fatalf("%v and %v are both less than each other", attrs[i].Name, attrs[j].Name)
+				}
+				for k := range attrs {
+					if attrs.Less(i, j) && attrs.Less(j, k) && !attrs.Less(i, k) {
+						t.Fatalf("ordering of %v, %v and %v is not transitive", attrs[i].Name, attrs[j].Name, attrs[k].Name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkCanonicalizeManyAttributes(b *testing.B) {
+	var doc strings.Builder
+	doc.WriteString("<root")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&doc, ` xmlns:p%d="urn:p%d"`, i, i)
+	}
+	doc.WriteString("><element")
+	for i := 0; i < 500; i++ {
+		if i%2 == 0 {
+			fmt.Fprintf(&doc, ` a%d="%d"`, i, i)
+		} else {
+			fmt.Fprintf(&doc, ` p%d:a%d="%d"`, i%10, i, i)
+		}
+	}
+	doc.WriteString("/></root>")
+	data := []byte(doc.String())
+	c, _ := pickCanonicalization("")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.write(io.Discard, bytes.NewReader(data), wholeDocument); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// largeElement returns a document with an element holding many children.
+func largeElement() []byte {
+	var doc strings.Builder
+	doc.WriteString(`<root xmlns="urn:root"><element ID="_large">`)
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&doc, `<item n="%d">value %d</item>`, i, i)
+	}
+	doc.WriteString("</element></root>")
+	return []byte(doc.String())
+}
+
+func BenchmarkDigestStreaming(b *testing.B) {
+	data := largeElement()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := sha256.New()
+		if err := CanonicalizeTo(h, data, "_large"); err != nil {
+			b.Fatal(err)
+		}
+		h.Sum(nil)
+	}
+}
+
+func BenchmarkDigestBuffered(b *testing.B) {
+	data := largeElement()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var canonical bytes.Buffer
+		if err := CanonicalizeTo(&canonical, data, "_large"); err != nil {
+			b.Fatal(err)
+		}
+		sha256.Sum256(canonical.Bytes())
+	}
+}
+
+func TestCanonicalizeTo(t *testing.T) {
+	data := []byte(`<root xmlns="urn:root" xmlns:x="urn:x"><element ID="_e"><item/></element></root>`)
+	var out bytes.Buffer
+	if err := CanonicalizeTo(&out, data, "_e"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `<element xmlns="urn:root" ID="_e"><item></item></element>`
+	if out.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, out.String())
+	}
+	c, _ := pickCanonicalization("")
+	sum, err := c.digest(crypto.SHA256, bytes.NewReader(data), subset{1, -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered := sha256.Sum256(out.Bytes()); !bytes.Equal(sum, buffered[:]) {
+		t.Fatal("expected the streamed digest to match the digest of the canonical bytes")
+	}
+	if err := CanonicalizeTo(&out, data, "_missing"); err == nil {
+		t.Fatal("expected an error for an unknown ID")
+	}
+}
+
+func TestCanonicalizationDeterministic(t *testing.T) {
+	var doc strings.Builder
+	doc.WriteString(`<root xmlns="urn:default"`)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&doc, ` xmlns:p%d="urn:p%d"`, i, i)
+	}
+	doc.WriteString(`><child xmlns:p3="urn:other"`)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&doc, ` p%d:a="%d"`, i, i)
+	}
+	doc.WriteString(`><p7:leaf xmlns:q="urn:q" q:b="1"/></child></root>`)
+	data := []byte(doc.String())
+	for _, method := range []string{c14n10Namespace, xMLexcC14Namespace} {
+		// The subset inherits every namespace in scope of the child
+		c, _ := pickCanonicalization(method)
+		var expected bytes.Buffer
+		if _, err := c.write(&expected, bytes.NewReader(data), subset{1, -1}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			var out bytes.Buffer
+			if _, err := c.write(&out, bytes.NewReader(data), subset{1, -1}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), expected.Bytes()) {
+				t.Fatalf("canonicalization using %s is not deterministic:\n%s\n%s", method, expected.Bytes(), out.Bytes())
+			}
+		}
+	}
+}
+
+func TestCanonicalizeNodeSet(t *testing.T) {
+	doc := []byte(`<root xmlns="urn:r" xmlns:a="urn:a"><a:one ID="_1" a:x="1">One</a:one> text <two ID="_2"><a:nested ID="_3"/></two><three/></root>`)
+	// The text between the elements isn't part of the node-set and each element
+	// declares the namespaces it needs
+	expected := `<a:one xmlns:a="urn:a" ID="_1" a:x="1">One</a:one><two xmlns="urn:r" ID="_2"><a:nested xmlns:a="urn:a" ID="_3"></a:nested></two>`
+	out, err := CanonicalizeNodeSet(doc, "_2", "_1", "_3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Fatalf("expected %s but got %s", expected, out)
+	}
+	// Inclusive canonicalization renders every namespace in scope on each element
+	expected = `<a:one xmlns="urn:r" xmlns:a="urn:a" ID="_1" a:x="1">One</a:one><two xmlns="urn:r" xmlns:a="urn:a" ID="_2"><a:nested ID="_3"></a:nested></two>`
+	index, err := indexDocument(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := pickCanonicalization(c14n10Namespace)
+	var inclusive bytes.Buffer
+	if err := c.writeNodeSet(&inclusive, doc, index, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if inclusive.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, inclusive.Bytes())
+	}
+	if _, err := CanonicalizeNodeSet(doc, "_missing"); err == nil {
+		t.Fatal("expected an error for an unknown ID")
+	}
+}
+
+func TestInheritedXMLAttributes(t *testing.T) {
+	doc := []byte(`<root xml:lang="en" xml:space="preserve"><parent xml:base="http://example.com/" xml:space="default"><signed ID="_s" xml:space="preserve"><child/></signed></parent></root>`)
+	for _, test := range []struct {
+		method   string
+		expected string
+	}{
+		{c14n10Namespace, `<signed ID="_s" xml:base="http://example.com/" xml:lang="en" xml:space="preserve"><child></child></signed>`},
+		{c14n11Namespace, `<signed ID="_s" xml:base="http://example.com/" xml:lang="en" xml:space="preserve"><child></child></signed>`},
+		{xMLexcC14Namespace, `<signed ID="_s" xml:space="preserve"><child></child></signed>`},
+	} {
+		c, _ := pickCanonicalization(test.method)
+		var out bytes.Buffer
+		if _, err := c.write(&out, bytes.NewReader(doc), subset{2, -1}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Fatalf("expected %s using %s but got %s", test.expected, test.method, out.Bytes())
+		}
+	}
+}
+
+func TestCanonicalVersions(t *testing.T) {
+	doc := []byte(`<root xml:id="r" xml:lang="en" xml:base="http://example.com/a/b"><p xml:base="c/"><item ID="_i" xml:base="d/e.xml"/></p></root>`)
+	versions := map[string]string{
+		// Canonical XML 1.0 inherits every xml attribute as it is
+		c14n10Namespace: `<item ID="_i" xml:base="d/e.xml" xml:id="r" xml:lang="en"></item>`,
+		// 1.1 doesn't inherit xml:id and resolves xml:base against the ancestors
+		c14n11Namespace: `<item ID="_i" xml:base="http://example.com/a/c/d/e.xml" xml:lang="en"></item>`,
+	}
+	for method, expected := range versions {
+		c, _ := pickCanonicalization(method)
+		var out bytes.Buffer
+		if _, err := c.write(&out, bytes.NewReader(doc), subset{2, -1}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected {
+			t.Fatalf("expected %s using %s but got %s", expected, method, out.Bytes())
+		}
+	}
+	if joined := joinBases([]string{"../x/", "y/", "z.xml"}); joined != "../x/y/z.xml" {
+		t.Fatalf("expected relative bases to be joined but got %s", joined)
+	}
+
+	// the verifier canonicalizes with the version the transform declares
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, expected := range versions {
+		sum := sha256.Sum256([]byte(expected))
+		reference := Reference{URI: "#_i", DigestValue: base64.StdEncoding.EncodeToString(sum[:])}
+		reference.Transforms.Transform = []Algorithm{{Algorithm: method}}
+		sig, err := CreateSignatureWithReferences(signer, reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := xml.Marshal(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := bytes.Replace(doc, []byte("</root>"), append(data, "</root>"...), 1)
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatalf("expected the %s digest to verify but got %v", method, err)
+		}
+		other := c14n10Namespace
+		if method == c14n10Namespace {
+			other = c14n11Namespace
+		}
+		swapped := bytes.Replace(signed, []byte(`Algorithm="`+method+`"`), []byte(`Algorithm="`+other+`"`), 1)
+		if err := NewVerifier().Verify(swapped); err == nil {
+			t.Fatalf("expected the %s digest not to verify with %s", method, other)
+		}
+	}
+}
+
+func TestCanonicalizeForEncryption(t *testing.T) {
+	envelope := &Envelope{ID: "_e", Data: "caf\u00e9 & cr\u00e8me"}
+	fromValue, err := Canonicalize(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- before -->\n<?pi outside?>\n" + string(fromValue) + "\n<!-- after -->\n"
+	fromBytes, err := Canonicalize([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<Envelope xmlns="urn:envelope" ID="_e"><Data>café &amp; crème</Data></Envelope>`
+	for _, canonical := range [][]byte{fromValue, fromBytes} {
+		if string(canonical) != expected {
+			t.Fatalf("expected %s but got %s", expected, canonical)
+		}
+		// the plaintext is a single element that parses on its own
+		decoder := xml.NewDecoder(bytes.NewReader(canonical))
+		token, err := decoder.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := token.(xml.StartElement); !ok {
+			t.Fatalf("expected the plaintext to start with the element but got %T", token)
+		}
+		if err := decoder.Skip(); err != nil {
+			t.Fatal(err)
+		}
+		if decoder.InputOffset() != int64(len(canonical)) {
+			t.Fatalf("expected nothing after the element in %q", canonical)
+		}
+		var parsed Envelope
+		if err := xml.Unmarshal(canonical, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if parsed.ID != envelope.ID || parsed.Data != envelope.Data {
+			t.Fatalf("expected %+v but got %+v", envelope, parsed)
+		}
+	}
+}
+
+func TestMixedDefaultAndPrefixedNamespace(t *testing.T) {
+	// The assertion namespace is bound to saml on the response and is the
+	// default namespace of the Assertion, inside which saml is used as well
+	// as rebound to another namespace. The expected output was produced by
+	// xmllint --c14n and --exc-c14n.
+	doc := []byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r">` +
+		`<saml:Issuer>idp</saml:Issuer>` +
+		`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a"><Issuer>idp</Issuer>` +
+		`<saml:Subject><NameID saml:Format="x">alice</NameID></saml:Subject>` +
+		`<Conditions xmlns:saml="urn:other"><saml:Audience>sp</saml:Audience></Conditions></Assertion></samlp:Response>`)
+	for _, test := range []struct {
+		method   string
+		expected string
+	}{
+		{c14n10Namespace, `<samlp:Response xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r">` +
+			`<saml:Issuer>idp</saml:Issuer>` +
+			`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a"><Issuer>idp</Issuer>` +
+			`<saml:Subject><NameID saml:Format="x">alice</NameID></saml:Subject>` +
+			`<Conditions xmlns:saml="urn:other"><saml:Audience>sp</saml:Audience></Conditions></Assertion></samlp:Response>`},
+		{xMLexcC14Namespace, `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r">` +
+			`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">idp</saml:Issuer>` +
+			`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a"><Issuer>idp</Issuer>` +
+			`<saml:Subject xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><NameID saml:Format="x">alice</NameID></saml:Subject>` +
+			`<Conditions><saml:Audience xmlns:saml="urn:other">sp</saml:Audience></Conditions></Assertion></samlp:Response>`},
+	} {
+		c, _ := pickCanonicalization(test.method)
+		var out bytes.Buffer
+		if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Fatalf("expected %s using %s but got %s", test.expected, test.method, out.Bytes())
+		}
+	}
+	// Signing the assertion alone renders both bindings of its namespace
+	c, _ := pickCanonicalization("")
+	var out bytes.Buffer
+	if _, err := c.write(&out, bytes.NewReader(doc), subset{2, -1}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a"><Issuer>idp</Issuer>` +
+		`<saml:Subject xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><NameID saml:Format="x">alice</NameID></saml:Subject>` +
+		`<Conditions><saml:Audience xmlns:saml="urn:other">sp</saml:Audience></Conditions></Assertion>`
+	if out.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, out.Bytes())
+	}
+}
+
+func TestNumericCharacterReferences(t *testing.T) {
+	data := []byte(`<doc a="&#169;&#x9;"><item>&#169; 2024 &#x3C;&#62;&#38;</item></doc>`)
+	var out bytes.Buffer
+	c, _ := pickCanonicalization("")
+	if _, err := c.write(&out, bytes.NewReader(data), wholeDocument); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<doc a=\"©&#x9;\"><item>© 2024 &lt;&gt;&amp;</item></doc>"
+	if out.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, out.String())
+	}
+	if !bytes.Contains(out.Bytes(), []byte{0xc2, 0xa9}) {
+		t.Fatal("expected the copyright sign as UTF-8")
+	}
+}
+
+func TestCanonicalizeAdjacentText(t *testing.T) {
+	// each CDATA section and the text around it is read as a separate token
+	data := []byte("<doc><a>x&#13;\ny</a><b>x\r\ny</b><c>x\r<![CDATA[\ny]]></c>" +
+		"<d>caf<![CDATA[\xc3\xa9]]>&#233;\xc3\xa9<![CDATA[\r\n]]>z</d><e>x&#13;&#10;y\r</e></doc>")
+	var out bytes.Buffer
+	c, _ := pickCanonicalization("")
+	if _, err := c.write(&out, bytes.NewReader(data), wholeDocument); err != nil {
+		t.Fatal(err)
+	}
+	// produced with xmllint --exc-c14n
+	expected := "<doc><a>x&#xD;\ny</a><b>x\ny</b><c>x\n\ny</c><d>caf\u00e9\u00e9\u00e9\nz</d><e>x&#xD;\ny\n</e></doc>"
+	if out.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, out.String())
+	}
+}
+
+type namespacedElement struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Child   *namespacedElement
+}
+
+// Any namespace the encoder writes is declared, whatever its scheme, while an
+// element in no namespace doesn't get a declaration.
+func TestNamespaceSchemes(t *testing.T) {
+	for _, ns := range []string{"http://example.com/ns", "https://example.com/ns", "urn:example:ns", "tag:example.com,2024:ns", "custom-scheme"} {
+		element := &namespacedElement{
+			XMLName: xml.Name{Space: ns, Local: "root"},
+			Attr:    []xml.Attr{{Name: xml.Name{Local: "a"}, Value: "1"}},
+			Child:   &namespacedElement{XMLName: xml.Name{Space: ns, Local: "child"}},
+		}
+		data, _, err := canonicalize(element)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `<root xmlns="` + ns + `" a="1"><child></child></root>`
+		if string(data) != expected {
+			t.Errorf("expected %s but got %s", expected, data)
+		}
+	}
+	data, _, err := canonicalize(&namespacedElement{XMLName: xml.Name{Local: "root"}, Attr: []xml.Attr{{Name: xml.Name{Local: "a"}, Value: "1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<root a="1"></root>`; string(data) != expected {
+		t.Errorf("expected %s but got %s", expected, data)
+	}
+}
+
+func TestMinifyForSigning(t *testing.T) {
+	pretty := "<?xml version=\"1.0\"?>\r\n<doc xmlns=\"urn:doc\" ID=\"_d\">\r\n  <item>  one  </item>\r\n  <pre xml:space=\"preserve\">\r\n    <line> </line>\r\n  </pre>\r\n  <note>two\r\nlines</note>\r\n</doc>\r\n"
+	compact := `<doc xmlns="urn:doc" ID="_d"><item>  one  </item><pre xml:space="preserve">` + "\n    <line> </line>\n  " + `</pre><note>two` + "\r\n" + `lines</note></doc>`
+	expected := `<doc xmlns="urn:doc" ID="_d"><item>  one  </item><pre xml:space="preserve">` + "\n    <line> </line>\n  " + `</pre><note>two` + "\n" + `lines</note></doc>`
+	for _, doc := range []string{pretty, compact} {
+		minified, err := MinifyForSigning([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(minified) != expected {
+			t.Fatalf("expected %q but got %q", expected, minified)
+		}
+	}
+
+	// the minified document is what gets signed
+	minified, _ := MinifyForSigning([]byte(pretty))
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument(minified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(signed, minified[:len(minified)-len("</doc>")]) {
+		t.Fatalf("expected the signed document to start with %s but got %s", minified, signed)
+	}
+}
+
+// The same element name recurs at different depths with and without attributes
+// and namespace declarations, which must only apply to the element declaring
+// them and its descendants, never to its siblings. The expected output was
+// produced by xmllint --c14n, --exc-c14n and --c14n11.
+func TestRepeatedElementContext(t *testing.T) {
+	doc := []byte(`<a:root xmlns:a="urn:a" xmlns="urn:d"><item x="1"><item xmlns:b="urn:b" b:y="2"><item/></item>` +
+		`<item xmlns="urn:e" z="3"><b:item xmlns:b="urn:b2"/></item><item/></item><item/>` +
+		`<a:item xmlns:a="urn:a2" a:k="v"><item/><a:item/></a:item><a:item/><item xmlns=""><item/></item><item/></a:root>`)
+	inclusive := `<a:root xmlns="urn:d" xmlns:a="urn:a"><item x="1"><item xmlns:b="urn:b" b:y="2"><item></item></item>` +
+		`<item xmlns="urn:e" z="3"><b:item xmlns:b="urn:b2"></b:item></item><item></item></item><item></item>` +
+		`<a:item xmlns:a="urn:a2" a:k="v"><item></item><a:item></a:item></a:item><a:item></a:item><item xmlns=""><item></item></item><item></item></a:root>`
+	for _, test := range []struct {
+		method   string
+		expected string
+	}{
+		{c14n10Namespace, inclusive},
+		{c14n11Namespace, inclusive},
+		{xMLexcC14Namespace, `<a:root xmlns:a="urn:a"><item xmlns="urn:d" x="1"><item xmlns:b="urn:b" b:y="2"><item></item></item>` +
+			`<item xmlns="urn:e" z="3"><b:item xmlns:b="urn:b2"></b:item></item><item></item></item><item xmlns="urn:d"></item>` +
+			`<a:item xmlns:a="urn:a2" a:k="v"><item xmlns="urn:d"></item><a:item></a:item></a:item><a:item></a:item><item><item></item></item><item xmlns="urn:d"></item></a:root>`},
+	} {
+		c, _ := pickCanonicalization(test.method)
+		var out bytes.Buffer
+		if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Fatalf("expected %s using %s but got %s", test.expected, test.method, out.Bytes())
+		}
+	}
+	// each element rendered alone only gets the declarations in scope for it
+	for _, test := range []struct {
+		method   string
+		apex     int
+		expected string
+	}{
+		{xMLexcC14Namespace, 7, `<item xmlns="urn:d"></item>`},
+		{c14n10Namespace, 7, `<item xmlns="urn:d" xmlns:a="urn:a"></item>`},
+		{xMLexcC14Namespace, 10, `<a:item xmlns:a="urn:a2"></a:item>`},
+		{xMLexcC14Namespace, 11, `<a:item xmlns:a="urn:a"></a:item>`},
+		{c14n10Namespace, 11, `<a:item xmlns="urn:d" xmlns:a="urn:a"></a:item>`},
+		{xMLexcC14Namespace, 13, `<item></item>`},
+		{c14n10Namespace, 13, `<item xmlns:a="urn:a"></item>`},
+		{xMLexcC14Namespace, 14, `<item xmlns="urn:d"></item>`},
+	} {
+		c, _ := pickCanonicalization(test.method)
+		var out bytes.Buffer
+		if _, err := c.write(&out, bytes.NewReader(doc), subset{test.apex, -1}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Fatalf("expected %s for element %d using %s but got %s", test.expected, test.apex, test.method, out.Bytes())
+		}
+	}
+}
+
+// Many namespace declarations in scrambled source order, with the default
+// namespace among them, are sorted with the default first and then by prefix,
+// followed by the attributes sorted by namespace URI and local name. The
+// expected output was produced by xmllint --c14n and --exc-c14n.
+func TestManyNamespaceDeclarations(t *testing.T) {
+	doc := []byte(`<root xmlns:p04="urn:p04" xmlns:soap="urn:soap" xmlns:_u="urn:_u" xmlns:a="urn:a" xmlns:xs="urn:xs" ` +
+		`xmlns="urn:default" xmlns:p05="urn:p05" xmlns:Z="urn:Z" xmlns:b10="urn:b10" xmlns:zz="urn:zz" xmlns:p02="urn:p02" ` +
+		`xmlns:p01="urn:p01" xmlns:b2="urn:b2" xmlns:p07="urn:p07" xmlns:p03="urn:p03" xmlns:p06="urn:p06" p04:at="0" ` +
+		`soap:at="1" _u:at="2" a:at="3" xs:at="4" p05:at="5" Z:at="6" ` +
+		`b10:at="7" zz:at="8" p02:at="9" p01:at="10" b2:at="11" p07:at="12" ` +
+		`p03:at="13" p06:at="14" plain="x"><child/></root>`)
+	expected := `<root xmlns="urn:default" xmlns:Z="urn:Z" xmlns:_u="urn:_u" xmlns:a="urn:a" xmlns:b10="urn:b10" ` +
+		`xmlns:b2="urn:b2" xmlns:p01="urn:p01" xmlns:p02="urn:p02" xmlns:p03="urn:p03" xmlns:p04="urn:p04" xmlns:p05="urn:p05" ` +
+		`xmlns:p06="urn:p06" xmlns:p07="urn:p07" xmlns:soap="urn:soap" xmlns:xs="urn:xs" xmlns:zz="urn:zz" plain="x" ` +
+		`Z:at="6" _u:at="2" a:at="3" b10:at="7" b2:at="11" p01:at="10" ` +
+		`p02:at="9" p03:at="13" p04:at="0" p05:at="5" p06:at="14" p07:at="12" ` +
+		`soap:at="1" xs:at="4" zz:at="8"><child></child></root>`
+	for _, method := range []string{CanonInclusive, CanonInclusive11, CanonExclusive} {
+		c, _ := pickCanonicalization(method)
+		for i := 0; i < 10; i++ {
+			var out bytes.Buffer
+			if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != expected {
+				t.Fatalf("expected %s using %s but got %s", expected, method, out.Bytes())
+			}
+		}
+	}
+}
+
+func TestDetectReferenceID(t *testing.T) {
+	envelope := &Envelope{ID: "_1234", Data: "Hello, World!"}
+	canonical, id, err := canonicalize(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected, err := DetectReferenceID(envelope); err != nil || detected != id || detected != "_1234" {
+		t.Fatalf("expected %s but got %s with %v", id, detected, err)
+	}
+	// canonicalization alone gives the same bytes without scanning for the ID
+	if pure, err := Canonicalize(envelope); err != nil || !bytes.Equal(pure, canonical) {
+		t.Fatalf("expected %s but got %s with %v", canonical, pure, err)
+	}
+	for _, test := range []struct {
+		doc, expected string
+	}{
+		{`<?xml version="1.0"?><!-- c --><doc wsu:Id="_w" xmlns:wsu="urn:wsu"><item ID="_i"/></doc>`, "_w"},
+		{`<doc><item ID="_i"/></doc>`, ""},
+	} {
+		if detected, err := DetectReferenceID([]byte(test.doc)); err != nil || detected != test.expected {
+			t.Fatalf("expected %q for %s but got %q with %v", test.expected, test.doc, detected, err)
+		}
+	}
+	if _, err := DetectReferenceID([]byte(`<!-- nothing -->`)); err != ErrEmptyDocument {
+		t.Fatalf("expected ErrEmptyDocument but got %v", err)
+	}
+}
+
+func TestAttributeWhitespaceAcrossReads(t *testing.T) {
+	// The reader is read a byte at a time, so the CR LF pair of the value is
+	// split between reads.
+	doc := "<a b=\"x\r\ny\tz\" c='&#xA;'><!-- \"\n\" --></a>"
+	c, _ := pickCanonicalization(xMLexcC14WithComments)
+	var out bytes.Buffer
+	if _, err := c.write(&out, iotest.OneByteReader(strings.NewReader(doc)), wholeDocument); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<a b=\"x y z\" c=\"&#xA;\"><!-- \"\n\" --></a>"
+	if out.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, out.String())
+	}
+}
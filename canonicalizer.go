@@ -0,0 +1,266 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"hash"
+	"io"
+	"sort"
+)
+
+// Canonicalizer produces the canonical form of what a reference covers, in
+// place of the package's own canonicalization, such as to use a binding to
+// another C14N implementation. The data is either a value to marshal as XML,
+// or a []byte holding the XML of the referenced element as a document of its
+// own, with the namespaces declared on ancestors declared on it and without
+// any enveloped Signature. Canonicalize returns the canonical bytes along with
+// the ID of the document element, if it has one.
+//
+// The signer and verifier must use the same Canonicalizer. SignedInfo is still
+// canonicalized by the package with the CanonicalizationAlgorithm.
+type Canonicalizer interface {
+	Canonicalize(data interface{}) ([]byte, string, error)
+}
+
+// canonicalize returns the canonical form of data to be referenced.
+func (s *signer) canonicalize(data interface{}) ([]byte, string, error) {
+	if s.options.Canonicalizer != nil {
+		if source, ok := data.(CanonicalSource); ok {
+			doc, err := readSource(source)
+			if err != nil {
+				return nil, "", err
+			}
+			data = doc
+		}
+		return s.options.Canonicalizer.Canonicalize(data)
+	}
+	return s.refCanon.canonicalize(data)
+}
+
+// canonicalizeNodes returns the canonical form of the nodes of doc to be
+// referenced, along with the ID of the apex.
+func (s *signer) canonicalizeNodes(doc []byte, index *document, nodes subset) ([]byte, string, error) {
+	if s.options.Canonicalizer != nil {
+		data, err := referencedXML(doc, index, nodes)
+		if err != nil {
+			return nil, "", err
+		}
+		return s.options.Canonicalizer.Canonicalize(data)
+	}
+	var canonical bytes.Buffer
+	canonical.Grow(s.refCanon.sizeHint)
+	id, err := s.refCanon.write(&canonical, bytes.NewReader(doc), nodes)
+	if err != nil {
+		return nil, "", err
+	}
+	return canonical.Bytes(), id, nil
+}
+
+// digestValue returns the digest of the canonical form of data to be
+// referenced, along with the ID of the data's element, and writes the canonical
+// form to canonical as well.
+func (s *signer) digestValue(canonical *bytes.Buffer, data interface{}) (string, string, error) {
+	if s.options.Canonicalizer != nil || s.options.CanonicalizeHook != nil {
+		canonData, id, err := s.canonicalize(data)
+		if err != nil {
+			return "", "", err
+		}
+		s.options.Logger.log("canonicalized", "bytes", len(canonData), "id", id)
+		canonical.Write(canonData)
+		digest, err := s.digestCanonical(canonData)
+		return digest, id, err
+	}
+	h := s.digestAlg.hash.New()
+	var size byteCounter
+	id, err := s.refCanon.writeValueInScope(io.MultiWriter(h, &size, canonical), data, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return s.streamedDigest(h, int(size), id), id, nil
+}
+
+// digestNodes returns the digest of the canonical form of the nodes of doc to
+// be referenced, along with the ID of the apex, and writes the canonical form
+// to canonical as well unless it is nil. The canonical form is streamed into
+// the hash except for a Canonicalizer or CanonicalizeHook, which work with all
+// of it at once.
+func (s *signer) digestNodes(canonical *bytes.Buffer, doc []byte, index *document, nodes subset) (string, string, error) {
+	if s.options.Canonicalizer != nil || s.options.CanonicalizeHook != nil {
+		canonData, id, err := s.canonicalizeNodes(doc, index, nodes)
+		if err != nil {
+			return "", "", err
+		}
+		s.options.Logger.log("canonicalized", "bytes", len(canonData), "id", id)
+		if canonical != nil {
+			canonical.Write(canonData)
+		}
+		digest, err := s.digestCanonical(canonData)
+		return digest, id, err
+	}
+	h := s.digestAlg.hash.New()
+	var size byteCounter
+	out := io.MultiWriter(h, &size)
+	if canonical != nil {
+		out = io.MultiWriter(h, &size, canonical)
+	}
+	id, err := s.refCanon.write(out, bytes.NewReader(doc), nodes)
+	if err != nil {
+		return "", "", err
+	}
+	return s.streamedDigest(h, int(size), id), id, nil
+}
+
+// streamedDigest returns the digest in h of the canonical form streamed into
+// it. Canonicalization and digesting finish together, so both are logged.
+func (s *signer) streamedDigest(h hash.Hash, size int, id string) string {
+	s.options.Logger.log("canonicalized", "bytes", size, "id", id)
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	s.options.Logger.log("digest computed", "algorithm", s.digestAlg.name, "length", len(digest))
+	return digest
+}
+
+// digestCanonical returns the digest of canonical data after the
+// CanonicalizeHook has been applied to it.
+func (s *signer) digestCanonical(canonData []byte) (string, error) {
+	digestData, err := s.options.CanonicalizeHook.apply(canonData)
+	if err != nil {
+		return "", err
+	}
+	digest := s.digest(digestData)
+	s.options.Logger.log("digest computed", "algorithm", s.digestAlg.name, "length", len(digest))
+	return digest, nil
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int
+
+// Write is part of io.Writer.
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// canonicalizeNodes returns the canonical form of the nodes of doc, using the
+// Canonicalizer when there is one.
+func (v *verifier) canonicalizeNodes(canon *canonicalization, doc []byte, index *document, nodes subset) ([]byte, error) {
+	if v.options.Canonicalizer == nil {
+		var canonical bytes.Buffer
+		if _, err := canon.write(&canonical, bytes.NewReader(doc), nodes); err != nil {
+			return nil, err
+		}
+		return canonical.Bytes(), nil
+	}
+	data, err := referencedXML(doc, index, nodes)
+	if err != nil {
+		return nil, err
+	}
+	canonical, _, err := v.options.Canonicalizer.Canonicalize(data)
+	return canonical, err
+}
+
+// referencedXML returns the XML of the nodes of doc as a document of its own.
+// It is the apex element, or the whole document, without the excluded element
+// and with the namespaces in scope at the apex declared on it.
+func referencedXML(doc []byte, index *document, nodes subset) ([]byte, error) {
+	start, tagEnd, end := 0, 0, len(doc)
+	var err error
+	if nodes.apex >= 0 {
+		if start, tagEnd, end, err = elementBounds(doc, nodes.apex); err != nil {
+			return nil, err
+		}
+	}
+	data := doc[start:end]
+	if nodes.exclude >= 0 && (nodes.apex < 0 || index.contains(nodes.apex, nodes.exclude)) {
+		excludeStart, _, excludeEnd, err := elementBounds(doc, nodes.exclude)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, 0, end-start)
+		data = append(data, doc[start:excludeStart]...)
+		data = append(data, doc[excludeEnd:end]...)
+	}
+	if nodes.apex < 0 || index.elements[nodes.apex].parent < 0 {
+		return data, nil
+	}
+	scope, err := namespacesInScope(doc, index.elements[nodes.apex].parent)
+	if err != nil {
+		return nil, err
+	}
+	return declareScope(data, tagEnd-start, scope)
+}
+
+// elementBounds returns the offsets in doc where the element at the position in
+// document order starts, where its start tag ends and where it ends.
+func elementBounds(doc []byte, position int) (start, tagEnd, end int, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	depth := 0
+	for i := 0; ; {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				depth++
+			} else if i == position {
+				start, tagEnd, depth = int(offset), int(decoder.InputOffset()), 1
+			}
+			i++
+		case xml.EndElement:
+			if depth > 0 {
+				if depth--; depth == 0 {
+					return start, tagEnd, int(decoder.InputOffset()), nil
+				}
+			}
+		}
+	}
+}
+
+// declareScope adds declarations of the namespaces of scope, mapping prefixes
+// to namespaces, to the start tag of element that ends at tagEnd, unless it
+// declares the prefixes itself.
+func declareScope(element []byte, tagEnd int, scope map[string]string) ([]byte, error) {
+	token, err := xml.NewDecoder(bytes.NewReader(element[:tagEnd])).RawToken()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	start, _ := token.(xml.StartElement)
+	declared := make(map[string]bool)
+	for _, att := range start.Attr {
+		if isNamespaceDeclaration(att.Name) {
+			declared[declaredPrefix(att.Name)] = true
+		}
+	}
+	prefixes := make([]string, 0, len(scope))
+	for prefix, uri := range scope {
+		if !declared[prefix] && uri != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return element, nil
+	}
+	sort.Strings(prefixes)
+	var declarations bytes.Buffer
+	for _, prefix := range prefixes {
+		declarations.WriteString(" xmlns")
+		if prefix != "" {
+			declarations.WriteString(":" + prefix)
+		}
+		declarations.WriteString(`="`)
+		attrEscaper.WriteString(&declarations, scope[prefix])
+		declarations.WriteByte('"')
+	}
+	// the declarations go before the > or /> closing the start tag
+	insert := tagEnd - 1
+	if element[insert-1] == '/' {
+		insert--
+	}
+	out := make([]byte, 0, len(element)+declarations.Len())
+	out = append(out, element[:insert]...)
+	out = append(out, declarations.Bytes()...)
+	return append(out, element[insert:]...), nil
+}
@@ -0,0 +1,87 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+// markingCanonicalizer canonicalizes with Exclusive XML Canonicalization and
+// adds a comment, so that its output differs from the package's own.
+type markingCanonicalizer struct {
+	inputs [][]byte
+}
+
+func (c *markingCanonicalizer) Canonicalize(data interface{}) ([]byte, string, error) {
+	doc, ok := data.([]byte)
+	if !ok {
+		var err error
+		if doc, err = xml.Marshal(data); err != nil {
+			return nil, "", err
+		}
+	}
+	c.inputs = append(c.inputs, doc)
+	canon, _ := pickCanonicalization(CanonExclusive)
+	out := bytes.NewBufferString("<!--marked-->")
+	id, err := canon.write(out, bytes.NewReader(doc), wholeDocument)
+	return out.Bytes(), id, err
+}
+
+func TestCanonicalizer(t *testing.T) {
+	canonicalizer := &markingCanonicalizer{}
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{Canonicalizer: canonicalizer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`<doc ID="_d"><item>one</item></doc>`)
+	signed, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(signed, []byte(`<!--marked--><doc ID="_d">`)) {
+		t.Fatalf("expected the document to be canonicalized by the Canonicalizer but got %s", signed)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{Canonicalizer: canonicalizer}).Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// the verifier is given the referenced element without the signature
+	if verified := canonicalizer.inputs[len(canonicalizer.inputs)-1]; string(verified) != `<doc ID="_d"><item>one</item></doc>` {
+		t.Fatalf("expected the verifier to canonicalize the element but got %s", verified)
+	}
+	if err := NewVerifier().Verify(signed); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch without the Canonicalizer but got %v", err)
+	}
+
+	sig, err := signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<!--marked--><Envelope xmlns="urn:envelope" ID="_1234">`; !bytes.HasPrefix([]byte(sig.CanonicalizedInput), []byte(expected)) {
+		t.Fatalf("expected the struct to be canonicalized by the Canonicalizer but got %s", sig.CanonicalizedInput)
+	}
+}
+
+func TestReferencedXML(t *testing.T) {
+	doc := []byte(`<p:root xmlns:p="urn:p" xmlns="urn:default"><p:item ID="_i" xmlns:q="urn:q"><p:empty/><Signature/></p:item></p:root>`)
+	index, err := indexDocument(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apex, _ := index.lookupID("_i")
+	data, err := referencedXML(doc, index, subset{apex, apex + 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<p:item ID="_i" xmlns:q="urn:q" xmlns="urn:default" xmlns:p="urn:p"><p:empty/></p:item>`
+	if string(data) != expected {
+		t.Fatalf("expected %s but got %s", expected, data)
+	}
+	data, err = referencedXML(doc, index, subset{apex + 1, -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<p:empty xmlns="urn:default" xmlns:p="urn:p" xmlns:q="urn:q"/>`; string(data) != expected {
+		t.Fatalf("expected %s but got %s", expected, data)
+	}
+}
@@ -0,0 +1,67 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// diffContext is how many bytes around the first difference CanonicalDiff shows.
+const diffContext = 20
+
+// CanonicalDiff describes where two canonical forms first differ, such as ours
+// and a partner's for the same content, or returns "" when they are equal. It
+// gives the offset, line and column of the first differing byte, the element
+// it is in and the bytes around it in each, quoted so that whitespace and line
+// endings show.
+func CanonicalDiff(a, b []byte) string {
+	offset := 0
+	for offset < len(a) && offset < len(b) && a[offset] == b[offset] {
+		offset++
+	}
+	if offset == len(a) && offset == len(b) {
+		return ""
+	}
+	line := 1 + bytes.Count(a[:offset], []byte("\n"))
+	column := offset - bytes.LastIndexByte(a[:offset], '\n')
+	return fmt.Sprintf("canonical forms differ at byte %d (line %d, column %d) in %s: %q != %q",
+		offset, line, column, elementPath(a[:offset]), diffWindow(a, offset), diffWindow(b, offset))
+}
+
+// elementPath returns the path of the elements open at the end of the
+// canonical data, such as /doc/item, or / outside of the document element.
+func elementPath(data []byte) string {
+	var open []string
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, qualifiedName(t.Name))
+		case xml.EndElement:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	return "/" + strings.Join(open, "/")
+}
+
+// diffWindow returns the bytes of data around the offset.
+func diffWindow(data []byte, offset int) string {
+	start, end := offset-diffContext, offset+diffContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+	if start > end {
+		start = end
+	}
+	return string(data[start:end])
+}
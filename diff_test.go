@@ -0,0 +1,19 @@
+package xmlsig
+
+import "testing"
+
+func TestCanonicalDiff(t *testing.T) {
+	ours := []byte("<doc xmlns=\"urn:doc\">\n<item ID=\"_1\">value</item>\n</doc>")
+	theirs := []byte("<doc xmlns=\"urn:doc\">\n<item ID=\"_1\">valve</item>\n</doc>")
+	if diff := CanonicalDiff(ours, ours); diff != "" {
+		t.Fatalf("expected no difference but got %s", diff)
+	}
+	expected := `canonical forms differ at byte 39 (line 2, column 18) in /doc/item: "\">\n<item ID=\"_1\">value</item>\n</doc>" != "\">\n<item ID=\"_1\">valve</item>\n</doc>"`
+	if diff := CanonicalDiff(ours, theirs); diff != expected {
+		t.Fatalf("expected %s but got %s", expected, diff)
+	}
+	expected = `canonical forms differ at byte 55 (line 3, column 7) in /: ">value</item>\n</doc>" != ">value</item>\n</doc>\n"`
+	if diff := CanonicalDiff(ours, append(ours, '\n')); diff != expected {
+		t.Fatalf("expected %s but got %s", expected, diff)
+	}
+}
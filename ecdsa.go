@@ -0,0 +1,46 @@
+package xmlsig
+
+import (
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// XML Signature encodes ECDSA signatures as the integers r and s, each padded
+// to the size of the curve, one after the other rather than in ASN.1.
+
+// ecdsaSignatureValue converts the ASN.1 signature crypto.Signer returns to
+// the value of the SignatureValue.
+func ecdsaSignatureValue(key *ecdsa.PublicKey, der []byte) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("xmlsig ECDSA signature has trailing data")
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	value := make([]byte, 2*size)
+	sig.R.FillBytes(value[:size])
+	sig.S.FillBytes(value[size:])
+	return value, nil
+}
+
+// verifyECDSA checks the value of a SignatureValue against the hashed
+// SignedInfo.
+func verifyECDSA(key *ecdsa.PublicKey, hashed, value []byte) error {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(value) != 2*size {
+		return ErrInvalidSignature
+	}
+	r := new(big.Int).SetBytes(value[:size])
+	s := new(big.Int).SetBytes(value[size:])
+	if !ecdsa.Verify(key, hashed, r, s) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDeterministicECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := issueCertificate(t, "ecdsa", key, nil, nil)
+	doc := []byte(`<doc ID="_d"><item>1</item></doc>`)
+	for _, deterministic := range []bool{true, false} {
+		signer, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, SignerOptions{
+			SignatureAlgorithm:      SigECDSASHA384,
+			DeterministicSignatures: deterministic,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for i := 0; i < 2; i++ {
+			signed, err := signer.(DocumentSigner).SignDocument(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := NewVerifier().Verify(signed); err != nil {
+				t.Fatal(err)
+			}
+			sig, err := ParseSignature(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// r and s of 48 bytes each for P-384
+			if value, _ := base64.StdEncoding.DecodeString(sig.SignatureValue); len(value) != 96 {
+				t.Fatalf("expected a 96 byte SignatureValue but got %d bytes", len(value))
+			}
+			values = append(values, sig.SignatureValue)
+		}
+		if (values[0] == values[1]) != deterministic {
+			t.Fatalf("expected deterministic signatures to be %t but got %s and %s", deterministic, values[0], values[1])
+		}
+	}
+
+	signer, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.SignedInfo.SignatureMethod.Algorithm != SigECDSASHA256 {
+		t.Fatalf("expected %s by default but got %s", SigECDSASHA256, sig.SignedInfo.SignatureMethod.Algorithm)
+	}
+	tampered := bytes.Replace(signed, []byte(sig.SignatureValue), []byte(tamperBase64(sig.SignatureValue)), 1)
+	if err := NewVerifier().Verify(tampered); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+}
+
+// externalKey hides the concrete type of a key, as for a key held in an HSM.
+type externalKey struct {
+	crypto.Signer
+}
+
+func TestDeterministicSignaturesNeedECDSAPrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := issueCertificate(t, "ecdsa", key, nil, nil)
+	options := SignerOptions{DeterministicSignatures: true}
+	if _, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: externalKey{key}}, options); err == nil {
+		t.Fatal("expected an error for deterministic signatures with an external key")
+	}
+	if _, err := NewSignerWithOptions(testCertificate(t), options); err == nil {
+		t.Fatal("expected an error for deterministic signatures with an RSA key")
+	}
+	signer, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: externalKey{key}}, SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
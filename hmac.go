@@ -0,0 +1,55 @@
+package xmlsig
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+)
+
+// NewHMACSigner creates a new Signer that computes the SignatureValue as an
+// HMAC using a key shared with the verifier, for services that don't use
+// certificates. The SignatureAlgorithm option defaults to HMAC-SHA256.
+func NewHMACSigner(key []byte, options SignerOptions) (Signer, error) {
+	if len(key) == 0 {
+		return nil, errors.New("xmlsig needs a key to sign using HMAC")
+	}
+	sigAlg, err := pickHMACAlgorithm(options.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	s, err := configureSigner(sigAlg, options)
+	if err != nil {
+		return nil, err
+	}
+	s.hmacKey = key
+	return s, nil
+}
+
+func pickHMACAlgorithm(alg string) (*algorithm, error) {
+	if method, _ := lookupSignatureMethod(hmacKey, alg); method != nil {
+		return method, nil
+	}
+	return nil, errors.New("xmlsig does not support the specified HMAC algorithm")
+}
+
+func computeHMAC(alg *algorithm, key, data []byte) []byte {
+	mac := hmac.New(alg.hash.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// checkHMAC checks the HMAC value over the signed data. The whole value is
+// compared, so a truncated HMACOutputLength can't weaken it.
+func checkHMAC(key []byte, alg string, signed, value []byte) error {
+	if alg == "" {
+		return errors.New("xmlsig signature does not declare a signature method")
+	}
+	hmacAlg, err := pickHMACAlgorithm(alg)
+	if err != nil {
+		return fmt.Errorf("%w: %s for an HMAC key", ErrSignatureMethodMismatch, alg)
+	}
+	if !hmac.Equal(computeHMAC(hmacAlg, key, signed), value) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
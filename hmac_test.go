@@ -0,0 +1,102 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestHMACSignature(t *testing.T) {
+	key := []byte("shared secret")
+	for _, alg := range []SignatureAlgorithm{"", "http://www.w3.org/2000/09/xmldsig#hmac-sha1", "http://www.w3.org/2001/04/xmldsig-more#hmac-sha512"} {
+		signer, err := NewHMACSigner(key, SignerOptions{SignatureAlgorithm: alg, VerifyAfterSign: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(signed, []byte("X509Data")) {
+			t.Fatal("expected no certificate in the KeyInfo")
+		}
+		cert, err := NewVerifierWithOptions(VerifierOptions{HMACKey: key}).(CertificateVerifier).VerifyAndExtract(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != nil {
+			t.Fatal("expected no certificate for an HMAC signature")
+		}
+		if err := NewVerifierWithOptions(VerifierOptions{HMACKey: []byte("wrong secret")}).Verify(signed); err != ErrInvalidSignature {
+			t.Fatalf("expected ErrInvalidSignature for the wrong key but got %v", err)
+		}
+	}
+	if _, err := NewHMACSigner(nil, SignerOptions{}); err == nil {
+		t.Fatal("expected an error without a key")
+	}
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{HMACKey: key}).Verify(signed); err == nil {
+		t.Fatal("expected an RSA signature to be rejected when verifying with an HMAC key")
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	key := []byte("shared secret")
+	signer, err := NewHMACSigner(key, SignerOptions{KeyName: "partner-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signed, []byte(`<KeyName xmlns="http://www.w3.org/2000/09/xmldsig#">partner-1</KeyName></KeyInfo>`)) {
+		t.Fatalf("expected the KeyName in the KeyInfo but got %s", signed)
+	}
+	keys := map[string]crypto.PublicKey{"partner-1": key}
+	resolver := func(keyName string) (crypto.PublicKey, error) {
+		if key, ok := keys[keyName]; ok {
+			return key, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{KeyResolver: resolver})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	keys["partner-1"] = []byte("wrong secret")
+	if err := verifier.Verify(signed); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+
+	cert := testCertificate(t)
+	rsaSigner, err := NewSignerWithOptions(cert, SignerOptions{KeyName: "partner-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = rsaSigner.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["partner-2"] = leaf.PublicKey
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	delete(keys, "partner-2")
+	if err := verifier.Verify(signed); err == nil {
+		t.Fatal("expected an error for an unknown key name")
+	}
+}
@@ -0,0 +1,134 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// indentUnsigned puts the children of elements on their own lines, indented
+// by one indent per level, where doing so doesn't change what is signed. The
+// content of elements covered by a reference of any signature in the document
+// and of each SignedInfo is copied byte for byte, as is everything outside of
+// the document element. Elements with text other than whitespace or under
+// xml:space="preserve" are left alone too, as indenting would change their
+// text.
+func indentUnsigned(doc []byte, indent string, idAttributes []xml.Name) ([]byte, error) {
+	index, err := indexDocument(doc, idAttributes)
+	if err != nil {
+		return nil, err
+	}
+	frozen := make([]bool, len(index.elements))
+	signatureName := xml.Name{Space: dsigNamespace, Local: "Signature"}
+	signedInfoName := xml.Name{Space: dsigNamespace, Local: "SignedInfo"}
+	for sigPos := range index.elements {
+		if index.elements[sigPos].name != signatureName {
+			continue
+		}
+		signature, err := decodeSignature(doc, sigPos)
+		if err != nil {
+			return nil, err
+		}
+		signedInfo := index.child(sigPos, signedInfoName)
+		for pos := range frozen {
+			if pos == signedInfo || (signedInfo >= 0 && index.contains(signedInfo, pos)) ||
+				index.covered(pos, sigPos, signature) {
+				frozen[pos] = true
+			}
+		}
+	}
+	mixed, err := mixedContent(doc, len(index.elements))
+	if err != nil {
+		return nil, err
+	}
+
+	type frame struct {
+		indented, preserve, children bool
+	}
+	var open []*frame
+	var out bytes.Buffer
+	out.Grow(len(doc) + len(doc)/4)
+	newline := func(depth int) {
+		out.WriteByte('\n')
+		out.WriteString(strings.Repeat(indent, depth))
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	pos := 0
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw := doc[offset:decoder.InputOffset()]
+		var parent *frame
+		if len(open) > 0 {
+			parent = open[len(open)-1]
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if parent != nil && parent.indented {
+				newline(len(open))
+				parent.children = true
+			}
+			preserve := parent != nil && parent.preserve
+			for _, att := range t.Attr {
+				if att.Name.Space == "xml" && att.Name.Local == "space" {
+					preserve = att.Value == "preserve"
+				}
+			}
+			open = append(open, &frame{indented: !frozen[pos] && !mixed[pos] && !preserve, preserve: preserve})
+			pos++
+		case xml.EndElement:
+			closed := open[len(open)-1]
+			open = open[:len(open)-1]
+			if closed.indented && closed.children {
+				newline(len(open))
+			}
+		case xml.CharData:
+			// Only whitespace is left in indented elements, which is replaced
+			if parent != nil && parent.indented {
+				continue
+			}
+		default:
+			if parent != nil && parent.indented {
+				newline(len(open))
+				parent.children = true
+			}
+		}
+		out.Write(raw)
+	}
+}
+
+// mixedContent reports for each element, in document order, whether it has
+// text other than whitespace as a child.
+func mixedContent(doc []byte, elements int) ([]bool, error) {
+	mixed := make([]bool, elements)
+	var open []int
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	pos := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return mixed, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, pos)
+			pos++
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(open) > 0 && len(bytes.Trim(t, " \t\r\n")) > 0 {
+				mixed[open[len(open)-1]] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package xmlsig
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIndent(t *testing.T) {
+	doc := []byte(`<doc xmlns="urn:doc" ID="_d"><item>one</item><item>two</item></doc>`)
+	plain, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{Indent: "  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := plain.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pretty, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(pretty); err != nil {
+		t.Fatal(err)
+	}
+	// the signed document and the SignedInfo are untouched
+	content := `<doc xmlns="urn:doc" ID="_d"><item>one</item><item>two</item><Signature`
+	if !bytes.HasPrefix(pretty, []byte(content)) {
+		t.Fatalf("expected the signed content to be unchanged but got %s", pretty)
+	}
+	start := bytes.Index(compact, []byte("<SignedInfo"))
+	end := bytes.Index(compact, []byte("</SignedInfo>"))
+	if !bytes.Contains(pretty, compact[start:end]) {
+		t.Fatalf("expected the SignedInfo to be unchanged but got %s", pretty)
+	}
+	for _, line := range []string{"\n    <SignedInfo ", "\n    <KeyInfo ", "\n      <X509Data ", "\n        <X509Certificate ", "\n  </Signature></doc>"} {
+		if !strings.Contains(string(pretty), line) {
+			t.Fatalf("expected %q in %s", line, pretty)
+		}
+	}
+
+	// only the parts outside of the referenced element are indented
+	wrapped := []byte(`<envelope><header><note>a <b>note</b></note><empty/></header>` + string(compact) + `</envelope>`)
+	indented, err := indentUnsigned(wrapped, "\t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the enveloped Signature is excluded from the reference, so it is indented
+	prefix := "<envelope>\n\t<header>\n\t\t<note>a <b>note</b></note>\n\t\t<empty/>\n\t</header>\n\t" + content
+	suffix := "\n\t\t</Signature></doc>\n</envelope>"
+	if !bytes.HasPrefix(indented, []byte(prefix)) || !bytes.HasSuffix(indented, []byte(suffix)) {
+		t.Fatalf("expected %s...%s but got %s", prefix, suffix, indented)
+	}
+	if err := NewVerifier().Verify(indented); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package xmlsig
+
+import "time"
+
+// SignatureInfo summarizes a Signature for debugging and audit logs, so
+// tooling can consume signature metadata as JSON without parsing XML.
+type SignatureInfo struct {
+	CanonicalizationMethod string           `json:"canonicalizationMethod"`
+	SignatureMethod        string           `json:"signatureMethod"`
+	References             []ReferenceInfo  `json:"references"`
+	Certificate            *CertificateInfo `json:"certificate,omitempty"`
+}
+
+// ReferenceInfo describes a Reference within SignedInfo.
+type ReferenceInfo struct {
+	URI          string   `json:"uri"`
+	Transforms   []string `json:"transforms,omitempty"`
+	DigestMethod string   `json:"digestMethod"`
+	DigestValue  string   `json:"digestValue"`
+}
+
+// referenceInfo describes the References within SignedInfo.
+func (signature *Signature) referenceInfo() []ReferenceInfo {
+	var references []ReferenceInfo
+	for _, reference := range signature.SignedInfo.References() {
+		ref := ReferenceInfo{
+			URI:          reference.URI,
+			DigestMethod: reference.DigestMethod.Algorithm,
+			DigestValue:  reference.DigestValue,
+		}
+		for _, transform := range reference.Transforms.Transform {
+			ref.Transforms = append(ref.Transforms, transform.Algorithm)
+		}
+		references = append(references, ref)
+	}
+	return references
+}
+
+// CertificateInfo describes the certificate in a Signature's KeyInfo.
+type CertificateInfo struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	Fingerprint  string    `json:"fingerprint"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+// Info returns a summary of the signature. Certificate is only set when
+// KeyInfo contains an X509 certificate, which must then be parseable.
+func (signature *Signature) Info() (*SignatureInfo, error) {
+	info := &SignatureInfo{
+		CanonicalizationMethod: signature.SignedInfo.CanonicalizationMethod.Algorithm,
+		SignatureMethod:        signature.SignedInfo.SignatureMethod.Algorithm,
+		References:             []ReferenceInfo{},
+	}
+	info.References = append(info.References, signature.referenceInfo()...)
+	if x509Data := signature.KeyInfo.X509Data; x509Data != nil && x509Data.X509Certificate != "" {
+		cert, err := signature.certificate()
+		if err != nil {
+			return nil, err
+		}
+		info.Certificate = &CertificateInfo{
+			Subject:      cert.Subject.String(),
+			Issuer:       cert.Issuer.String(),
+			SerialNumber: cert.SerialNumber.String(),
+			Fingerprint:  CertificateSHA256Fingerprint(cert),
+			NotBefore:    cert.NotBefore.UTC(),
+			NotAfter:     cert.NotAfter.UTC(),
+		}
+	}
+	return info, nil
+}
+
+// SignatureAlgorithms returns the algorithms declared by the outermost Signature
+// in the document without verifying it: the canonicalization method, the
+// signature method and the digest method of each reference. It lets operators
+// classify incoming documents, such as finding partners still using SHA-1.
+func SignatureAlgorithms(doc []byte) (canonicalization string, signature string, digests []string, err error) {
+	defer recoverPanic(&err, nil)
+	sig, err := ParseSignature(doc)
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, reference := range sig.SignedInfo.References() {
+		digests = append(digests, reference.DigestMethod.Algorithm)
+	}
+	return sig.SignedInfo.CanonicalizationMethod.Algorithm, sig.SignedInfo.SignatureMethod.Algorithm, digests, nil
+}
@@ -0,0 +1,106 @@
+package xmlsig
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSignatureJSON(t *testing.T) {
+	data, err := os.ReadFile("testdata/dsig-prefix.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := sig.certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := sig.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info SignatureInfo
+	if err := json.Unmarshal(encoded, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.CanonicalizationMethod != xMLexcC14Namespace ||
+		info.SignatureMethod != "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256" {
+		t.Fatalf("unexpected algorithms in %s", encoded)
+	}
+	if len(info.References) != 1 || info.References[0].URI != "#_resp1" ||
+		info.References[0].DigestValue != sig.SignedInfo.Reference.DigestValue ||
+		len(info.References[0].Transforms) != 2 {
+		t.Fatalf("unexpected references in %s", encoded)
+	}
+	if info.Certificate == nil ||
+		info.Certificate.Subject != cert.Subject.String() ||
+		info.Certificate.Issuer != cert.Issuer.String() ||
+		info.Certificate.SerialNumber != cert.SerialNumber.String() ||
+		info.Certificate.Fingerprint != CertificateSHA256Fingerprint(cert) ||
+		!info.Certificate.NotBefore.Equal(cert.NotBefore) ||
+		!info.Certificate.NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("unexpected certificate in %s", encoded)
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	tests := []struct {
+		options                             SignerOptions
+		canonicalization, signature, digest string
+	}{
+		{
+			SignerOptions{},
+			"http://www.w3.org/2001/10/xml-exc-c14n#",
+			"http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			"http://www.w3.org/2000/09/xmldsig#sha1",
+		},
+		{
+			SignerOptions{
+				CanonicalizationAlgorithm: "http://www.w3.org/2006/12/xml-c14n11",
+				SignatureAlgorithm:        "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+				DigestAlgorithm:           "http://www.w3.org/2001/04/xmlenc#sha256",
+			},
+			"http://www.w3.org/2006/12/xml-c14n11",
+			"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			"http://www.w3.org/2001/04/xmlenc#sha256",
+		},
+		{
+			SignerOptions{
+				CanonicalizationAlgorithm: "http://www.w3.org/TR/2001/REC-xml-c14n-20010315",
+				SignatureAlgorithm:        "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+				DigestAlgorithm:           "http://www.w3.org/2001/04/xmlenc#sha512",
+			},
+			"http://www.w3.org/TR/2001/REC-xml-c14n-20010315",
+			"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+			"http://www.w3.org/2001/04/xmlenc#sha512",
+		},
+	}
+	for _, test := range tests {
+		s, err := NewSignerWithOptions(testCertificate(t), test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := s.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"/>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		canonicalization, signature, digests, err := SignatureAlgorithms(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonicalization != test.canonicalization || signature != test.signature || len(digests) != 1 || digests[0] != test.digest {
+			t.Fatalf("expected %s %s %s but got %s %s %v", test.canonicalization, test.signature, test.digest, canonicalization, signature, digests)
+		}
+	}
+	if _, _, _, err := SignatureAlgorithms([]byte(`<doc/>`)); err != ErrSignatureNotFound {
+		t.Fatalf("expected ErrSignatureNotFound but got %v", err)
+	}
+}
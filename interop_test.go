@@ -0,0 +1,127 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// goldenCanonicalizations maps the extension of the expected output files in
+// testdata/c14n to the algorithm that produced them. The expected outputs were
+// produced with libxml2, which is also used by xmlsec1, and keep comments. They
+// can be regenerated with xmllint --c14n, --c14n11 and --exc-c14n.
+var goldenCanonicalizations = map[string]string{
+	".c14n":     c14n10WithCommentsNamespace,
+	".c14n11":   c14n11WithCommentsNamespace,
+	".exc-c14n": xMLexcC14WithComments,
+}
+
+func canonicalFixtures(t *testing.T) []string {
+	fixtures, err := filepath.Glob("testdata/c14n/*.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("expected fixtures in testdata/c14n")
+	}
+	return fixtures
+}
+
+func TestCanonicalizationGoldenFiles(t *testing.T) {
+	for _, fixture := range canonicalFixtures(t) {
+		doc, err := os.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ext, alg := range goldenCanonicalizations {
+			golden := strings.TrimSuffix(fixture, ".xml") + ext
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, _ := pickCanonicalization(alg)
+			var out bytes.Buffer
+			if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+				t.Fatalf("%s: %v", golden, err)
+			}
+			if !bytes.Equal(out.Bytes(), expected) {
+				t.Errorf("%s: expected\n%s\nbut got\n%s", golden, expected, out.Bytes())
+			}
+		}
+	}
+}
+
+// xmlsecTemplate is signed by xmlsec1 to have it digest a fixture. The fixture
+// is referenced as an external file, so the whole document is canonicalized
+// and comments are kept.
+const xmlsecTemplate = `<Signature xmlns="http://www.w3.org/2000/09/xmldsig#">
+<SignedInfo>
+<CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>
+<SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#hmac-sha256"/>
+<Reference URI="{{uri}}">
+<Transforms><Transform Algorithm="{{transform}}"/></Transforms>
+<DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>
+<DigestValue></DigestValue>
+</Reference>
+</SignedInfo>
+<SignatureValue></SignatureValue>
+</Signature>`
+
+var digestValuePattern = regexp.MustCompile(`<DigestValue>([^<]*)</DigestValue>`)
+
+// TestCanonicalizationXMLSec compares the digests of the fixtures with the
+// ones xmlsec1 computes, when it is installed.
+func TestCanonicalizationXMLSec(t *testing.T) {
+	xmlsec, err := exec.LookPath("xmlsec1")
+	if err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hmac.key"), bytes.Repeat([]byte{'k'}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range canonicalFixtures(t) {
+		doc, err := os.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(fixture)
+		if err := os.WriteFile(filepath.Join(dir, name), doc, 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, alg := range goldenCanonicalizations {
+			template := strings.NewReplacer("{{uri}}", name, "{{transform}}", alg).Replace(xmlsecTemplate)
+			if err := os.WriteFile(filepath.Join(dir, "template.xml"), []byte(template), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(xmlsec, "--sign", "--hmackey", "hmac.key", "--enabled-reference-uris", "local", "--output", "signed.xml", "template.xml")
+			cmd.Dir = dir
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("xmlsec1 failed to sign %s using %s: %v\n%s", name, alg, err, output)
+			}
+			signed, err := os.ReadFile(filepath.Join(dir, "signed.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			match := digestValuePattern.FindSubmatch(signed)
+			if match == nil {
+				t.Fatalf("expected a DigestValue in %s", signed)
+			}
+			c, _ := pickCanonicalization(alg)
+			var out bytes.Buffer
+			if _, err := c.write(&out, bytes.NewReader(doc), wholeDocument); err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(out.Bytes())
+			if digest := base64.StdEncoding.EncodeToString(sum[:]); digest != string(match[1]) {
+				t.Errorf("%s using %s: expected digest %s from xmlsec1 but got %s", name, alg, match[1], digest)
+			}
+		}
+	}
+}
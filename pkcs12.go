@@ -0,0 +1,55 @@
+package xmlsig
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// NewSignerFromPKCS12 creates a new Signer with the private key and
+// certificates of a PKCS#12 (.p12 or .pfx) file. The certificate matching the
+// key is the signing certificate and the others are included in the X509Data
+// as its chain, as with NewSignerWithChain.
+func NewSignerFromPKCS12(data []byte, password string, options SignerOptions) (Signer, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			if key != nil {
+				return nil, errors.New("xmlsig needs a PKCS#12 file with a single private key")
+			}
+			if key, err = parsePKCS12Key(block.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if key == nil {
+		return nil, errors.New("xmlsig needs a PKCS#12 file with a private key")
+	}
+	return NewSignerWithChain(certs, key, options)
+}
+
+// parsePKCS12Key parses a private key from a PKCS#12 file, which ToPEM
+// converts to PKCS#1 for RSA keys and to SEC 1 for ECDSA keys.
+func parsePKCS12Key(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("xmlsig does not support the type of private key in the PKCS#12 file")
+}
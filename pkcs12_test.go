@@ -0,0 +1,47 @@
+package xmlsig
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// testdata/signer.p12 holds a key, its certificate and the CA that issued it,
+// exported by openssl with the password secret using 3DES, which is what
+// golang.org/x/crypto/pkcs12 supports.
+func TestNewSignerFromPKCS12(t *testing.T) {
+	data, err := os.ReadFile("testdata/signer.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSignerFromPKCS12(data, "secret", SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain := signature.KeyInfo.X509Data.X509Chain; len(chain) != 1 {
+		t.Fatalf("expected the certificate and its CA but got a chain of %d certificates", len(chain))
+	}
+	leaf, err := signature.certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "xmlsig test signer" || leaf.Issuer.CommonName != "xmlsig test CA" {
+		t.Fatalf("expected the signing certificate first but got %s", leaf.Subject)
+	}
+
+	if _, err := NewSignerFromPKCS12(data, "wrong", SignerOptions{}); err != pkcs12.ErrIncorrectPassword {
+		t.Fatalf("expected ErrIncorrectPassword but got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package xmlsig
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// subjectKeyIdentifier returns the SubjectKeyIdentifier of the certificate.
+// When the certificate doesn't have one and compute is set, it is the SHA-1
+// hash of the subjectPublicKey bits, which is method 1 of RFC 5280.
+func subjectKeyIdentifier(cert *x509.Certificate, compute bool) ([]byte, error) {
+	if len(cert.SubjectKeyId) > 0 {
+		return cert.SubjectKeyId, nil
+	}
+	if !compute {
+		return nil, errors.New("xmlsig certificate does not have a subject key identifier")
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// keyIdentifier returns the value identifying the certificate for a
+// KeyIdentifier of the ValueType, computing a missing SubjectKeyIdentifier
+// when compute is set.
+func keyIdentifier(cert *x509.Certificate, valueType string, compute bool) ([]byte, error) {
+	switch valueType {
+	case KeyIdentifierSKI:
+		return subjectKeyIdentifier(cert, compute)
+	case KeyIdentifierThumbprint:
+		sum := sha1.Sum(cert.Raw)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("xmlsig does not support the key identifier type %s", valueType)
+}
@@ -0,0 +1,112 @@
+package xmlsig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSubjectKeyIdentifier(t *testing.T) {
+	key := testCertificate(t).PrivateKey.(*rsa.PrivateKey)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(5678),
+		Subject:        pkix.Name{CommonName: "xmlsig ski test"},
+		EmailAddresses: []string{"test@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		SubjectKeyId:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, SignerOptions{SubjectKeyIdentifier: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ski := sig.KeyInfo.X509Data.X509SKI; ski != base64.StdEncoding.EncodeToString(template.SubjectKeyId) {
+		t.Fatalf("expected the SubjectKeyIdentifier extension but got %s", ski)
+	}
+
+	// the shared test certificate doesn't have the extension
+	if _, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SubjectKeyIdentifier: true}); err == nil {
+		t.Fatal("expected an error for a certificate without a SubjectKeyIdentifier")
+	}
+	signer, err = NewSignerWithOptions(testCertificate(t), SignerOptions{SubjectKeyIdentifier: true, ComputeSubjectKeyIdentifier: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	computed := sha1.Sum(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	if ski := sig.KeyInfo.X509Data.X509SKI; ski != base64.StdEncoding.EncodeToString(computed[:]) {
+		t.Fatalf("expected the SHA-1 hash of the public key but got %s", ski)
+	}
+}
+
+func TestKeyIdentifier(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ski, err := subjectKeyIdentifier(leaf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint := sha1.Sum(leaf.Raw)
+	for _, test := range []struct {
+		valueType string
+		value     []byte
+	}{
+		{KeyIdentifierSKI, ski},
+		{KeyIdentifierThumbprint, thumbprint[:]},
+	} {
+		signer, err := NewSignerWithOptions(cert, SignerOptions{KeyIdentifier: test.valueType, ComputeSubjectKeyIdentifier: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		str := signature.KeyInfo.SecurityTokenReference
+		if signature.KeyInfo.X509Data != nil || str == nil || str.KeyIdentifier == nil {
+			t.Fatalf("expected a KeyIdentifier instead of X509Data but got %+v", signature.KeyInfo)
+		}
+		if identifier := str.KeyIdentifier; identifier.ValueType != test.valueType ||
+			identifier.Value != base64.StdEncoding.EncodeToString(test.value) {
+			t.Fatalf("expected a %s KeyIdentifier but got %+v", test.valueType, identifier)
+		}
+		verifier := NewVerifierWithOptions(VerifierOptions{Certificates: []*x509.Certificate{leaf}})
+		if verified, err := verifier.(CertificateVerifier).VerifyAndExtract(signed); err != nil || !verified.Equal(leaf) {
+			t.Fatalf("expected the known certificate to verify the signature but got %v", err)
+		}
+		if err := NewVerifier().Verify(signed); err != ErrUnknownKeyIdentifier {
+			t.Fatalf("expected ErrUnknownKeyIdentifier without the certificate but got %v", err)
+		}
+	}
+	if _, err := NewSignerWithOptions(cert, SignerOptions{KeyIdentifier: "urn:unknown"}); err == nil {
+		t.Fatal("expected an error for an unsupported key identifier type")
+	}
+	if _, err := NewSignerWithOptions(cert, SignerOptions{KeyIdentifier: KeyIdentifierThumbprint, BinarySecurityTokenID: "token"}); err == nil {
+		t.Fatal("expected an error for both a KeyIdentifier and a BinarySecurityToken")
+	}
+}
@@ -0,0 +1,77 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// CanonicalSource is XML held in a form other than a Go struct, such as an
+// element tree, that can be signed with CreateSignature by yielding its tokens
+// in document order. The tokens are what xml.Decoder.RawToken returns: names
+// have the prefix rather than the namespace as their Space, and namespace
+// declarations are attributes. Token returns io.EOF after the last token.
+//
+// A beevik/etree element can yield its Space, Tag and Attr as a StartElement,
+// the tokens of its children and then an EndElement. It can also be written
+// out and adapted with BytesSource:
+//
+//	doc := etree.NewDocument()
+//	doc.SetRoot(element.Copy())
+//	data, err := doc.WriteToBytes()
+//	...
+//	signature, err := signer.CreateSignature(xmlsig.BytesSource(data))
+type CanonicalSource interface {
+	Token() (xml.Token, error)
+}
+
+// BytesSource returns a CanonicalSource yielding the tokens of the XML
+// document.
+func BytesSource(doc []byte) CanonicalSource {
+	return rawTokens{xml.NewDecoder(bytes.NewReader(doc))}
+}
+
+type rawTokens struct {
+	decoder *xml.Decoder
+}
+
+func (r rawTokens) Token() (xml.Token, error) {
+	return r.decoder.RawToken()
+}
+
+// readSource writes the tokens of the source out as an XML document.
+func readSource(source CanonicalSource) ([]byte, error) {
+	var out bytes.Buffer
+	for {
+		token, err := source.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, att := range t.Attr {
+				out.WriteString(" " + qualifiedName(att.Name) + `="`)
+				attrEscaper.WriteString(&out, att.Value)
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+		case xml.EndElement:
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			textEscaper.WriteString(&out, string(t))
+		case xml.Comment:
+			out.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			out.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			out.WriteString("<!" + string(t) + ">")
+		default:
+			return nil, fmt.Errorf("xmlsig can not write the token %T", token)
+		}
+	}
+}
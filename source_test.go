@@ -0,0 +1,70 @@
+package xmlsig
+
+import (
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+// tokenSource is a minimal CanonicalSource over tokens held in memory.
+type tokenSource struct {
+	tokens []xml.Token
+}
+
+func (s *tokenSource) Token() (xml.Token, error) {
+	if len(s.tokens) == 0 {
+		return nil, io.EOF
+	}
+	token := s.tokens[0]
+	s.tokens = s.tokens[1:]
+	return token, nil
+}
+
+func TestCanonicalSource(t *testing.T) {
+	doc := `<p:order xmlns:p="urn:order" ID="_o"><p:item qty="2">A &amp; B</p:item><!-- note --></p:order>`
+	tokens := func() *tokenSource {
+		return &tokenSource{tokens: []xml.Token{
+			xml.StartElement{Name: xml.Name{Space: "p", Local: "order"}, Attr: []xml.Attr{
+				{Name: xml.Name{Space: "xmlns", Local: "p"}, Value: "urn:order"},
+				{Name: xml.Name{Local: "ID"}, Value: "_o"},
+			}},
+			xml.StartElement{Name: xml.Name{Space: "p", Local: "item"}, Attr: []xml.Attr{{Name: xml.Name{Local: "qty"}, Value: "2"}}},
+			xml.CharData("A & B"),
+			xml.EndElement{Name: xml.Name{Space: "p", Local: "item"}},
+			xml.Comment(" note "),
+			xml.EndElement{Name: xml.Name{Space: "p", Local: "order"}},
+		}}
+	}
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(tokens())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<p:order xmlns:p="urn:order" ID="_o"><p:item qty="2">A &amp; B</p:item></p:order>`
+	if sig.CanonicalizedInput != expected {
+		t.Fatalf("expected %s but got %s", expected, sig.CanonicalizedInput)
+	}
+	if uri := sig.SignedInfo.Reference.URI; uri != "#_o" {
+		t.Fatalf("expected a reference to #_o but got %s", uri)
+	}
+	fromBytes, err := signer.CreateSignature(BytesSource([]byte(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromBytes.SignedInfo.Reference.DigestValue != sig.SignedInfo.Reference.DigestValue {
+		t.Fatal("expected the tokens and the bytes of the same document to have the same digest")
+	}
+
+	// the signature verifies once placed in the document
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte(`<p:order xmlns:p="urn:order" ID="_o"><p:item qty="2">A &amp; B</p:item>` + string(data) + `</p:order>`)
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@ package xmlsig
 import (
 	"encoding/xml"
 	"math/big"
+	"sort"
 )
 
 /*
@@ -12,20 +13,126 @@ Schema for XML Signatures, http://www.w3.org/2000/09/xmldsig.
 
 // Signature element is the root element of an XML Signature.
 type Signature struct {
-	XMLName            xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
-	SignedInfo         SignedInfo
-	SignatureValue     string `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+	XMLName        xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	ID             string   `xml:"Id,attr,omitempty"`
+	SignedInfo     SignedInfo
+	SignatureValue string `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+	// SignatureValueID is the Id attribute of the SignatureValue, so that
+	// counter-signatures can reference it.
+	SignatureValueID   string `xml:"-"`
 	KeyInfo            KeyInfo
+	Object             []Object
 	CanonicalizedInput string `xml:"-"`
+	// raw is the Signature element a parsed Signature was read from, and
+	// parsed is how it marshalled at the time, to tell if it was modified.
+	raw, parsed []byte
+	// namespaces are the prefixes in scope where a parsed Signature was read
+	// from, declared on it when marshalled for the elements kept as written.
+	namespaces map[string]string
+}
+
+// encodedSignature is the encoded form of Signature, with the
+// SignatureValueID as an attribute of the SignatureValue.
+type encodedSignature struct {
+	XMLName        xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	ID             string   `xml:"Id,attr,omitempty"`
+	SignedInfo     SignedInfo
+	SignatureValue signatureValue
+	KeyInfo        KeyInfo
+	Object         []Object
+}
+
+type signatureValue struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+	ID      string   `xml:"Id,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+// MarshalXML writes the SignatureValueID as the Id of the SignatureValue.
+func (signature Signature) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Space: dsigNamespace, Local: "Signature"}
+	prefixes := make([]string, 0, len(signature.namespaces))
+	for prefix := range signature.namespaces {
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:" + prefix}, Value: signature.namespaces[prefix]})
+	}
+	return e.EncodeElement(encodedSignature{
+		ID:             signature.ID,
+		SignedInfo:     signature.SignedInfo,
+		SignatureValue: signatureValue{ID: signature.SignatureValueID, Value: signature.SignatureValue},
+		KeyInfo:        signature.KeyInfo,
+		Object:         signature.Object,
+	}, start)
+}
+
+// UnmarshalXML reads the Id of the SignatureValue into SignatureValueID.
+func (signature *Signature) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var decoded encodedSignature
+	if err := d.DecodeElement(&decoded, &start); err != nil {
+		return err
+	}
+	*signature = Signature{
+		XMLName:          decoded.XMLName,
+		ID:               decoded.ID,
+		SignedInfo:       decoded.SignedInfo,
+		SignatureValue:   decoded.SignatureValue.Value,
+		SignatureValueID: decoded.SignatureValue.ID,
+		KeyInfo:          decoded.KeyInfo,
+		Object:           decoded.Object,
+	}
+	return nil
+}
+
+// Object holds the signature properties or counter-signatures of the
+// Signature it is contained in, or the base64 encoded content an enveloping
+// signature signs.
+type Object struct {
+	XMLName             xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Object"`
+	ID                  string   `xml:"Id,attr,omitempty"`
+	Encoding            string   `xml:",attr,omitempty"`
+	SignatureProperties *SignatureProperties
+	Signature           []Signature
+	Data                string `xml:",chardata"`
+	// Foreign keeps the children that aren't modelled, such as the
+	// QualifyingProperties of XAdES, so that they survive parsing.
+	Foreign []ForeignElement `xml:",any"`
+}
+
+// SignatureProperties holds additional information about a Signature, such as
+// the time it was made.
+type SignatureProperties struct {
+	XMLName           xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# SignatureProperties"`
+	ID                string   `xml:"Id,attr,omitempty"`
+	SignatureProperty []SignatureProperty
+}
+
+// SignatureProperty is an assertion about the Signature referenced by Target.
+// Its content is kept as XML since it may be in any namespace.
+type SignatureProperty struct {
+	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# SignatureProperty"`
+	ID       string   `xml:"Id,attr,omitempty"`
+	Target   string   `xml:",attr"`
+	InnerXML string   `xml:",innerxml"`
 }
 
 // Algorithm describes the digest or signature used when digest or signature.
 type Algorithm struct {
-	Algorithm string `xml:",attr"`
-	// InclusiveNamespace InclusiveNamespace `xml:",omitempty"`
+	Algorithm           string               `xml:",attr"`
+	InclusiveNamespaces *InclusiveNamespaces `xml:",omitempty"`
 }
 
-// type InclusiveNamespace struct {}
+// InclusiveNamespaces lists the prefixes that Exclusive XML Canonicalization
+// treats as it would with inclusive canonicalization. PrefixList is separated
+// by whitespace and may contain #default for the default namespace.
+type InclusiveNamespaces struct {
+	XMLName    xml.Name `xml:"http://www.w3.org/2001/10/xml-exc-c14n# InclusiveNamespaces"`
+	PrefixList string   `xml:",attr"`
+}
 
 // SignedInfo includes a canonicalization algorithm, a signature algorithm, and a reference.
 type SignedInfo struct {
@@ -33,12 +140,72 @@ type SignedInfo struct {
 	CanonicalizationMethod Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# CanonicalizationMethod"`
 	SignatureMethod        Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# SignatureMethod"`
 	Reference              Reference
+	// AdditionalReferences follow Reference when the signature covers more than
+	// one resource, such as the SignatureProperties of the signing time.
+	AdditionalReferences []Reference `xml:"-"`
+}
+
+// References returns the Reference followed by the AdditionalReferences.
+func (signedInfo SignedInfo) References() []Reference {
+	return append([]Reference{signedInfo.Reference}, signedInfo.AdditionalReferences...)
+}
+
+// decodedSignedInfo is the decoded form of SignedInfo, with all of the
+// references as a single list.
+type decodedSignedInfo struct {
+	CanonicalizationMethod Algorithm   `xml:"http://www.w3.org/2000/09/xmldsig# CanonicalizationMethod"`
+	SignatureMethod        Algorithm   `xml:"http://www.w3.org/2000/09/xmldsig# SignatureMethod"`
+	Reference              []Reference `xml:"http://www.w3.org/2000/09/xmldsig# Reference"`
+}
+
+// MarshalXML writes the children of SignedInfo in the order of the schema,
+// CanonicalizationMethod, SignatureMethod and then each Reference, whatever the
+// order of the fields.
+func (signedInfo SignedInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Space: dsigNamespace, Local: "SignedInfo"}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := e.EncodeElement(signedInfo.CanonicalizationMethod, xml.StartElement{Name: xml.Name{Space: dsigNamespace, Local: "CanonicalizationMethod"}}); err != nil {
+		return err
+	}
+	if err := e.EncodeElement(signedInfo.SignatureMethod, xml.StartElement{Name: xml.Name{Space: dsigNamespace, Local: "SignatureMethod"}}); err != nil {
+		return err
+	}
+	for _, reference := range signedInfo.References() {
+		if err := e.Encode(reference); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads the first Reference into Reference and any others into
+// AdditionalReferences. It returns ErrNoReference when there isn't one.
+func (signedInfo *SignedInfo) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var decoded decodedSignedInfo
+	if err := d.DecodeElement(&decoded, &start); err != nil {
+		return err
+	}
+	if len(decoded.Reference) == 0 {
+		return ErrNoReference
+	}
+	*signedInfo = SignedInfo{
+		XMLName:                start.Name,
+		CanonicalizationMethod: decoded.CanonicalizationMethod,
+		SignatureMethod:        decoded.SignatureMethod,
+		Reference:              decoded.Reference[0],
+		AdditionalReferences:   decoded.Reference[1:],
+	}
+	return nil
 }
 
 // Reference specifies a digest algorithm and digest value, and optionally an identifier of the object being signed, the type of the object, and/or a list of transforms to be applied prior to digesting.
 type Reference struct {
 	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Reference"`
+	ID           string   `xml:"Id,attr,omitempty"`
 	URI          string   `xml:",attr,omitempty"`
+	Type         string   `xml:",attr,omitempty"`
 	Transforms   Transforms
 	DigestMethod Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
 	DigestValue  string    `xml:"http://www.w3.org/2000/09/xmldsig# DigestValue"`
@@ -50,12 +217,85 @@ type Transforms struct {
 	Transform []Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# Transform"`
 }
 
+// The plain types have the fields of the types with a MarshalXML method but
+// none of their methods, so a MarshalXML method converts its value to one to
+// have the element encoded as usual rather than calling itself again.
+type (
+	plainTransforms       Transforms
+	plainKeyInfo          KeyInfo
+	plainX509IssuerSerial X509IssuerSerial
+)
+
+// MarshalXML leaves out Transforms without any Transform, as the element must
+// have at least one when it is present.
+func (transforms Transforms) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(transforms.Transform) == 0 {
+		return nil
+	}
+	start.Name = xml.Name{Space: dsigNamespace, Local: "Transforms"}
+	return e.EncodeElement(plainTransforms(transforms), start)
+}
+
 // KeyInfo is an optional element that enables the recipient(s) to obtain the key needed to validate the signature.
 type KeyInfo struct {
-	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
-	X509Data *X509Data
+	XMLName                xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	KeyName                string   `xml:"http://www.w3.org/2000/09/xmldsig# KeyName,omitempty"`
+	X509Data               *X509Data
+	RetrievalMethod        *RetrievalMethod
+	SecurityTokenReference *SecurityTokenReference
 	// KeyValue KeyValue
 	Children []interface{}
+	// Foreign keeps the children that aren't modelled, such as extensions
+	// in other namespaces, so that they survive parsing.
+	Foreign []ForeignElement `xml:",any"`
+	// Omitted leaves the KeyInfo out of the Signature when it is marshalled,
+	// rather than emitting an empty element.
+	Omitted bool `xml:"-"`
+}
+
+// MarshalXML leaves out a KeyInfo that is omitted.
+func (keyInfo KeyInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if keyInfo.Omitted {
+		return nil
+	}
+	start.Name = xml.Name{Space: dsigNamespace, Local: "KeyInfo"}
+	return e.EncodeElement(plainKeyInfo(keyInfo), start)
+}
+
+// ForeignElement is an element kept as it was written because it isn't
+// modelled, such as a custom extension of KeyInfo.
+type ForeignElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+// MarshalXML writes the element with the namespace declarations it was
+// parsed with, which the encoder would otherwise mangle.
+func (element ForeignElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = element.XMLName
+	start.Attr = nil
+	for _, att := range element.Attrs {
+		switch {
+		case att.Name.Space == "xmlns":
+			att.Name = xml.Name{Local: "xmlns:" + att.Name.Local}
+		case att.Name.Space == "" && att.Name.Local == "xmlns":
+			// the encoder declares the namespace of the element itself
+			continue
+		}
+		start.Attr = append(start.Attr, att)
+	}
+	return e.EncodeElement(struct {
+		InnerXML string `xml:",innerxml"`
+	}{element.InnerXML}, start)
+}
+
+// RetrievalMethod within KeyInfo points at key information kept elsewhere, such
+// as an X509Data in the document with the ID of the URI.
+type RetrievalMethod struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# RetrievalMethod"`
+	URI     string   `xml:",attr"`
+	Type    string   `xml:",attr,omitempty"`
 }
 
 // KeyValue holds the RSAKeyValue modulus & exponent
@@ -76,6 +316,72 @@ type X509Data struct {
 	XMLName          xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
 	X509Certificate  string   `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
 	X509IssuerSerial X509IssuerSerial
+	X509SKI          string `xml:"http://www.w3.org/2000/09/xmldsig# X509SKI,omitempty"`
+	X509Digest       *X509Digest
+	// X509Chain holds the rest of the certificate chain, which is encoded as
+	// further X509Certificate elements following X509Certificate.
+	X509Chain []string `xml:"-"`
+}
+
+// x509Data is the encoded form of X509Data, with the signing certificate and
+// the rest of its chain as a single list.
+type x509Data struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
+	X509Certificate  []string `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
+	X509IssuerSerial X509IssuerSerial
+	X509SKI          string `xml:"http://www.w3.org/2000/09/xmldsig# X509SKI,omitempty"`
+	X509Digest       *X509Digest
+}
+
+// MarshalXML writes the X509Certificate followed by the X509Chain.
+func (data X509Data) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	encoded := x509Data{
+		X509IssuerSerial: data.X509IssuerSerial,
+		X509SKI:          data.X509SKI,
+		X509Digest:       data.X509Digest,
+	}
+	if data.X509Certificate != "" {
+		encoded.X509Certificate = append(encoded.X509Certificate, data.X509Certificate)
+	}
+	encoded.X509Certificate = append(encoded.X509Certificate, data.X509Chain...)
+	start.Name = xml.Name{Space: dsigNamespace, Local: "X509Data"}
+	return e.EncodeElement(encoded, start)
+}
+
+// UnmarshalXML reads the first X509Certificate into X509Certificate and any
+// others into X509Chain. A KeyInfo with more than one X509Data, such as one per
+// certificate or one with just the X509SKI, decodes them all into its X509Data,
+// so the elements of each are merged into it: certificates are added to the
+// chain and the other elements are kept from the first X509Data with them.
+func (data *X509Data) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var decoded x509Data
+	if err := d.DecodeElement(&decoded, &start); err != nil {
+		return err
+	}
+	data.XMLName = decoded.XMLName
+	if data.X509IssuerSerial.IssuerName == "" && data.X509IssuerSerial.SerialNumber == nil {
+		data.X509IssuerSerial = decoded.X509IssuerSerial
+	}
+	if data.X509SKI == "" {
+		data.X509SKI = decoded.X509SKI
+	}
+	if data.X509Digest == nil {
+		data.X509Digest = decoded.X509Digest
+	}
+	certificates := decoded.X509Certificate
+	if data.X509Certificate == "" && len(certificates) > 0 {
+		data.X509Certificate, certificates = certificates[0], certificates[1:]
+	}
+	data.X509Chain = append(data.X509Chain, certificates...)
+	return nil
+}
+
+// X509Digest is the XML Signature 1.1 element holding the base64 encoded
+// digest of a certificate's DER encoding.
+type X509Digest struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/2009/xmldsig11# X509Digest"`
+	Algorithm string   `xml:",attr"`
+	Value     string   `xml:",chardata"`
 }
 
 // X509IssuerSerial element within X509Data contains the issername and the serialnumber
@@ -85,6 +391,38 @@ type X509IssuerSerial struct {
 	SerialNumber *big.Int `xml:"X509SerialNumber,omitempty"`
 }
 
+// MarshalXML leaves out an X509IssuerSerial without an issuer or serial
+// number, such as in the X509Data of a certificate of the chain.
+func (issuerSerial X509IssuerSerial) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if issuerSerial.IssuerName == "" && issuerSerial.SerialNumber == nil {
+		return nil
+	}
+	return e.EncodeElement(plainX509IssuerSerial(issuerSerial), start)
+}
+
+// SecurityTokenReference is a WS-Security reference to the token holding the key
+type SecurityTokenReference struct {
+	XMLName       xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd SecurityTokenReference"`
+	Reference     *TokenReference
+	KeyIdentifier *KeyIdentifier
+}
+
+// TokenReference within SecurityTokenReference points at a token by URI
+type TokenReference struct {
+	XMLName   xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Reference"`
+	URI       string   `xml:",attr"`
+	ValueType string   `xml:",attr,omitempty"`
+}
+
+// KeyIdentifier within SecurityTokenReference identifies the certificate by a
+// value of the type given by ValueType, such as its SubjectKeyIdentifier
+type KeyIdentifier struct {
+	XMLName      xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd KeyIdentifier"`
+	ValueType    string   `xml:",attr"`
+	EncodingType string   `xml:",attr,omitempty"`
+	Value        string   `xml:",chardata"`
+}
+
 // BinarySecurityToken contains the binary security token for X509 certificates
 type BinarySecurityToken struct {
 	ValueType    string `xml:"ValueType,attr"`
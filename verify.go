@@ -0,0 +1,1190 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Verifier is used to validate the Signature of a signed XML document.
+type Verifier interface {
+	Verify(doc []byte) error
+}
+
+// CertificateVerifier is implemented by the Verifiers of this package to
+// return the certificate a document was verified with.
+type CertificateVerifier interface {
+	VerifyAndExtract(doc []byte) (*x509.Certificate, error)
+}
+
+// DigestVerifier is implemented by the Verifiers of this package to check the
+// reference digests of a document without its SignatureValue.
+type DigestVerifier interface {
+	VerifyDigests(doc []byte) error
+}
+
+// DetachedVerifier is implemented by the Verifiers of this package to verify
+// a detached signature against content the caller resolves.
+type DetachedVerifier interface {
+	VerifyDetached(signature []byte, resolver func(uri string) ([]byte, error)) error
+}
+
+// ReferenceVerifier is implemented by the Verifiers of this package to return
+// the references a document was verified with, for audit logs.
+type ReferenceVerifier interface {
+	VerifyWithReferences(doc []byte) ([]ReferenceInfo, error)
+}
+
+// VerifierOptions configures a Verifier.
+type VerifierOptions struct {
+	// Certificate is used to check signatures in place of the certificate in
+	// their KeyInfo. Without it, the embedded certificate is used and callers
+	// are responsible for deciding whether it is trusted.
+	Certificate *x509.Certificate
+	// Certificates are known certificates that a signature may identify by the
+	// X509Digest in its KeyInfo, or by the SubjectKeyIdentifier or SHA-1
+	// thumbprint of a WS-Security KeyIdentifier, rather than embedding the
+	// certificate. When the certificate is embedded as well, it must match the
+	// X509Digest.
+	Certificates []*x509.Certificate
+	// PinnedFingerprint, when set, is the hex encoded SHA-256 fingerprint the
+	// signing certificate must have, as returned by CertificateSHA256Fingerprint.
+	// It guards against accepting any other certificate in KeyInfo when only one
+	// specific certificate is expected.
+	PinnedFingerprint string
+	// CheckValidity makes verification fail with ErrCertificateNotValid when the
+	// signing certificate is outside of its validity period.
+	CheckValidity bool
+	// Clock returns the time the validity period is checked at. It defaults to
+	// time.Now, and can be set to check signatures at a known time.
+	Clock func() time.Time
+	// HMACKey is the shared key for verifying signatures made by a signer from
+	// NewHMACSigner. When it is set, only HMAC signature methods are accepted and
+	// VerifyAndExtract doesn't return a certificate.
+	HMACKey []byte
+	// KeyResolver looks up the key to verify a signature with by the KeyName in
+	// its KeyInfo, in place of the certificate. It may return an
+	// *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey, or a []byte for an
+	// HMAC key. VerifyAndExtract doesn't return a certificate for a resolved key.
+	KeyResolver func(keyName string) (crypto.PublicKey, error)
+	// KeyInfoResolver looks up the key to verify a signature with from
+	// whatever hints its KeyInfo has, such as an X509IssuerSerial. It takes
+	// precedence over KeyResolver and the certificate in the KeyInfo, and may
+	// return the same types of key as KeyResolver, and likewise VerifyAndExtract
+	// doesn't return a certificate for it.
+	KeyInfoResolver func(keyInfo *KeyInfo) (crypto.PublicKey, error)
+	// IDAttributes, when set, are the only attributes that identify the elements
+	// referenced by URIs such as #id. They are matched on namespace and local
+	// name, so xml:id is {Space: "http://www.w3.org/XML/1998/namespace", Local: "id"}.
+	// By default any attribute named ID or Id, or ending in Id, identifies an element.
+	IDAttributes []xml.Name
+	// RequiredReferences are the IDs of the elements the application goes on to
+	// use. Verification fails unless a reference of the signature covers each of
+	// them, which defends against signature wrapping attacks where a signed
+	// decoy is kept in the document and the element that is used is unsigned.
+	RequiredReferences []string
+	// AllowedTransforms are the transform algorithms a reference may declare.
+	// Any other transform, such as XSLT, is rejected with ErrDisallowedTransform
+	// before the reference is processed. It defaults to DefaultAllowedTransforms.
+	AllowedTransforms []string
+	// AllowedSignatureMethods are the signature methods SignedInfo may declare.
+	// Any other is rejected with ErrDisallowedSignatureMethod. The declared
+	// method is always the one verified with, and must suit the key. It
+	// defaults to DefaultAllowedSignatureMethods.
+	AllowedSignatureMethods []string
+	// MaxDocumentSize, when set, is the largest document in bytes that will be
+	// verified. Larger documents are rejected with ErrDocumentTooLarge before
+	// they are parsed.
+	MaxDocumentSize int
+	// MaxSignatures, when set, is the most Signature elements, counter-signatures
+	// included, a document may have. Documents with more are rejected with
+	// ErrTooManySignatures before any reference or signature is checked.
+	MaxSignatures int
+	// StrictKeyInfo rejects signatures whose KeyInfo has children other than
+	// KeyName, X509Data, RetrievalMethod and SecurityTokenReference with
+	// ErrUnknownKeyInfo. By default unknown children are ignored.
+	StrictKeyInfo bool
+	// RejectCommentsInText rejects references to content where a comment
+	// splits text, as in <User>ad<!---->min</User>, with ErrCommentInText.
+	// Canonicalization without comments digests such text as if the comment
+	// weren't there, while an application reading only the first text node
+	// sees part of it, which lets a signed value be changed.
+	RejectCommentsInText bool
+	// Logger, when set, is told about each verified reference and the outcome
+	// of verification.
+	Logger Logger
+	// CanonicalizeHook must be the hook the signer used, if any. It runs on the
+	// canonical bytes of each reference and of SignedInfo before checking them.
+	CanonicalizeHook CanonicalizeHook
+	// Canonicalizer must be the Canonicalizer the signer used, if any. It
+	// produces the canonical form of the content of same-document references.
+	Canonicalizer Canonicalizer
+}
+
+var (
+	// ErrSignatureNotFound is returned when a document doesn't contain a Signature.
+	ErrSignatureNotFound = errors.New("xmlsig could not find a signature in the document")
+	// ErrDigestMismatch is wrapped by the ReferenceError returned when the
+	// digest of a reference doesn't match the referenced content.
+	ErrDigestMismatch = errors.New("xmlsig reference digest does not match the content")
+	// ErrInvalidSignature is returned when the SignatureValue doesn't match SignedInfo.
+	ErrInvalidSignature = errors.New("xmlsig signature value is not valid")
+	// ErrCertificateNotPinned is returned when the signing certificate doesn't
+	// match the pinned fingerprint.
+	ErrCertificateNotPinned = errors.New("xmlsig signing certificate does not match the pinned fingerprint")
+	// ErrCertificateNotValid is returned when validity is checked and the
+	// signing certificate has expired or isn't valid yet.
+	ErrCertificateNotValid = errors.New("xmlsig signing certificate is not within its validity period")
+	// ErrReferenceNotCovered is returned when a required element isn't covered
+	// by a reference of the signature.
+	ErrReferenceNotCovered = errors.New("xmlsig required element is not covered by the signature")
+	// ErrReferenceNotFound is wrapped by the error returned when no element has
+	// the ID a reference or required reference resolves.
+	ErrReferenceNotFound = errors.New("xmlsig could not find the element")
+	// ErrDuplicateID is returned when more than one element has the ID that a
+	// reference or required reference resolves.
+	ErrDuplicateID = errors.New("xmlsig more than one element has the same ID")
+	// ErrDisallowedTransform is returned when a reference declares a transform
+	// that isn't in the allowed transforms.
+	ErrDisallowedTransform = errors.New("xmlsig reference declares a transform that is not allowed")
+	// ErrDisallowedSignatureMethod is returned when SignedInfo declares a
+	// signature method that isn't in the allowed signature methods.
+	ErrDisallowedSignatureMethod = errors.New("xmlsig signature declares a signature method that is not allowed")
+	// ErrSignatureMethodMismatch is wrapped by the error returned when the
+	// declared signature method can't be used with the verification key, such
+	// as an HMAC method with an RSA key.
+	ErrSignatureMethodMismatch = errors.New("xmlsig signature method does not match the key")
+	// ErrDocumentTooLarge is returned when a document is larger than the
+	// maximum document size.
+	ErrDocumentTooLarge = errors.New("xmlsig document is larger than the maximum size")
+	// ErrUnknownKeyInfo is wrapped by the error returned when StrictKeyInfo is
+	// set and the KeyInfo has a child the verifier doesn't understand.
+	ErrUnknownKeyInfo = errors.New("xmlsig KeyInfo has an unknown child")
+	// ErrUnknownKeyIdentifier is returned when none of the known certificates
+	// matches the KeyIdentifier in a signature's SecurityTokenReference.
+	ErrUnknownKeyIdentifier = errors.New("xmlsig none of the certificates matches the key identifier")
+	// ErrCommentInText is returned when RejectCommentsInText is set and a
+	// comment splits the text of referenced content.
+	ErrCommentInText = errors.New("xmlsig referenced content has a comment within its text")
+	// ErrTooManySignatures is returned when a document has more Signature
+	// elements than the maximum number of signatures.
+	ErrTooManySignatures = errors.New("xmlsig document has more signatures than the maximum")
+	// ErrNoReference is returned when the SignedInfo of a signature doesn't
+	// contain a Reference, so that it would sign nothing at all.
+	ErrNoReference = errors.New("xmlsig SignedInfo does not contain a Reference")
+	// ErrX509DigestMismatch is returned when neither the embedded certificate
+	// nor a known certificate matches the X509Digest of the signature.
+	ErrX509DigestMismatch = errors.New("xmlsig no certificate matches the X509Digest of the signature")
+)
+
+// ReferenceError is returned when the digest of a reference doesn't match the
+// referenced content. It wraps ErrDigestMismatch, so it can be checked for with
+// errors.Is.
+type ReferenceError struct {
+	// Index is the position of the reference in the SignedInfo.
+	Index int
+	URI   string
+	// Expected is the DigestValue of the reference and Computed the base64
+	// digest of the content as it was verified.
+	Expected string
+	Computed string
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("xmlsig digest of reference %d with the URI %q does not match the content: expected %s but computed %s",
+		e.Index, e.URI, e.Expected, e.Computed)
+}
+
+// Unwrap returns ErrDigestMismatch.
+func (e *ReferenceError) Unwrap() error {
+	return ErrDigestMismatch
+}
+
+// DefaultAllowedTransforms are the transforms references may declare unless
+// VerifierOptions.AllowedTransforms is set.
+var DefaultAllowedTransforms = []string{
+	envelopedSignatureNamespace,
+	c14n10Namespace,
+	c14n10WithCommentsNamespace,
+	c14n11Namespace,
+	c14n11WithCommentsNamespace,
+	xMLexcC14Namespace,
+	xMLexcC14WithComments,
+	base64Transform,
+}
+
+// DefaultAllowedSignatureMethods are the signature methods a SignedInfo may
+// declare unless VerifierOptions.AllowedSignatureMethods is set.
+var DefaultAllowedSignatureMethods = []string{
+	SigRSASHA1, SigRSASHA256, SigRSASHA384, SigRSASHA512,
+	SigDSASHA1, SigDSASHA256,
+	SigECDSASHA1, SigECDSASHA256, SigECDSASHA384, SigECDSASHA512,
+	SigEd25519,
+	SigHMACSHA1, SigHMACSHA256, SigHMACSHA384, SigHMACSHA512,
+}
+
+const dsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+type verifier struct {
+	options VerifierOptions
+	// resolver supplies the content of references to other documents
+	resolver func(uri string) ([]byte, error)
+}
+
+// NewVerifier creates a new Verifier that checks signatures using the
+// certificate in their KeyInfo.
+func NewVerifier() Verifier {
+	return NewVerifierWithOptions(VerifierOptions{})
+}
+
+// NewVerifierWithOptions creates a new Verifier with the options
+func NewVerifierWithOptions(options VerifierOptions) Verifier {
+	return &verifier{options: options}
+}
+
+// Verify checks the outermost Signature in the document, so a signature
+// embedded in signed content isn't mistaken for the one enveloping it. The
+// digest of each reference is recomputed using its declared transforms and the
+// SignatureValue is checked over the canonicalized SignedInfo.
+// Counter-signatures within the Signature are checked the same way.
+func (v *verifier) Verify(doc []byte) error {
+	_, err := v.VerifyAndExtract(doc)
+	return err
+}
+
+// VerifyAndExtract verifies the document like Verify and returns the
+// certificate the Signature was checked with, so callers don't need to parse
+// KeyInfo again to find out who signed it. A signature checked with the
+// HMACKey, or a key from the KeyResolver or KeyInfoResolver, has no
+// certificate, so the certificate is nil even though verification succeeded.
+func (v *verifier) VerifyAndExtract(doc []byte) (_ *x509.Certificate, err error) {
+	defer recoverPanic(&err, v.options.Logger)
+	cert, _, err := v.verify(doc)
+	if err != nil {
+		v.options.Logger.log("verification failed", "error", err)
+		return nil, err
+	}
+	v.options.Logger.log("verification succeeded")
+	return cert, nil
+}
+
+// VerifyWithReferences verifies the document like Verify and returns the URI,
+// transforms, digest method and DigestValue of each reference of the outermost
+// Signature, which are the digests it checked, for audit logs.
+func (v *verifier) VerifyWithReferences(doc []byte) (_ []ReferenceInfo, err error) {
+	defer recoverPanic(&err, v.options.Logger)
+	_, signature, err := v.verify(doc)
+	if err != nil {
+		v.options.Logger.log("verification failed", "error", err)
+		return nil, err
+	}
+	v.options.Logger.log("verification succeeded")
+	return signature.referenceInfo(), nil
+}
+
+// VerifyDigests only checks that the digest of each reference of the outermost
+// Signature matches its content, leaving the SignatureValue unchecked. It is
+// for when the SignatureValue is checked elsewhere, such as by an HSM, and for
+// telling canonicalization problems apart from key problems. A document that
+// passes is not known to be signed.
+func (v *verifier) VerifyDigests(doc []byte) (err error) {
+	defer recoverPanic(&err, v.options.Logger)
+	if v.options.MaxDocumentSize > 0 && len(doc) > v.options.MaxDocumentSize {
+		return ErrDocumentTooLarge
+	}
+	index, sigPos, signature, err := findSignature(doc, v.options.IDAttributes)
+	if err != nil {
+		return err
+	}
+	if err := v.checkSignatureCount(index); err != nil {
+		return err
+	}
+	for i, reference := range signature.SignedInfo.References() {
+		if err := v.verifyReference(doc, index, sigPos, i, reference); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyDetached verifies a signature like Verify, where references to other
+// documents, such as a URI of https://example.com/data.xml, are digested from
+// the content the resolver returns for them. A RetrievalMethod in the KeyInfo
+// that points at another document is resolved the same way. The library never
+// fetches a URI itself, so the caller decides what is reachable. The returned
+// content is canonicalized as a whole document when the reference declares a
+// canonicalization transform and digested as it is otherwise.
+func (v *verifier) VerifyDetached(signature []byte, resolver func(uri string) ([]byte, error)) error {
+	detached := *v
+	detached.resolver = resolver
+	return detached.Verify(signature)
+}
+
+func (v *verifier) verify(doc []byte) (*x509.Certificate, *Signature, error) {
+	if v.options.MaxDocumentSize > 0 && len(doc) > v.options.MaxDocumentSize {
+		return nil, nil, ErrDocumentTooLarge
+	}
+	index, sigPos, signature, err := findSignature(doc, v.options.IDAttributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := v.checkSignatureCount(index); err != nil {
+		return nil, nil, err
+	}
+	cert, err := v.verifySignature(doc, index, sigPos, signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range v.options.RequiredReferences {
+		pos, err := index.lookupID(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !index.covered(pos, sigPos, signature) {
+			return nil, nil, ErrReferenceNotCovered
+		}
+	}
+	for pos := sigPos + 1; pos < len(index.elements) && index.contains(sigPos, pos); pos++ {
+		if index.elements[pos].name != (xml.Name{Space: dsigNamespace, Local: "Signature"}) {
+			continue
+		}
+		counter, err := decodeSignature(doc, pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := v.verifySignature(doc, index, pos, counter); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, signature, nil
+}
+
+// checkSignatureCount rejects documents with more than the maximum number of
+// Signature elements.
+func (v *verifier) checkSignatureCount(index *document) error {
+	if v.options.MaxSignatures <= 0 {
+		return nil
+	}
+	count := 0
+	for _, element := range index.elements {
+		if element.name == (xml.Name{Space: dsigNamespace, Local: "Signature"}) {
+			if count++; count > v.options.MaxSignatures {
+				return ErrTooManySignatures
+			}
+		}
+	}
+	return nil
+}
+
+// verifySignature checks the signature and returns the certificate it was checked with.
+func (v *verifier) verifySignature(doc []byte, index *document, sigPos int, signature *Signature) (*x509.Certificate, error) {
+	if v.options.StrictKeyInfo && len(signature.KeyInfo.Foreign) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyInfo, signature.KeyInfo.Foreign[0].XMLName.Local)
+	}
+	for i, reference := range signature.SignedInfo.References() {
+		if err := v.verifyReference(doc, index, sigPos, i, reference); err != nil {
+			return nil, err
+		}
+	}
+	return v.verifySignatureValue(doc, index, sigPos, signature)
+}
+
+// ParseSignature returns the outermost Signature in the document. Signature
+// elements are matched on the XML Signature namespace, so it doesn't matter
+// whether the document uses a ds: or dsig: prefix or the default namespace.
+func ParseSignature(doc []byte) (_ *Signature, err error) {
+	defer recoverPanic(&err, nil)
+	_, sigPos, signature, err := findSignature(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	start, _, end, err := elementBounds(doc, sigPos)
+	if err != nil {
+		return nil, err
+	}
+	signature.raw = append([]byte(nil), doc[start:end]...)
+	if signature.namespaces, err = namespacesInScope(doc, sigPos); err != nil {
+		return nil, err
+	}
+	if signature.parsed, err = xml.Marshal(signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// Serialize returns the XML of the Signature. A Signature returned by
+// ParseSignature serializes to the element exactly as it was written in the
+// document until it is modified, so it still verifies when put back there.
+// Otherwise the Signature is marshalled, which keeps the Foreign elements the
+// types don't model along with the namespaces they were written with.
+func (signature *Signature) Serialize() ([]byte, error) {
+	data, err := xml.Marshal(signature)
+	if err != nil {
+		return nil, err
+	}
+	if signature.raw != nil && bytes.Equal(data, signature.parsed) {
+		return append([]byte(nil), signature.raw...), nil
+	}
+	return data, nil
+}
+
+// findSignature indexes the document and decodes its outermost Signature.
+func findSignature(doc []byte, idAttributes []xml.Name) (*document, int, *Signature, error) {
+	index, err := indexDocument(doc, idAttributes)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	sigPos := index.find(xml.Name{Space: dsigNamespace, Local: "Signature"})
+	if sigPos < 0 {
+		return nil, 0, nil, ErrSignatureNotFound
+	}
+	signature, err := decodeSignature(doc, sigPos)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return index, sigPos, signature, nil
+}
+
+// verifyReference checks the digest of the reference at position i of the
+// SignedInfo of the signature at sigPos.
+func (v *verifier) verifyReference(doc []byte, index *document, sigPos int, i int, reference Reference) error {
+	if v.resolver != nil && reference.URI != "" && !strings.HasPrefix(reference.URI, "#") {
+		return v.verifyExternalReference(i, reference)
+	}
+	nodes := wholeDocument
+	apex, comments, err := index.resolve(reference.URI)
+	if err != nil {
+		return err
+	}
+	nodes.apex = apex
+	if v.options.RejectCommentsInText {
+		if err := checkCommentsInText(doc, apex); err != nil {
+			return err
+		}
+	}
+	// Without a canonicalization transform the node-set is converted to
+	// octets using Canonical XML 1.0
+	canon, _ := pickCanonicalization(c14n10Namespace)
+	for _, transform := range reference.Transforms.Transform {
+		if !v.allowedTransform(transform.Algorithm) {
+			return ErrDisallowedTransform
+		}
+	}
+	if transforms := reference.Transforms.Transform; len(transforms) > 0 && transforms[len(transforms)-1].Algorithm == base64Transform {
+		return v.verifyBase64Reference(doc, apex, i, reference)
+	}
+	for _, transform := range reference.Transforms.Transform {
+		if transform.Algorithm == envelopedSignatureNamespace {
+			nodes.exclude = sigPos
+			continue
+		}
+		c, err := pickCanonicalization(transform.Algorithm)
+		if err != nil || transform.Algorithm == "" {
+			return fmt.Errorf("xmlsig does not support the transform %s", transform.Algorithm)
+		}
+		if transform.InclusiveNamespaces != nil {
+			if c, err = c.withPrefixList(transform.InclusiveNamespaces.PrefixList); err != nil {
+				return err
+			}
+		}
+		canon = c
+	}
+	if !comments {
+		canon = canon.withoutComments()
+	}
+	if reference.DigestMethod.Algorithm == "" {
+		return errors.New("xmlsig reference does not declare a digest method")
+	}
+	digestAlg, err := pickDigestAlgorithm(reference.DigestMethod.Algorithm)
+	if err != nil {
+		return err
+	}
+	expected, err := decodeBase64(reference.DigestValue)
+	if err != nil {
+		return err
+	}
+	var sum []byte
+	if v.options.CanonicalizeHook == nil && v.options.Canonicalizer == nil {
+		if sum, err = canon.digest(digestAlg.hash, bytes.NewReader(doc), nodes); err != nil {
+			return err
+		}
+	} else {
+		// the hook and the Canonicalizer need the whole canonical form
+		canonical, err := v.canonicalizeNodes(canon, doc, index, nodes)
+		if err != nil {
+			return err
+		}
+		data, err := v.options.CanonicalizeHook.apply(canonical)
+		if err != nil {
+			return err
+		}
+		h := digestAlg.hash.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	}
+	if !bytes.Equal(sum, expected) {
+		return &ReferenceError{Index: i, URI: reference.URI, Expected: reference.DigestValue, Computed: base64.StdEncoding.EncodeToString(sum)}
+	}
+	v.options.Logger.log("reference verified", "uri", reference.URI, "algorithm", digestAlg.name)
+	return nil
+}
+
+// verifyExternalReference checks the digest of a reference to content the
+// resolver supplies.
+func (v *verifier) verifyExternalReference(i int, reference Reference) error {
+	for _, transform := range reference.Transforms.Transform {
+		if !v.allowedTransform(transform.Algorithm) {
+			return ErrDisallowedTransform
+		}
+	}
+	data, err := v.resolver(reference.URI)
+	if err != nil {
+		return err
+	}
+	for _, transform := range reference.Transforms.Transform {
+		if transform.Algorithm == envelopedSignatureNamespace {
+			return errors.New("xmlsig can not apply the enveloped signature transform to another document")
+		}
+		if transform.Algorithm == base64Transform {
+			if data, err = decodeBase64(string(data)); err != nil {
+				return err
+			}
+			continue
+		}
+		c, err := pickCanonicalization(transform.Algorithm)
+		if err != nil || transform.Algorithm == "" {
+			return fmt.Errorf("xmlsig does not support the transform %s", transform.Algorithm)
+		}
+		if transform.InclusiveNamespaces != nil {
+			if c, err = c.withPrefixList(transform.InclusiveNamespaces.PrefixList); err != nil {
+				return err
+			}
+		}
+		var canonical bytes.Buffer
+		if _, err := c.write(&canonical, bytes.NewReader(data), wholeDocument); err != nil {
+			return err
+		}
+		data = canonical.Bytes()
+	}
+	if data, err = v.options.CanonicalizeHook.apply(data); err != nil {
+		return err
+	}
+	return v.checkDigest(i, reference, data)
+}
+
+// checkCommentsInText returns ErrCommentInText when a comment within the
+// element at the position, or the whole document for -1, has text other than
+// whitespace immediately before and after it.
+func checkCommentsInText(doc []byte, position int) error {
+	start, end := 0, len(doc)
+	if position >= 0 {
+		var err error
+		if start, _, end, err = elementBounds(doc, position); err != nil {
+			return err
+		}
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(doc[start:end]))
+	textBefore, comment := false, false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				textBefore, comment = false, false
+				continue
+			}
+			if comment && textBefore {
+				return ErrCommentInText
+			}
+			textBefore, comment = true, false
+		case xml.Comment:
+			comment = textBefore
+		default:
+			textBefore, comment = false, false
+		}
+	}
+}
+
+// verifyBase64Reference checks the digest of a reference whose only transform
+// is base64, which decodes the text of the referenced element, such as an
+// Object of an enveloping signature, to the octets that are digested.
+func (v *verifier) verifyBase64Reference(doc []byte, apex int, i int, reference Reference) error {
+	if len(reference.Transforms.Transform) > 1 {
+		return errors.New("xmlsig only supports the base64 transform on its own")
+	}
+	if apex < 0 {
+		return errors.New("xmlsig can only apply the base64 transform to an element")
+	}
+	var text struct {
+		Data string `xml:",chardata"`
+	}
+	if err := decodeElement(doc, apex, &text); err != nil {
+		return err
+	}
+	data, err := decodeBase64(text.Data)
+	if err != nil {
+		return err
+	}
+	return v.checkDigest(i, reference, data)
+}
+
+// checkDigest compares the digest of the data with the DigestValue of the
+// reference at position i.
+func (v *verifier) checkDigest(i int, reference Reference, data []byte) error {
+	if reference.DigestMethod.Algorithm == "" {
+		return errors.New("xmlsig reference does not declare a digest method")
+	}
+	digestAlg, err := pickDigestAlgorithm(reference.DigestMethod.Algorithm)
+	if err != nil {
+		return err
+	}
+	expected, err := decodeBase64(reference.DigestValue)
+	if err != nil {
+		return err
+	}
+	h := digestAlg.hash.New()
+	h.Write(data)
+	if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+		return &ReferenceError{Index: i, URI: reference.URI, Expected: reference.DigestValue, Computed: base64.StdEncoding.EncodeToString(sum)}
+	}
+	v.options.Logger.log("reference verified", "uri", reference.URI, "algorithm", digestAlg.name)
+	return nil
+}
+
+func (v *verifier) allowedSignatureMethod(alg string) bool {
+	allowed := v.options.AllowedSignatureMethods
+	if allowed == nil {
+		allowed = DefaultAllowedSignatureMethods
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *verifier) allowedTransform(alg string) bool {
+	allowed := v.options.AllowedTransforms
+	if allowed == nil {
+		allowed = DefaultAllowedTransforms
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *verifier) verifySignatureValue(doc []byte, index *document, sigPos int, signature *Signature) (*x509.Certificate, error) {
+	method := signature.SignedInfo.CanonicalizationMethod
+	canon, err := pickCanonicalization(method.Algorithm)
+	if err != nil || method.Algorithm == "" {
+		return nil, fmt.Errorf("xmlsig does not support the canonicalization method %s", method.Algorithm)
+	}
+	if method.InclusiveNamespaces != nil {
+		if canon, err = canon.withPrefixList(method.InclusiveNamespaces.PrefixList); err != nil {
+			return nil, err
+		}
+	}
+	nodes := subset{index.child(sigPos, xml.Name{Space: dsigNamespace, Local: "SignedInfo"}), -1}
+	if nodes.apex < 0 {
+		return nil, errors.New("xmlsig signature does not contain SignedInfo")
+	}
+	var signedInfo bytes.Buffer
+	if _, err := canon.write(&signedInfo, bytes.NewReader(doc), nodes); err != nil {
+		return nil, err
+	}
+	signed, err := v.options.CanonicalizeHook.apply(signedInfo.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if signature.SignedInfo.SignatureMethod.Algorithm == "" {
+		return nil, errors.New("xmlsig signature does not declare a signature method")
+	}
+	if !v.allowedSignatureMethod(signature.SignedInfo.SignatureMethod.Algorithm) {
+		return nil, ErrDisallowedSignatureMethod
+	}
+	value, err := decodeBase64(signature.SignatureValue)
+	if err != nil {
+		return nil, err
+	}
+	if v.options.HMACKey != nil {
+		return nil, checkHMAC(v.options.HMACKey, signature.SignedInfo.SignatureMethod.Algorithm, signed, value)
+	}
+	if v.options.KeyInfoResolver != nil {
+		key, err := v.options.KeyInfoResolver(&signature.KeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		return nil, checkKey(key, signature.SignedInfo.SignatureMethod.Algorithm, signed, value)
+	}
+	if v.options.KeyResolver != nil {
+		key, err := v.resolveKeyName(signature)
+		if err != nil {
+			return nil, err
+		}
+		return nil, checkKey(key, signature.SignedInfo.SignatureMethod.Algorithm, signed, value)
+	}
+	cert, err := v.certificate(doc, index, signature)
+	if err != nil {
+		return nil, err
+	}
+	if v.options.PinnedFingerprint != "" && !matchFingerprint(cert, v.options.PinnedFingerprint) {
+		return nil, ErrCertificateNotPinned
+	}
+	if v.options.CheckValidity && !v.withinValidity(cert) {
+		return nil, ErrCertificateNotValid
+	}
+	sigAlg, err := keyAlgorithm(cert.PublicKeyAlgorithm, signature.SignedInfo.SignatureMethod.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignatureValue(cert.PublicKey, sigAlg, signed, value); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// resolveKeyName looks up the key for the signature's KeyName.
+func (v *verifier) resolveKeyName(signature *Signature) (crypto.PublicKey, error) {
+	name := strings.TrimSpace(signature.KeyInfo.KeyName)
+	if name == "" {
+		return nil, errors.New("xmlsig signature does not contain a key name")
+	}
+	return v.options.KeyResolver(name)
+}
+
+// checkKey checks the signature value with a resolved key, where a []byte is
+// an HMAC key.
+func checkKey(key crypto.PublicKey, alg string, signed, value []byte) error {
+	switch key := key.(type) {
+	case []byte:
+		return checkHMAC(key, alg, signed, value)
+	case *rsa.PublicKey:
+		sigAlg, err := keyAlgorithm(x509.RSA, alg)
+		if err != nil {
+			return err
+		}
+		return checkSignatureValue(key, sigAlg, signed, value)
+	case *ecdsa.PublicKey:
+		sigAlg, err := keyAlgorithm(x509.ECDSA, alg)
+		if err != nil {
+			return err
+		}
+		return checkSignatureValue(key, sigAlg, signed, value)
+	case ed25519.PublicKey:
+		sigAlg, err := keyAlgorithm(x509.Ed25519, alg)
+		if err != nil {
+			return err
+		}
+		return checkSignatureValue(key, sigAlg, signed, value)
+	}
+	return errors.New("xmlsig does not currently support verifying signatures with this type of key")
+}
+
+// keyAlgorithm returns the declared signature method, which must be one for
+// the type of key.
+func keyAlgorithm(keyType x509.PublicKeyAlgorithm, alg string) (*algorithm, error) {
+	sigAlg, err := pickSignatureAlgorithm(keyType, alg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s for a %v key", ErrSignatureMethodMismatch, alg, keyType)
+	}
+	return sigAlg, nil
+}
+
+// withinValidity reports whether the clock is within the certificate's
+// validity period.
+func (v *verifier) withinValidity(cert *x509.Certificate) bool {
+	now := time.Now
+	if v.options.Clock != nil {
+		now = v.options.Clock
+	}
+	t := now()
+	return !t.Before(cert.NotBefore) && !t.After(cert.NotAfter)
+}
+
+// certificate returns the certificate to verify the signature with.
+func (v *verifier) certificate(doc []byte, index *document, signature *Signature) (*x509.Certificate, error) {
+	if v.options.Certificate != nil {
+		return v.options.Certificate, nil
+	}
+	x509Data := signature.KeyInfo.X509Data
+	if x509Data != nil && x509Data.X509Digest != nil {
+		return v.certificateByDigest(signature)
+	}
+	if method := signature.KeyInfo.RetrievalMethod; method != nil && (x509Data == nil || x509Data.X509Certificate == "") {
+		return v.retrieveCertificate(doc, index, method)
+	}
+	if str := signature.KeyInfo.SecurityTokenReference; str != nil && str.KeyIdentifier != nil && x509Data == nil {
+		return v.certificateByKeyIdentifier(str.KeyIdentifier)
+	}
+	return signature.certificate()
+}
+
+// certificateByKeyIdentifier returns the known certificate the KeyIdentifier
+// identifies.
+func (v *verifier) certificateByKeyIdentifier(identifier *KeyIdentifier) (*x509.Certificate, error) {
+	if identifier.ValueType != KeyIdentifierSKI && identifier.ValueType != KeyIdentifierThumbprint {
+		return nil, fmt.Errorf("xmlsig does not support the key identifier type %s", identifier.ValueType)
+	}
+	expected, err := decodeBase64(identifier.Value)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range v.options.Certificates {
+		if value, err := keyIdentifier(cert, identifier.ValueType, true); err == nil && bytes.Equal(value, expected) {
+			return cert, nil
+		}
+	}
+	return nil, ErrUnknownKeyIdentifier
+}
+
+const (
+	rawX509CertificateType = "http://www.w3.org/2000/09/xmldsig#rawX509Certificate"
+	wsseNamespace          = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+)
+
+// retrieveCertificate follows a RetrievalMethod to the certificate in the
+// X509Data or BinarySecurityToken with the ID of its URI, which may also be the
+// child of the element with the ID. Other URIs are resolved with the resolver
+// of VerifyDetached, as an X509Data or, for the rawX509Certificate Type, as
+// DER.
+func (v *verifier) retrieveCertificate(doc []byte, index *document, method *RetrievalMethod) (*x509.Certificate, error) {
+	if !strings.HasPrefix(method.URI, "#") {
+		if v.resolver == nil {
+			return nil, fmt.Errorf("xmlsig can not retrieve the key information at %s without a resolver", method.URI)
+		}
+		data, err := v.resolver(method.URI)
+		if err != nil {
+			return nil, err
+		}
+		if method.Type == rawX509CertificateType {
+			return x509.ParseCertificate(data)
+		}
+		x509Data := &X509Data{}
+		if err := xml.Unmarshal(data, x509Data); err != nil {
+			return nil, err
+		}
+		return parseX509Data(x509Data)
+	}
+	pos, err := index.lookupID(method.URI[1:])
+	if err != nil {
+		return nil, err
+	}
+	x509DataName := xml.Name{Space: dsigNamespace, Local: "X509Data"}
+	if index.elements[pos].name != x509DataName {
+		if child := index.child(pos, x509DataName); child >= 0 {
+			pos = child
+		}
+	}
+	switch index.elements[pos].name {
+	case x509DataName:
+		x509Data := &X509Data{}
+		if err := decodeElement(doc, pos, x509Data); err != nil {
+			return nil, err
+		}
+		return parseX509Data(x509Data)
+	case xml.Name{Space: wsseNamespace, Local: "BinarySecurityToken"}:
+		token := &BinarySecurityToken{}
+		if err := decodeElement(doc, pos, token); err != nil {
+			return nil, err
+		}
+		der, err := decodeBase64(token.Value)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	}
+	return nil, fmt.Errorf("xmlsig can not retrieve a certificate from the element with the ID %s", method.URI[1:])
+}
+
+// certificateByDigest returns the embedded certificate, or else the known
+// certificate, matching the X509Digest of the signature.
+func (v *verifier) certificateByDigest(signature *Signature) (*x509.Certificate, error) {
+	x509Digest := signature.KeyInfo.X509Data.X509Digest
+	alg, err := pickDigestAlgorithm(x509Digest.Algorithm)
+	if err != nil || x509Digest.Algorithm == "" {
+		return nil, fmt.Errorf("xmlsig does not support the X509Digest algorithm %s", x509Digest.Algorithm)
+	}
+	expected, err := decodeBase64(x509Digest.Value)
+	if err != nil {
+		return nil, err
+	}
+	matches := func(cert *x509.Certificate) bool {
+		h := alg.hash.New()
+		h.Write(cert.Raw)
+		return bytes.Equal(h.Sum(nil), expected)
+	}
+	if signature.KeyInfo.X509Data.X509Certificate != "" {
+		cert, err := signature.certificate()
+		if err != nil {
+			return nil, err
+		}
+		if !matches(cert) {
+			return nil, ErrX509DigestMismatch
+		}
+		return cert, nil
+	}
+	for _, cert := range v.options.Certificates {
+		if matches(cert) {
+			return cert, nil
+		}
+	}
+	return nil, ErrX509DigestMismatch
+}
+
+// certificate parses the first certificate in the signature's KeyInfo.
+func (signature *Signature) certificate() (*x509.Certificate, error) {
+	if signature.KeyInfo.X509Data == nil {
+		return nil, errors.New("xmlsig signature does not contain a certificate")
+	}
+	return parseX509Data(signature.KeyInfo.X509Data)
+}
+
+// parseX509Data parses the signing certificate in the X509Data.
+func parseX509Data(x509Data *X509Data) (*x509.Certificate, error) {
+	if x509Data.X509Certificate == "" {
+		return nil, errors.New("xmlsig signature does not contain a certificate")
+	}
+	der, err := decodeBase64(x509Data.X509Certificate)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// CertificateSHA256Fingerprint returns the SHA-256 fingerprint of the
+// certificate's DER encoding as lowercase hex, for pinning and logging.
+func CertificateSHA256Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// matchFingerprint compares a fingerprint ignoring case and colon separators.
+func matchFingerprint(cert *x509.Certificate, fingerprint string) bool {
+	fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	return CertificateSHA256Fingerprint(cert) == fingerprint
+}
+
+func checkSignatureValue(publicKey crypto.PublicKey, sigAlg *algorithm, signed, value []byte) error {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		h := sigAlg.hash.New()
+		h.Write(signed)
+		if rsa.VerifyPKCS1v15(key, sigAlg.hash, h.Sum(nil), value) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		h := sigAlg.hash.New()
+		h.Write(signed)
+		return verifyECDSA(key, h.Sum(nil), value)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signed, value) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return errors.New("xmlsig does not currently support verifying signatures with this type of key")
+}
+
+// decodeBase64 decodes base64 text that may be broken into lines.
+func decodeBase64(text string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+}
+
+// element describes an element of a document with its namespace resolved.
+type element struct {
+	name   xml.Name
+	parent int
+}
+
+// duplicateID is the position indexed for an ID that more than one element has.
+const duplicateID = -2
+
+// document lists the elements of a document in document order, so an
+// element's index is the position used to select it for canonicalization.
+// It also indexes the position of the element with each ID.
+type document struct {
+	elements []element
+	ids      map[string]int
+}
+
+func indexDocument(doc []byte, idAttributes []xml.Name) (*document, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	index := &document{ids: make(map[string]int)}
+	parents := &stack{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := -1
+			if top, err := parents.Top(); err == nil {
+				parent = top.(int)
+			}
+			pos := len(index.elements)
+			parents.Push(pos)
+			index.elements = append(index.elements, element{t.Name, parent})
+			id := elementID(t, idAttributes)
+			if id == "" {
+				continue
+			}
+			if _, ok := index.ids[id]; ok {
+				index.ids[id] = duplicateID
+			} else {
+				index.ids[id] = pos
+			}
+		case xml.EndElement:
+			parents.Pop()
+		}
+	}
+}
+
+// find returns the position of the outermost element with the name, the first
+// in document order when several are at the same depth, or -1.
+func (d *document) find(name xml.Name) int {
+	found, foundDepth := -1, 0
+	for i := range d.elements {
+		if d.elements[i].name != name {
+			continue
+		}
+		if depth := d.depth(i); found < 0 || depth < foundDepth {
+			found, foundDepth = i, depth
+		}
+	}
+	return found
+}
+
+// depth returns the number of ancestors of the element at the position.
+func (d *document) depth(pos int) int {
+	depth := 0
+	for p := d.elements[pos].parent; p >= 0; p = d.elements[p].parent {
+		depth++
+	}
+	return depth
+}
+
+// child returns the position of the first child of parent with the name, or -1.
+func (d *document) child(parent int, name xml.Name) int {
+	for i := parent + 1; i < len(d.elements); i++ {
+		if d.elements[i].parent == parent && d.elements[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// contains reports whether the element at pos is a descendant of ancestor.
+func (d *document) contains(ancestor, pos int) bool {
+	for pos = d.elements[pos].parent; pos >= 0; pos = d.elements[pos].parent {
+		if pos == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// covered reports whether the element at pos is within the content referenced
+// by the signature at sigPos. The signature itself is never covered, because
+// references to the document exclude it with the enveloped signature transform.
+func (d *document) covered(pos, sigPos int, signature *Signature) bool {
+	if pos == sigPos || d.contains(sigPos, pos) {
+		return false
+	}
+	for _, reference := range signature.SignedInfo.References() {
+		apex, _, err := d.resolve(reference.URI)
+		if err == nil && (apex < 0 || apex == pos || d.contains(apex, pos)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the position of the element a same-document reference URI
+// selects, or -1 for the whole document, and whether comments are kept. Only
+// the XPointer forms #xpointer(/) and #xpointer(id('ID')) keep comments.
+func (d *document) resolve(uri string) (int, bool, error) {
+	switch {
+	case uri == "":
+		return -1, false, nil
+	case uri == "#xpointer(/)":
+		return -1, true, nil
+	case strings.HasPrefix(uri, "#xpointer(id(") && strings.HasSuffix(uri, "))"):
+		id := strings.TrimSuffix(strings.TrimPrefix(uri, "#xpointer(id("), "))")
+		if len(id) < 2 || (id[0] != '\'' && id[0] != '"') || id[len(id)-1] != id[0] {
+			return -1, false, fmt.Errorf("xmlsig does not support the reference URI %s", uri)
+		}
+		pos, err := d.lookupID(id[1 : len(id)-1])
+		return pos, true, err
+	case strings.HasPrefix(uri, "#"):
+		pos, err := d.lookupID(uri[1:])
+		return pos, false, err
+	}
+	return -1, false, fmt.Errorf("xmlsig does not support the reference URI %s", uri)
+}
+
+// lookupID returns the position of the element with the ID. It is an error
+// for no element or more than one element to have the ID, as an attacker could
+// otherwise add an element to shadow the one that was signed.
+func (d *document) lookupID(id string) (int, error) {
+	pos, ok := d.ids[id]
+	if !ok {
+		return -1, fmt.Errorf("%w with the ID %s", ErrReferenceNotFound, id)
+	}
+	if pos == duplicateID {
+		return -1, ErrDuplicateID
+	}
+	return pos, nil
+}
+
+// decodeSignature unmarshals the Signature element at the position.
+func decodeSignature(doc []byte, position int) (*Signature, error) {
+	signature := &Signature{}
+	if err := decodeElement(doc, position, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// decodeElement unmarshals the element at the position into v.
+func decodeElement(doc []byte, position int, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for i := 0; ; {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if i == position {
+				return decoder.DecodeElement(v, &start)
+			}
+			i++
+		}
+	}
+}
@@ -0,0 +1,1806 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Envelope struct {
+	XMLName   xml.Name `xml:"urn:envelope Envelope"`
+	ID        string   `xml:",attr"`
+	Data      string   `xml:"urn:envelope Data"`
+	Signature *Signature
+}
+
+// signEnvelope signs an Envelope and returns it marshalled with its Signature.
+func signEnvelope(t *testing.T, signer Signer, doc *Envelope) []byte {
+	t.Helper()
+	sig, err := signer.CreateSignature(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Signature = sig
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerify(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := signEnvelope(t, signer, &Envelope{ID: "_1234", Data: "Hello, World!"})
+	verifier := NewVerifier()
+	if err := verifier.Verify(data); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte("Hello"), []byte("Jello"), 1)
+	if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+	if err := verifier.Verify([]byte(`<Envelope xmlns="urn:envelope"></Envelope>`)); err != ErrSignatureNotFound {
+		t.Fatalf("expected ErrSignatureNotFound but got %v", err)
+	}
+}
+
+func TestCanonicalizationMethods(t *testing.T) {
+	methods := []string{
+		"http://www.w3.org/TR/2001/REC-xml-c14n-20010315",
+		"http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments",
+		"http://www.w3.org/2001/10/xml-exc-c14n#",
+		"http://www.w3.org/2001/10/xml-exc-c14n#WithComments",
+		"http://www.w3.org/2006/12/xml-c14n11",
+		"http://www.w3.org/2006/12/xml-c14n11#WithComments",
+	}
+	verifier := NewVerifier()
+	for _, method := range methods {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizationAlgorithm: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := &Envelope{ID: "_1234", Data: "Hello, World!"}
+		data := signEnvelope(t, signer, doc)
+		if alg := doc.Signature.SignedInfo.CanonicalizationMethod.Algorithm; alg != method {
+			t.Fatalf("expected canonicalization method %s but got %s", method, alg)
+		}
+		transforms := doc.Signature.SignedInfo.Reference.Transforms.Transform
+		if alg := transforms[len(transforms)-1].Algorithm; alg != method {
+			t.Fatalf("expected canonicalization transform %s but got %s", method, alg)
+		}
+		if err := verifier.Verify(data); err != nil {
+			t.Fatalf("failed to verify signature using %s: %v", method, err)
+		}
+	}
+	if _, err := NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizationAlgorithm: "urn:unknown"}); err == nil {
+		t.Fatal("expected an error for an unknown canonicalization method")
+	}
+}
+
+func TestVerifySignDocument(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{
+		`<doc xmlns="urn:doc" xmlns:x="urn:x"><x:item>1</x:item><item>2</item></doc>`,
+		`<doc ID="_doc"><item>1</item></doc>`,
+	} {
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatalf("failed to verify %s: %v", signed, err)
+		}
+	}
+}
+
+func TestVerifySignaturePrefixes(t *testing.T) {
+	// The fixtures were signed by another XML Signature implementation
+	for _, test := range []struct {
+		file string
+		uri  string
+	}{
+		{"testdata/dsig-prefix.xml", "#_resp1"},
+		{"testdata/default-namespace.xml", "#_env1"},
+	} {
+		data, err := os.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := ParseSignature(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig.SignedInfo.References()) != 1 || sig.SignedInfo.Reference.URI != test.uri {
+			t.Fatalf("expected a reference to %s in %s", test.uri, test.file)
+		}
+		if sig.SignatureValue == "" || sig.KeyInfo.X509Data.X509Certificate == "" || len(sig.KeyInfo.X509Data.X509Chain) != 0 {
+			t.Fatalf("failed to parse the signature in %s", test.file)
+		}
+		if err := NewVerifier().Verify(data); err != nil {
+			t.Fatalf("failed to verify %s: %v", test.file, err)
+		}
+		tampered := bytes.Replace(data, []byte("example.com"), []byte("example.org"), 1)
+		tampered = bytes.Replace(tampered, []byte("Hello"), []byte("Jello"), 1)
+		if err := NewVerifier().Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch for tampered %s but got %v", test.file, err)
+		}
+	}
+}
+
+func TestPinnedFingerprint(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := signEnvelope(t, signer, &Envelope{ID: "_1234", Data: "Hello, World!"})
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := CertificateSHA256Fingerprint(parsed)
+	sum := sha256.Sum256(cert.Certificate[0])
+	if fingerprint != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected fingerprint %s", fingerprint)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{PinnedFingerprint: strings.ToUpper(fingerprint)})
+	if err := verifier.Verify(data); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := os.ReadFile("testdata/default-namespace.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(fixture); err != ErrCertificateNotPinned {
+		t.Fatalf("expected ErrCertificateNotPinned but got %v", err)
+	}
+}
+
+func TestVerifyInclusiveNamespaces(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{InclusiveNamespaces: []string{"#default", "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc xmlns="urn:doc" xmlns:x="urn:x" ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signed, []byte(`<InclusiveNamespaces xmlns="http://www.w3.org/2001/10/xml-exc-c14n#" PrefixList="#default x">`)) {
+		t.Fatalf("expected the transform to include the prefix list in %s", signed)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCanonicalizeHook(t *testing.T) {
+	doc := []byte(`<doc xmlns="urn:doc" ID="_doc"><item>Hello</item></doc>`)
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := func(data []byte) ([]byte, error) { return data, nil }
+	signer, err = NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizeHook: noop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signed, expected) {
+		t.Fatalf("expected a no-op hook not to change the output %s but got %s", expected, signed)
+	}
+
+	upper := func(data []byte) ([]byte, error) { return bytes.ToUpper(data), nil }
+	signer, err = NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizeHook: upper, VerifyAfterSign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{CanonicalizeHook: upper}).Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(signed); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch without the hook but got %v", err)
+	}
+}
+
+// tamperBase64 changes the first character of base64 text.
+func tamperBase64(value string) string {
+	if value[0] == 'A' {
+		return "B" + value[1:]
+	}
+	return "A" + value[1:]
+}
+
+func TestCounterSignature(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureID: "_sig"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signed, []byte(`<Signature xmlns="http://www.w3.org/2000/09/xmldsig#" Id="_sig">`)) ||
+		!bytes.Contains(signed, []byte(`<SignatureValue xmlns="http://www.w3.org/2000/09/xmldsig#" Id="_sig-SignatureValue">`)) {
+		t.Fatalf("expected the signature and its value to have an Id in %s", signed)
+	}
+	counterSigner, err := NewSignerWithOptions(testCertificate(t), SignerOptions{VerifyAfterSign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterSigned, err := counterSigner.(CounterSigner).CounterSign(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(counterSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.Object) != 1 || len(sig.Object[0].Signature) != 1 ||
+		sig.Object[0].Signature[0].SignedInfo.Reference.URI != "#_sig-SignatureValue" {
+		t.Fatalf("expected a counter-signature of the signature value in %s", counterSigned)
+	}
+	if err := NewVerifier().Verify(counterSigned); err != nil {
+		t.Fatal(err)
+	}
+	value := sig.SignatureValue
+	tampered := bytes.Replace(counterSigned, []byte(value), []byte(tamperBase64(value)), 1)
+	if err := NewVerifier().Verify(tampered); err == nil {
+		t.Fatal("expected the tampered signature value to fail verification")
+	}
+	counter := sig.Object[0].Signature[0].SignatureValue
+	tampered = bytes.Replace(counterSigned, []byte(counter), []byte(tamperBase64(counter)), 1)
+	if err := NewVerifier().Verify(tampered); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature for a tampered counter-signature but got %v", err)
+	}
+	if _, err := counterSigner.(CounterSigner).CounterSign([]byte(`<doc ID="_doc"/>`)); err == nil {
+		t.Fatal("expected an error counter-signing a document without a signature")
+	}
+	unnamed, err := counterSigner.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := counterSigner.(CounterSigner).CounterSign(unnamed); err == nil {
+		t.Fatal("expected an error counter-signing a signature value without an Id")
+	}
+}
+
+func TestIDAttributes(t *testing.T) {
+	for _, test := range []struct {
+		doc  string
+		ids  []xml.Name
+		want string
+	}{
+		{
+			`<doc xmlns="urn:doc" xml:id="_doc" Id="_other"><item>1</item></doc>`,
+			[]xml.Name{{Space: xmlNamespace, Local: "id"}},
+			"#_doc",
+		},
+		{
+			`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:1.0:assertion" AssertionID="_a1" MajorVersion="1"/>`,
+			[]xml.Name{{Local: "AssertionID"}},
+			"#_a1",
+		},
+		{
+			// The first attribute of the element that is an ID is used
+			`<doc AssertionID="_first" xml:id="_second"/>`,
+			[]xml.Name{{Space: xmlNamespace, Local: "id"}, {Local: "AssertionID"}},
+			"#_first",
+		},
+	} {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{IDAttributes: test.ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(test.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uri := sig.SignedInfo.Reference.URI; uri != test.want {
+			t.Fatalf("expected the reference %s but got %s", test.want, uri)
+		}
+		if err := NewVerifierWithOptions(VerifierOptions{IDAttributes: test.ids}).Verify(signed); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewVerifier().Verify(signed); err == nil {
+			t.Fatalf("expected %s not to be found without the ID attributes", test.want)
+		}
+	}
+}
+
+func TestRequiredReferences(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<Assertion ID="_a"><Subject>alice</Subject></Assertion>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_a"}})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// The signed assertion is moved aside as a decoy and an unsigned one is
+	// added for the application to use
+	wrapped := []byte(`<Response ID="_r"><Assertion ID="_evil"><Subject>admin</Subject></Assertion><Extensions>` +
+		string(signed) + `</Extensions></Response>`)
+	if err := NewVerifier().Verify(wrapped); err != nil {
+		t.Fatalf("expected the decoy signature to verify but got %v", err)
+	}
+	verifier = NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_evil"}})
+	if err := verifier.Verify(wrapped); err != ErrReferenceNotCovered {
+		t.Fatalf("expected ErrReferenceNotCovered but got %v", err)
+	}
+	verifier = NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_r"}})
+	if err := verifier.Verify(wrapped); err != ErrReferenceNotCovered {
+		t.Fatalf("expected ErrReferenceNotCovered for an ancestor of the reference but got %v", err)
+	}
+}
+
+func TestDuplicateIDs(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<Assertion ID="_a"><Subject>alice</Subject></Assertion>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An attacker inserts a shadow element with the signed element's ID ahead
+	// of it, hoping that the shadow is what gets processed
+	shadowed := []byte(`<Response><Assertion ID="_a"><Subject>admin</Subject></Assertion>` + string(signed) + `</Response>`)
+	if err := NewVerifier().Verify(shadowed); err != ErrDuplicateID {
+		t.Fatalf("expected ErrDuplicateID for a shadow element but got %v", err)
+	}
+	// A later element with the same ID is rejected too
+	duplicated := []byte(`<Response>` + string(signed) + `<Other ID="_a"/></Response>`)
+	if err := NewVerifier().Verify(duplicated); err != ErrDuplicateID {
+		t.Fatalf("expected ErrDuplicateID but got %v", err)
+	}
+	// So is a required reference to an ID that isn't unique
+	doc := []byte(`<doc><item ID="_dup"/><item ID="_dup"/></doc>`)
+	signed, err = signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_dup"}})
+	if err := verifier.Verify(signed); err != ErrDuplicateID {
+		t.Fatalf("expected ErrDuplicateID for a required reference but got %v", err)
+	}
+}
+
+func TestSignedInfoInclusiveNamespaces(t *testing.T) {
+	doc := []byte(`<x:doc xmlns:x="urn:x" ID="_doc"><x:item>1</x:item></x:doc>`)
+	values := make(map[string]bool)
+	for _, prefixes := range [][]string{nil, {"x"}} {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignedInfoInclusiveNamespaces: prefixes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatalf("failed to verify %s: %v", signed, err)
+		}
+		sig, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inclusive := sig.SignedInfo.CanonicalizationMethod.InclusiveNamespaces
+		if (inclusive != nil) != (prefixes != nil) || (inclusive != nil && inclusive.PrefixList != "x") {
+			t.Fatalf("unexpected InclusiveNamespaces %v on the canonicalization method", inclusive)
+		}
+		values[sig.SignatureValue] = true
+	}
+	// The prefix list renders xmlns:x on SignedInfo, so it is signed differently
+	if len(values) != 2 {
+		t.Fatal("expected the prefix list to change the canonical SignedInfo")
+	}
+	if _, err := NewSignerWithOptions(testCertificate(t), SignerOptions{
+		CanonicalizationAlgorithm:     c14n10Namespace,
+		SignedInfoInclusiveNamespaces: []string{"x"},
+	}); err == nil {
+		t.Fatal("expected an error using a prefix list with inclusive canonicalization")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var events []string
+	logger := func(event string, keyvals ...interface{}) {
+		if len(keyvals)%2 != 0 {
+			t.Fatalf("expected keys and values for %s but got %v", event, keyvals)
+		}
+		events = append(events, event)
+	}
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{Logger: logger})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(bytes.Replace(signed, []byte("<item>1"), []byte("<item>2"), 1)); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+	expected := []string{
+		"canonicalized",
+		"digest computed",
+		"signature computed",
+		"reference verified",
+		"verification succeeded",
+		"verification failed",
+	}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v but got %v", expected, events)
+	}
+}
+
+func TestLoggerStages(t *testing.T) {
+	var events []string
+	logger := func(event string, keyvals ...interface{}) {
+		events = append(events, event)
+	}
+	noop := func(data []byte) ([]byte, error) { return data, nil }
+	doc := []byte(`<doc ID="_doc"><item>1</item></doc>`)
+	reference := []string{"canonicalized", "digest computed"}
+	signature := []string{"signature computed"}
+	for _, test := range []struct {
+		name     string
+		options  SignerOptions
+		sign     func(Signer) error
+		expected [][]string
+	}{
+		{
+			name: "CreateSignature",
+			sign: func(signer Signer) error {
+				_, err := signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name: "CreateSignatureForField",
+			sign: func(signer Signer) error {
+				response := &Response{ID: "_response", Assertion: &Assertion{ID: "_assertion"}}
+				_, err := signer.(FieldSigner).CreateSignatureForField(response, "Assertion")
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name: "CreateSignatureForID",
+			sign: func(signer Signer) error {
+				_, err := signer.(IDSigner).CreateSignatureForID(&Envelope{ID: "_1234", Data: "Hello, World!"}, "_1234")
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name: "SignDocument",
+			sign: func(signer Signer) error {
+				_, err := signer.(DocumentSigner).SignDocument(doc)
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name:    "SignDocument with a CanonicalizeHook",
+			options: SignerOptions{CanonicalizeHook: noop},
+			sign: func(signer Signer) error {
+				_, err := signer.(DocumentSigner).SignDocument(doc)
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name:    "SignDocument with the signing time",
+			options: SignerOptions{SignatureID: "_sig", SigningTime: true},
+			sign: func(signer Signer) error {
+				_, err := signer.(DocumentSigner).SignDocument(doc)
+				return err
+			},
+			// the signed element's reference is digested before the time's
+			expected: [][]string{reference, reference, signature},
+		},
+		{
+			name:    "CounterSign",
+			options: SignerOptions{SignatureID: "_sig"},
+			sign: func(signer Signer) error {
+				signed, err := signer.(DocumentSigner).SignDocument(doc)
+				if err != nil {
+					return err
+				}
+				events = nil
+				_, err = signer.(CounterSigner).CounterSign(signed)
+				return err
+			},
+			expected: [][]string{reference, signature},
+		},
+		{
+			name: "CreateEnvelopingSignature",
+			sign: func(signer Signer) error {
+				_, err := signer.(EnvelopingSigner).CreateEnvelopingSignature([]byte("content"), "_object")
+				return err
+			},
+			// the content is digested without being canonicalized
+			expected: [][]string{{"digest computed"}, signature},
+		},
+	} {
+		options := test.options
+		options.Logger = logger
+		signer, err := NewSignerWithOptions(testCertificate(t), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = nil
+		if err := test.sign(signer); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var expected []string
+		for _, stage := range test.expected {
+			expected = append(expected, stage...)
+		}
+		if strings.Join(events, ",") != strings.Join(expected, ",") {
+			t.Fatalf("%s: expected events %v but got %v", test.name, expected, events)
+		}
+	}
+}
+
+func TestSignaturePrefix(t *testing.T) {
+	for _, test := range []struct {
+		doc    string
+		prefix string
+	}{
+		{`<doc ID="_doc"><item>1</item></doc>`, "ds"},
+		{`<doc xmlns:ds="urn:other" ID="_doc"><ds:item>1</ds:item></doc>`, "ds1"},
+		{`<doc xmlns:ds="urn:other" ID="_doc"><ds:item xmlns:ds1="urn:another" ds1:n="1">1</ds:item></doc>`, "ds2"},
+		{`<doc xmlns="urn:doc" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" ID="_doc"><item>1</item></doc>`, "ds"},
+	} {
+		for _, options := range []SignerOptions{
+			{SignaturePrefix: "ds", VerifyAfterSign: true},
+			{SignaturePrefix: "ds", CanonicalizationAlgorithm: c14n10Namespace},
+		} {
+			signer, err := NewSignerWithOptions(testCertificate(t), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, err := signer.(DocumentSigner).SignDocument([]byte(test.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := `<` + test.prefix + `:Signature xmlns:` + test.prefix + `="http://www.w3.org/2000/09/xmldsig#">`
+			if !bytes.Contains(signed, []byte(start)) || !bytes.Contains(signed, []byte(`<`+test.prefix+`:SignedInfo>`)) {
+				t.Fatalf("expected the signature to use the prefix %s in %s", test.prefix, signed)
+			}
+			if err := NewVerifier().Verify(signed); err != nil {
+				t.Fatalf("failed to verify %s: %v", signed, err)
+			}
+		}
+	}
+	if _, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignaturePrefix: "xmlns"}); err == nil {
+		t.Fatal("expected an error for a reserved prefix")
+	}
+}
+
+func TestVerifyWithoutReference(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutReference := regexp.MustCompile(`<Reference .*</Reference>`).ReplaceAll(signed, nil)
+	if err := NewVerifier().Verify(withoutReference); !errors.Is(err, ErrNoReference) {
+		t.Fatalf("expected ErrNoReference but got %v", err)
+	}
+	if _, err := ParseSignature(withoutReference); !errors.Is(err, ErrNoReference) {
+		t.Fatalf("expected ErrNoReference parsing the signature but got %v", err)
+	}
+}
+
+func TestVerifyAndExtract(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := signEnvelope(t, signer, &Envelope{ID: "_1234", Data: "Hello, World!"})
+	signing, err := NewVerifier().(CertificateVerifier).VerifyAndExtract(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signing.Raw, cert.Certificate[0]) {
+		t.Fatal("expected the certificate used to sign the document")
+	}
+	tampered := bytes.Replace(data, []byte("Hello"), []byte("Jello"), 1)
+	if signing, err := NewVerifier().(CertificateVerifier).VerifyAndExtract(tampered); !errors.Is(err, ErrDigestMismatch) || signing != nil {
+		t.Fatalf("expected no certificate and ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestVerifyAndExtractWithoutCertificate(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSignerWithOptions(cert, SignerOptions{KeyName: "partner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := cert.PrivateKey.(crypto.Signer).Public()
+	key := []byte("shared secret")
+	hmacSigner, err := NewHMACSigner(key, SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacSigned, err := hmacSigner.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		options VerifierOptions
+		doc     []byte
+	}{
+		"KeyResolver": {VerifierOptions{KeyResolver: func(string) (crypto.PublicKey, error) {
+			return public, nil
+		}}, signed},
+		"KeyInfoResolver": {VerifierOptions{KeyInfoResolver: func(*KeyInfo) (crypto.PublicKey, error) {
+			return public, nil
+		}}, signed},
+		"HMACKey": {VerifierOptions{HMACKey: key}, hmacSigned},
+	} {
+		found, err := NewVerifierWithOptions(test.options).(CertificateVerifier).VerifyAndExtract(test.doc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if found != nil {
+			t.Fatalf("%s: expected no certificate for a key that isn't from one", name)
+		}
+		tampered := bytes.Replace(test.doc, []byte(">1<"), []byte(">2<"), 1)
+		if _, err := NewVerifierWithOptions(test.options).(CertificateVerifier).VerifyAndExtract(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("%s: expected ErrDigestMismatch but got %v", name, err)
+		}
+	}
+}
+
+func TestKeyInfoResolver(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leave only the X509IssuerSerial to identify the key
+	signed = regexp.MustCompile(`<X509Certificate[^>]*>[^<]*</X509Certificate>`).ReplaceAll(signed, nil)
+	if err := NewVerifier().Verify(signed); err == nil {
+		t.Fatal("expected an error without a certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{
+		KeyInfoResolver: func(keyInfo *KeyInfo) (crypto.PublicKey, error) {
+			if keyInfo.X509Data == nil || keyInfo.X509Data.X509IssuerSerial.SerialNumber == nil {
+				return nil, errors.New("no issuer serial")
+			}
+			if keyInfo.X509Data.X509IssuerSerial.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+				return nil, errors.New("unknown serial number")
+			}
+			return leaf.PublicKey, nil
+		},
+	})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(signed, []byte("<item>1"), []byte("<item>2"), 1)
+	if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestReferenceTransforms(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizationAlgorithm: "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unused namespace is dropped by exclusive canonicalization
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc xmlns:x="urn:x" ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var algorithms []string
+	for _, transform := range signature.SignedInfo.Reference.Transforms.Transform {
+		algorithms = append(algorithms, transform.Algorithm)
+	}
+	expected := []string{"http://www.w3.org/2000/09/xmldsig#enveloped-signature", "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"}
+	if strings.Join(algorithms, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected transforms %v but got %v", expected, algorithms)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	exclusive := bytes.Replace(signed, []byte(`<Transform xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/TR/2001/REC-xml-c14n-20010315">`),
+		[]byte(`<Transform xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#">`), 1)
+	if bytes.Equal(exclusive, signed) {
+		t.Fatal("expected to replace the canonicalization transform")
+	}
+	if err := NewVerifier().Verify(exclusive); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected the declared transform to be applied but got %v", err)
+	}
+}
+
+func TestAllowedTransforms(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	xslt := bytes.Replace(signed, []byte(`<Transform xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></Transform>`),
+		[]byte(`<Transform xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/TR/1999/REC-xslt-19991116"></Transform><Transform xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></Transform>`), 1)
+	if bytes.Equal(xslt, signed) {
+		t.Fatal("expected to add an XSLT transform")
+	}
+	if err := NewVerifier().Verify(xslt); err != ErrDisallowedTransform {
+		t.Fatalf("expected ErrDisallowedTransform but got %v", err)
+	}
+	restricted := NewVerifierWithOptions(VerifierOptions{AllowedTransforms: []string{"http://www.w3.org/2000/09/xmldsig#enveloped-signature"}})
+	if err := restricted.Verify(signed); err != ErrDisallowedTransform {
+		t.Fatalf("expected ErrDisallowedTransform for exclusive canonicalization but got %v", err)
+	}
+}
+
+func TestCertificateValidityClock(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		at       time.Time
+		expected error
+	}{
+		{leaf.NotBefore.Add(-time.Second), ErrCertificateNotValid},
+		{leaf.NotBefore, nil},
+		{leaf.NotAfter, nil},
+		{leaf.NotAfter.Add(time.Second), ErrCertificateNotValid},
+	}
+	for _, test := range tests {
+		at := test.at
+		verifier := NewVerifierWithOptions(VerifierOptions{
+			CheckValidity: true,
+			Clock:         func() time.Time { return at },
+		})
+		if err := verifier.Verify(signed); err != test.expected {
+			t.Fatalf("expected %v at %v but got %v", test.expected, at, err)
+		}
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{CheckValidity: true}).Verify(signed); err != nil {
+		t.Fatalf("expected the certificate to be valid now but got %v", err)
+	}
+}
+
+func TestVerifyWithComments(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizationAlgorithm: "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`<doc ID="_doc"><!-- note --><item>1</item></doc>`)
+	withComments, _ := pickCanonicalization("http://www.w3.org/2001/10/xml-exc-c14n#WithComments")
+	var canonical bytes.Buffer
+	if _, err := withComments.write(&canonical, bytes.NewReader(doc), wholeDocument); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(canonical.Bytes(), []byte("<!-- note -->")) {
+		t.Fatalf("expected the comment in %s", canonical.Bytes())
+	}
+	sum := sha1.Sum(canonical.Bytes())
+	// the XPointer form of the URI keeps comments in the node-set
+	reference := Reference{URI: "#xpointer(id('_doc'))", DigestValue: base64.StdEncoding.EncodeToString(sum[:])}
+	reference.Transforms.Transform = []Algorithm{
+		{Algorithm: "http://www.w3.org/2000/09/xmldsig#enveloped-signature"},
+		{Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"},
+	}
+	sig, err := CreateSignatureWithReferences(signer, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := bytes.Replace(doc, []byte("</doc>"), append(data, "</doc>"...), 1)
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_doc"}})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	stripped := bytes.Replace(signed, []byte("<!-- note -->"), nil, 1)
+	if err := verifier.Verify(stripped); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch without the comment but got %v", err)
+	}
+	// a bare #id reference removes comments, so the digest no longer matches
+	bare := bytes.Replace(signed, []byte(`URI="#xpointer(id(&#39;_doc&#39;))"`), []byte(`URI="#_doc"`), 1)
+	if bytes.Equal(bare, signed) {
+		t.Fatal("expected to replace the reference URI")
+	}
+	if err := verifier.Verify(bare); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch for a bare ID reference but got %v", err)
+	}
+}
+
+func TestEmbeddedSignature(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := signer.(DocumentSigner).SignDocument([]byte(`<inner xmlns="urn:inner" ID="_inner"><item>1</item></inner>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := append(append([]byte(`<outer xmlns:ds="http://www.w3.org/2000/09/xmldsig#" ID="_outer"><header/>`), inner...), "</outer>"...)
+	signed, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(signed, []byte("<SignatureValue")); n != 2 {
+		t.Fatalf("expected both signatures but got %d in %s", n, signed)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri := signature.SignedInfo.Reference.URI; uri != "#_outer" {
+		t.Fatalf("expected the enveloping signature but got the one referencing %s", uri)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_outer", "_inner"}})
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// the embedded signed element still verifies on its own
+	start := bytes.Index(signed, []byte("<inner"))
+	end := bytes.Index(signed, []byte("</inner>")) + len("</inner>")
+	if err := NewVerifier().Verify(signed[start:end]); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(signed, []byte("<item>1"), []byte("<item>2"), 1)
+	if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestMaxDocumentSize(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{MaxDocumentSize: len(signed)}).Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{MaxDocumentSize: len(signed) - 1}).Verify(signed); err != ErrDocumentTooLarge {
+		t.Fatalf("expected ErrDocumentTooLarge but got %v", err)
+	}
+}
+
+func TestMaxSignatures(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{MaxSignatures: 1}).Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	start := bytes.Index(signed, []byte("<Signature "))
+	end := bytes.LastIndex(signed, []byte("</Signature>")) + len("</Signature>")
+	copies := bytes.Repeat(signed[start:end], 50)
+	many := append(append(append([]byte(nil), signed[:end]...), copies...), signed[end:]...)
+	var events []string
+	verifier := NewVerifierWithOptions(VerifierOptions{
+		MaxSignatures: 10,
+		Logger: func(event string, keyvals ...interface{}) {
+			events = append(events, event)
+		},
+	})
+	if err := verifier.Verify(many); err != ErrTooManySignatures {
+		t.Fatalf("expected ErrTooManySignatures but got %v", err)
+	}
+	if err := verifier.(DigestVerifier).VerifyDigests(many); err != ErrTooManySignatures {
+		t.Fatalf("expected ErrTooManySignatures but got %v", err)
+	}
+	// the document is rejected before any reference is checked
+	for _, event := range events {
+		if event == "reference verified" {
+			t.Fatal("expected no reference to be checked")
+		}
+	}
+}
+
+func TestVerifyDigests(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier()
+	if err := verifier.(DigestVerifier).VerifyDigests(signed); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a broken signature value doesn't matter when only checking digests
+	value := sig.SignatureValue
+	badValue := bytes.Replace(signed, []byte(value), []byte(tamperBase64(value)), 1)
+	if err := verifier.(DigestVerifier).VerifyDigests(badValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(badValue); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+	altered := bytes.Replace(signed, []byte("<item>1"), []byte("<item>2"), 1)
+	if !bytes.Contains(altered, []byte(value)) {
+		t.Fatal("expected the signature value to be untouched")
+	}
+	if err := verifier.(DigestVerifier).VerifyDigests(altered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestSigningTime(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	clock := func() time.Time { return at }
+	tests := []struct {
+		options SignerOptions
+		doc     string
+	}{
+		{SignerOptions{}, `<doc ID="_doc"><item>1</item></doc>`},
+		{
+			SignerOptions{SignaturePrefix: "ds", CanonicalizationAlgorithm: "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"},
+			`<doc xmlns="urn:doc" xmlns:x="urn:x" ID="_doc"><item>1</item></doc>`,
+		},
+	}
+	for _, test := range tests {
+		options := test.options
+		options.SignatureID = "_sig"
+		options.SigningTime = true
+		options.Clock = clock
+		options.VerifyAfterSign = true
+		signer, err := NewSignerWithOptions(testCertificate(t), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(test.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(signed, []byte(`Target="#_sig"><date xmlns="http://purl.org/dc/elements/1.1/">2024-01-02T02:04:05Z</date>`)) {
+			t.Fatalf("expected the signing time in %s", signed)
+		}
+		sig, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig.SignedInfo.References()) != 2 || sig.SignedInfo.AdditionalReferences[0].URI != "#_sig-SignatureProperties" {
+			t.Fatalf("expected a reference to the signature properties in %s", signed)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatal(err)
+		}
+		tampered := bytes.Replace(signed, []byte("2024-01-02T02:04:05Z"), []byte("2023-01-02T02:04:05Z"), 1)
+		if err := NewVerifier().Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch for a tampered signing time but got %v", err)
+		}
+	}
+	if _, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SigningTime: true}); err == nil {
+		t.Fatal("expected an error for the signing time without a SignatureID")
+	}
+}
+
+func TestSerializeParsedSignature(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignaturePrefix: "ds", CanonicalizationAlgorithm: "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc xmlns:ext="urn:ext" ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add extensions like another implementation might, including a Reference
+	// attribute the types don't have, and sign SignedInfo again. The ext prefix
+	// is declared on the document element.
+	signed = bytes.Replace(signed, []byte(`<ds:Reference URI="#_doc">`), []byte(`<ds:Reference Id="_ref" URI="#_doc">`), 1)
+	signed = bytes.Replace(signed, []byte(`</ds:KeyInfo>`), []byte(`<ext:Hint ext:kind="test"><ext:Value>1</ext:Value></ext:Hint></ds:KeyInfo><ds:Object Id="_obj"><ext:Note>note</ext:Note></ds:Object>`), 1)
+	index, err := indexDocument(signed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := pickCanonicalization("http://www.w3.org/TR/2001/REC-xml-c14n-20010315")
+	var signedInfo bytes.Buffer
+	if _, err := c.write(&signedInfo, bytes.NewReader(signed), subset{index.find(xml.Name{Space: dsigNamespace, Local: "SignedInfo"}), -1}); err != nil {
+		t.Fatal(err)
+	}
+	value, err := signer.Sign(signedInfo.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed = bytes.Replace(signed, []byte(original.SignatureValue), []byte(value), 1)
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := sig.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, extension := range []string{`Id="_ref"`, `<ext:Hint ext:kind="test"><ext:Value>1</ext:Value></ext:Hint>`, `<ext:Note>note</ext:Note>`} {
+		if !bytes.Contains(serialized, []byte(extension)) {
+			t.Fatalf("expected %s to survive in %s", extension, serialized)
+		}
+	}
+	start := bytes.Index(signed, []byte("<ds:Signature"))
+	end := bytes.Index(signed, []byte("</ds:Signature>")) + len("</ds:Signature>")
+	if !bytes.Equal(serialized, signed[start:end]) {
+		t.Fatalf("expected the element as written but got %s", serialized)
+	}
+	reassembled := append(append(append([]byte(nil), signed[:start]...), serialized...), signed[end:]...)
+	if err := NewVerifier().Verify(reassembled); err != nil {
+		t.Fatalf("expected the serialized signature to verify: %v\n%s", err, reassembled)
+	}
+
+	// a modified signature is marshalled from its fields
+	sig.KeyInfo.KeyName = "changed"
+	modified, err := sig.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(modified, []byte(">changed</KeyName>")) {
+		t.Fatalf("expected the modification in %s", modified)
+	}
+	// the extensions are kept, with the prefix they use declared
+	for _, extension := range []string{`xmlns:ext="urn:ext"`, `Id="_ref"`, `<ext:Value>1</ext:Value>`, `<Note xmlns="urn:ext">note</Note>`} {
+		if !bytes.Contains(modified, []byte(extension)) {
+			t.Fatalf("expected %s to survive the modification in %s", extension, modified)
+		}
+	}
+	reparsed, err := ParseSignature(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := reparsed.KeyInfo.Foreign
+	if len(foreign) != 1 || foreign[0].XMLName != (xml.Name{Space: "urn:ext", Local: "Hint"}) {
+		t.Fatalf("expected the KeyInfo extension to be parsed again but got %+v", foreign)
+	}
+	kind := false
+	for _, att := range foreign[0].Attrs {
+		if att.Name == (xml.Name{Space: "urn:ext", Local: "kind"}) && att.Value == "test" {
+			kind = true
+		}
+	}
+	if !kind {
+		t.Fatalf("expected the attribute of the extension to be kept but got %+v", foreign[0].Attrs)
+	}
+	if len(reparsed.Object) != 1 || len(reparsed.Object[0].Foreign) != 1 {
+		t.Fatalf("expected the Object extension to be parsed again but got %+v", reparsed.Object)
+	}
+}
+
+type wsuBody struct {
+	XMLName   xml.Name `xml:"Body"`
+	ID        string   `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Id,attr"`
+	Data      string   `xml:"Data"`
+	Signature *Signature
+}
+
+func TestNamespacedIDOnElementWithoutNamespace(t *testing.T) {
+	const wsu = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_body"}})
+
+	// the declaration is on an ancestor of the signed element
+	doc := []byte(`<Envelope xmlns:wsu="` + wsu + `"><Header/><Body wsu:Id="_body"><Data>1</Data></Body></Envelope>`)
+	c, _ := pickCanonicalization("")
+	var canonical bytes.Buffer
+	id, err := c.write(&canonical, bytes.NewReader(doc), subset{2, -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<Body xmlns:wsu="` + wsu + `" wsu:Id="_body"><Data>1</Data></Body>`
+	if id != "_body" || canonical.String() != expected {
+		t.Fatalf("expected %s with ID _body but got %s with ID %s", expected, canonical.String(), id)
+	}
+
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the encoder picks its own prefix for the attribute
+	body := &wsuBody{ID: "_body", Data: "1"}
+	sig, err := signer.CreateSignature(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri := sig.SignedInfo.Reference.URI; uri != "#_body" {
+		t.Fatalf("expected a reference to #_body but got %s", uri)
+	}
+	body.Signature = sig
+	signed, err = xml.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(signed, []byte("<Data>1"), []byte("<Data>2"), 1)
+	if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestVerifyWholeDocument(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<?style sheet?><doc><!-- note --><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri := signature.SignedInfo.Reference.URI; uri != "" {
+		t.Fatalf("expected a reference to the whole document but got %s", uri)
+	}
+	verifier := NewVerifier()
+	if err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// comments aren't part of the whole document reference
+	commented := bytes.Replace(signed, []byte("<!-- note -->"), []byte("<!-- changed -->"), 1)
+	if err := verifier.Verify(commented); err != nil {
+		t.Fatal(err)
+	}
+	for _, tampered := range [][]byte{
+		bytes.Replace(signed, []byte("<item>1"), []byte("<item>2"), 1),
+		bytes.Replace(signed, []byte("<?style sheet?>"), []byte("<?style other?>"), 1),
+		bytes.Replace(signed, []byte("</doc>"), []byte("<extra/></doc>"), 1),
+	} {
+		if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch for %s but got %v", tampered, err)
+		}
+	}
+}
+
+func TestSignEmptyRoot(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		doc, uri, prefix string
+	}{
+		{`<root ID="x"/>`, "#x", `<root ID="x"><Signature `},
+		{`<root/>`, "", `<root><Signature `},
+	}
+	for _, test := range tests {
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(test.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the Signature is the only child of the root
+		if !bytes.HasPrefix(signed, []byte(test.prefix)) || !bytes.HasSuffix(signed, []byte("</Signature></root>")) {
+			t.Fatalf("expected the Signature to be the only child of the root but got %s", signed)
+		}
+		signature, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference := signature.SignedInfo.Reference
+		if reference.URI != test.uri {
+			t.Fatalf("expected a reference to %q but got %q", test.uri, reference.URI)
+		}
+		if len(reference.Transforms.Transform) == 0 || reference.Transforms.Transform[0].Algorithm != envelopedSignatureNamespace {
+			t.Fatalf("expected an enveloped signature transform but got %+v", reference.Transforms)
+		}
+		// the digest is of the empty root
+		root := test.doc[:len(test.doc)-2] + "></root>"
+		sum := sha1.Sum([]byte(root))
+		if expected := base64.StdEncoding.EncodeToString(sum[:]); reference.DigestValue != expected {
+			t.Fatalf("expected the digest of %s but got %s", root, reference.DigestValue)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatal(err)
+		}
+		tampered := bytes.Replace(signed, []byte("</Signature></root>"), []byte("</Signature><extra/></root>"), 1)
+		if err := NewVerifier().Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch but got %v", err)
+		}
+	}
+}
+
+func TestReferenceWithoutTransforms(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	// without transforms the element is digested in Canonical XML 1.0
+	item := `<item xmlns="urn:items" ID="_a">one</item>`
+	sig, err := CreateSignatureWithReferences(signer, Reference{URI: "#_a", DigestValue: digest(item)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Transforms")) {
+		t.Fatalf("expected no Transforms element in %s", data)
+	}
+	doc := []byte(`<items xmlns="urn:items"><item ID="_a">one</item>` + string(data) + `</items>`)
+	if err := NewVerifier().Verify(doc); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(doc, []byte(">one<"), []byte(">two<"), 1)
+	if err := NewVerifier().Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+
+	// without transforms the octets of another document are digested as they are
+	octets := "not XML, just octets\r\n"
+	sig, err = CreateSignatureWithReferences(signer, Reference{URI: "https://example.com/data.txt", DigestValue: digest(octets)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = xml.Marshal(sig); err != nil {
+		t.Fatal(err)
+	}
+	resolver := func(uri string) ([]byte, error) {
+		return []byte(octets), nil
+	}
+	if err := NewVerifier().(DetachedVerifier).VerifyDetached(data, resolver); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForeignKeyInfo(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := []byte(`<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">`)
+	extension := `<ext:Hint xmlns:ext="urn:ext" level="2"><ext:Value>x</ext:Value></ext:Hint>`
+	extended := bytes.Replace(signed, keyInfo, append(append([]byte(nil), keyInfo...), extension...), 1)
+
+	// parsing keeps the extension
+	signature, err := ParseSignature(extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := signature.KeyInfo.Foreign
+	if len(foreign) != 1 || foreign[0].XMLName != (xml.Name{Space: "urn:ext", Local: "Hint"}) ||
+		foreign[0].InnerXML != `<ext:Value>x</ext:Value>` {
+		t.Fatalf("expected the extension to be kept but got %+v", foreign)
+	}
+	if len(foreign[0].Attrs) == 0 || foreign[0].Attrs[len(foreign[0].Attrs)-1].Value != "2" {
+		t.Fatalf("expected the attributes of the extension to be kept but got %+v", foreign[0].Attrs)
+	}
+	serialized, err := signature.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(serialized, []byte(extension)) {
+		t.Fatalf("expected the extension in %s", serialized)
+	}
+	marshalled, err := xml.Marshal(signature.KeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(marshalled, []byte(`<Hint xmlns="urn:ext" xmlns:ext="urn:ext" level="2"><ext:Value>x</ext:Value></Hint>`)) {
+		t.Fatalf("expected the extension in %s", marshalled)
+	}
+
+	// unknown children are ignored unless KeyInfo is strict
+	if err := NewVerifier().Verify(extended); err != nil {
+		t.Fatal(err)
+	}
+	strict := NewVerifierWithOptions(VerifierOptions{StrictKeyInfo: true})
+	if err := strict.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.Verify(extended); !errors.Is(err, ErrUnknownKeyInfo) {
+		t.Fatalf("expected ErrUnknownKeyInfo but got %v", err)
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	content := map[string][]byte{
+		"https://example.com/data.xml": []byte(`<data xmlns:unused="urn:unused"><item>1</item></data>`),
+		"https://example.com/raw.bin":  []byte("raw content"),
+	}
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlReference := Reference{URI: "https://example.com/data.xml", DigestValue: digest([]byte(`<data><item>1</item></data>`))}
+	xmlReference.Transforms.Transform = []Algorithm{{Algorithm: CanonExclusive}}
+	xmlReference.DigestMethod.Algorithm = DigestSHA256
+	rawReference := Reference{URI: "https://example.com/raw.bin", DigestValue: digest(content["https://example.com/raw.bin"])}
+	rawReference.DigestMethod.Algorithm = DigestSHA256
+	sig, err := CreateSignatureWithReferences(signer, xmlReference, rawReference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detached, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := func(uri string) ([]byte, error) {
+		data, ok := content[uri]
+		if !ok {
+			return nil, errors.New("unknown URI " + uri)
+		}
+		return data, nil
+	}
+	verifier := NewVerifier()
+	if err := verifier.(DetachedVerifier).VerifyDetached(detached, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(detached); err == nil {
+		t.Fatal("expected references to other documents to fail without a resolver")
+	}
+	content["https://example.com/raw.bin"] = []byte("changed content")
+	if err := verifier.(DetachedVerifier).VerifyDetached(detached, resolver); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch but got %v", err)
+	}
+	delete(content, "https://example.com/raw.bin")
+	if err := verifier.(DetachedVerifier).VerifyDetached(detached, resolver); err == nil || !strings.Contains(err.Error(), "unknown URI") {
+		t.Fatalf("expected the resolver error but got %v", err)
+	}
+}
+
+func TestX509Digest(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSignerWithOptions(cert, SignerOptions{X509DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	x509Digest := signature.KeyInfo.X509Data.X509Digest
+	if x509Digest == nil || x509Digest.Algorithm != DigestSHA256 || x509Digest.Value != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("expected the SHA-256 digest of the certificate but got %+v", x509Digest)
+	}
+	if !bytes.Contains(signed, []byte(`<X509Digest xmlns="http://www.w3.org/2009/xmldsig11#" Algorithm="`+DigestSHA256+`">`)) {
+		t.Fatalf("expected an X509Digest element in %s", signed)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the KeyInfo isn't signed, so the certificate can be left out
+	withoutCert := regexp.MustCompile(`<X509Certificate[^>]*>[^<]*</X509Certificate>`).ReplaceAll(signed, nil)
+	known, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another certificate for the same key only differs in its digest
+	other := issueCertificate(t, "other", cert.PrivateKey.(crypto.Signer), nil, nil)
+	verifier := NewVerifierWithOptions(VerifierOptions{Certificates: []*x509.Certificate{other, known}})
+	found, err := verifier.(CertificateVerifier).VerifyAndExtract(withoutCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.Equal(known) {
+		t.Fatal("expected the known certificate matching the X509Digest")
+	}
+	verifier = NewVerifierWithOptions(VerifierOptions{Certificates: []*x509.Certificate{other}})
+	if err := verifier.Verify(withoutCert); err != ErrX509DigestMismatch {
+		t.Fatalf("expected ErrX509DigestMismatch but got %v", err)
+	}
+	// an embedded certificate must match the digest
+	swapped := bytes.Replace(signed, []byte(base64.StdEncoding.EncodeToString(cert.Certificate[0])),
+		[]byte(base64.StdEncoding.EncodeToString(other.Raw)), 1)
+	if err := NewVerifier().Verify(swapped); err != ErrX509DigestMismatch {
+		t.Fatalf("expected ErrX509DigestMismatch but got %v", err)
+	}
+}
+
+func TestReferenceError(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureID: "_sig", SigningTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second reference is to the signature properties
+	tampered := regexp.MustCompile(`<date([^>]*)>[^<]*</date>`).ReplaceAll(signed, []byte(`<date$1>2000-01-01T00:00:00Z</date>`))
+	err = NewVerifier().Verify(tampered)
+	var refErr *ReferenceError
+	if !errors.As(err, &refErr) || !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected a ReferenceError but got %v", err)
+	}
+	if refErr.Index != 1 || refErr.URI != "#_sig-SignatureProperties" || refErr.Expected != sig.SignedInfo.AdditionalReferences[0].DigestValue {
+		t.Fatalf("expected the error to identify the second reference but got %+v", refErr)
+	}
+	if refErr.Computed == "" || refErr.Computed == refErr.Expected {
+		t.Fatalf("expected the computed digest to differ but got %s", refErr.Computed)
+	}
+	if err := NewVerifier().(DigestVerifier).VerifyDigests(tampered); !errors.As(err, &refErr) || refErr.Index != 1 {
+		t.Fatalf("expected VerifyDigests to identify the second reference but got %v", err)
+	}
+}
+
+func TestRetrievalMethod(t *testing.T) {
+	cert := testCertificate(t)
+	encoded := base64.StdEncoding.EncodeToString(cert.Certificate[0])
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the KeyInfo isn't signed, so it can point elsewhere for the certificate
+	keyInfo := regexp.MustCompile(`<KeyInfo .*</KeyInfo>`)
+	retrieve := func(uri, typ string) []byte {
+		method := `<KeyInfo xmlns="` + dsigNamespace + `"><RetrievalMethod URI="` + uri + `" Type="` + typ + `"/></KeyInfo>`
+		return keyInfo.ReplaceAll(signed, []byte(method))
+	}
+	documents := map[string][]byte{
+		"X509Data": append(append([]byte(`<envelope><keys ID="_keys"><X509Data xmlns="`+dsigNamespace+`"><X509Certificate>`+encoded+
+			`</X509Certificate></X509Data></keys>`), retrieve("#_keys", "http://www.w3.org/2000/09/xmldsig#X509Data")...), "</envelope>"...),
+		"BinarySecurityToken": append(append([]byte(`<envelope xmlns:wsse="`+wsseNamespace+`"><wsse:BinarySecurityToken ID="_token">`+encoded+
+			`</wsse:BinarySecurityToken>`), retrieve("#_token", "")...), "</envelope>"...),
+	}
+	for name, doc := range documents {
+		found, err := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_d"}}).(CertificateVerifier).VerifyAndExtract(doc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if base64.StdEncoding.EncodeToString(found.Raw) != encoded {
+			t.Fatalf("%s: expected the retrieved certificate", name)
+		}
+	}
+
+	external := retrieve("https://example.com/cert.der", "http://www.w3.org/2000/09/xmldsig#rawX509Certificate")
+	if err := NewVerifier().Verify(external); err == nil {
+		t.Fatal("expected an error retrieving an external certificate without a resolver")
+	}
+	resolver := func(uri string) ([]byte, error) {
+		if uri != "https://example.com/cert.der" {
+			return nil, errors.New("unknown URI " + uri)
+		}
+		return cert.Certificate[0], nil
+	}
+	if err := NewVerifier().(DetachedVerifier).VerifyDetached(external, resolver); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferenceNotFound(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := bytes.Replace(signed, []byte(`URI="#_d"`), []byte(`URI="#_missing"`), 1)
+	for _, err := range []error{NewVerifier().Verify(missing), NewVerifier().(DigestVerifier).VerifyDigests(missing)} {
+		if !errors.Is(err, ErrReferenceNotFound) || !strings.Contains(err.Error(), "_missing") {
+			t.Fatalf("expected ErrReferenceNotFound for _missing but got %v", err)
+		}
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_other"}})
+	if err := verifier.Verify(signed); !errors.Is(err, ErrReferenceNotFound) {
+		t.Fatalf("expected ErrReferenceNotFound for a required reference but got %v", err)
+	}
+}
+
+func TestSignatureMethodMismatch(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureAlgorithm: SigRSASHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := []byte(`Algorithm="` + SigRSASHA256 + `"`)
+	if !bytes.Contains(signed, declared) {
+		t.Fatalf("expected the signature to declare %s", SigRSASHA256)
+	}
+	for _, method := range []SignatureAlgorithm{SigECDSASHA256, SigHMACSHA256} {
+		tampered := bytes.Replace(signed, declared, []byte(`Algorithm="`+method+`"`), 1)
+		if err := NewVerifier().Verify(tampered); !errors.Is(err, ErrSignatureMethodMismatch) {
+			t.Fatalf("expected ErrSignatureMethodMismatch for %s with an RSA key but got %v", method, err)
+		}
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{HMACKey: []byte("secret")}).Verify(signed); !errors.Is(err, ErrSignatureMethodMismatch) {
+		t.Fatalf("expected ErrSignatureMethodMismatch for an RSA method with an HMAC key but got %v", err)
+	}
+
+	strict := NewVerifierWithOptions(VerifierOptions{AllowedSignatureMethods: []string{SigRSASHA512}})
+	if err := strict.Verify(signed); err != ErrDisallowedSignatureMethod {
+		t.Fatalf("expected ErrDisallowedSignatureMethod but got %v", err)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// SignedInfo is canonicalized with its CanonicalizationMethod and each
+// reference with its own transform, even when one is exclusive and the other
+// inclusive.
+func TestMixedCanonicalizations(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{CanonicalizationAlgorithm: CanonExclusive, DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the item only has the namespace of its parent in its inclusive form
+	inclusive := sha256.Sum256([]byte(`<item xmlns:x="urn:x" ID="_i">value</item>`))
+	exclusive := sha256.Sum256([]byte(`<item ID="_i">value</item>`))
+	if inclusive == exclusive {
+		t.Fatal("expected the canonical forms to differ")
+	}
+	reference := Reference{URI: "#_i", DigestValue: base64.StdEncoding.EncodeToString(inclusive[:])}
+	reference.Transforms.Transform = []Algorithm{{Algorithm: CanonInclusive}}
+	sig, err := CreateSignatureWithReferences(signer, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method := sig.SignedInfo.CanonicalizationMethod.Algorithm; method != CanonExclusive {
+		t.Fatalf("expected SignedInfo to use %s but got %s", CanonExclusive, method)
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`<root xmlns:x="urn:x"><item ID="_i">value</item>` + string(data) + `</root>`)
+	// SignedInfo would also get the namespace of the root if it were
+	// canonicalized inclusively, so the signature only verifies when each is
+	// canonicalized as it declares
+	if err := NewVerifier().Verify(doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyWithReferences(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	references, err := NewVerifier().(ReferenceVerifier).VerifyWithReferences(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := signature.SignedInfo.References()
+	if len(references) != len(declared) {
+		t.Fatalf("expected %d references but got %d", len(declared), len(references))
+	}
+	for i, reference := range references {
+		if reference.URI != "#_d" || reference.DigestMethod != DigestSHA256 || reference.DigestValue != declared[i].DigestValue {
+			t.Fatalf("expected reference %d to match the document but got %+v", i, reference)
+		}
+	}
+	tampered := bytes.Replace(signed, []byte("<item>1</item>"), []byte("<item>2</item>"), 1)
+	if references, err := NewVerifier().(ReferenceVerifier).VerifyWithReferences(tampered); !errors.Is(err, ErrDigestMismatch) || references != nil {
+		t.Fatalf("expected ErrDigestMismatch and no references but got %v", err)
+	}
+}
+
+// A producer that pretty-prints SignedInfo signs its canonical form, which
+// keeps the indentation but normalizes the line endings, so the verifier must
+// canonicalize SignedInfo as it is in the document.
+func TestIndentedSignedInfo(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSignerWithOptions(cert, SignerOptions{SignatureAlgorithm: SigRSASHA256, DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := indexDocument(signed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canon, _ := pickCanonicalization(CanonExclusive)
+	var canonical bytes.Buffer
+	if _, err := canon.write(&canonical, bytes.NewReader(signed), subset{index.find(xml.Name{Space: dsigNamespace, Local: "SignedInfo"}), -1}); err != nil {
+		t.Fatal(err)
+	}
+	indented, expected := string(signed), canonical.String()
+	for _, tag := range []string{"<CanonicalizationMethod", "<SignatureMethod", "<Reference", "<Transforms", "<DigestMethod", "<DigestValue", "</SignedInfo>"} {
+		indented = strings.Replace(indented, tag, "\r\n  "+tag, 1)
+		expected = strings.Replace(expected, tag, "\n  "+tag, 1)
+	}
+	// the indentation is signed, so the old SignatureValue no longer matches
+	if err := NewVerifier().Verify([]byte(indented)); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+	digest := sha256.Sum256([]byte(expected))
+	value, err := cert.PrivateKey.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indented = strings.Replace(indented, signature.SignatureValue, base64.StdEncoding.EncodeToString(value), 1)
+	if err := NewVerifier().Verify([]byte(indented)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommentInText(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<Response ID="_r"><User>user@example.com.evil.com</User></Response>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the comment is left out when canonicalizing, so the digest still matches
+	injected := bytes.Replace(signed, []byte("user@example.com.evil.com"), []byte("user@example.com<!---->.evil.com"), 1)
+	if err := NewVerifier().Verify(injected); err != nil {
+		t.Fatal(err)
+	}
+	// while an application reading the first text node sees another user
+	decoder := xml.NewDecoder(bytes.NewReader(injected))
+	var user string
+	for user == "" {
+		token, err := decoder.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "User" {
+			next, _ := decoder.Token()
+			user = string(next.(xml.CharData))
+		}
+	}
+	if user != "user@example.com" {
+		t.Fatalf("expected the first text node to be truncated but got %s", user)
+	}
+	strict := NewVerifierWithOptions(VerifierOptions{RejectCommentsInText: true})
+	if err := strict.Verify(injected); err != ErrCommentInText {
+		t.Fatalf("expected ErrCommentInText but got %v", err)
+	}
+	if err := strict.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// comments between elements don't split any text
+	between := bytes.Replace(signed, []byte("<User>"), []byte("<!-- user --><User>"), 1)
+	if err := strict.Verify(between); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMalformedDocument is wrapped by the error returned when a document to be
+// signed isn't well-formed XML, which also says what is wrong and where.
+var ErrMalformedDocument = errors.New("xmlsig document is not well-formed")
+
+// ErrEmptyDocument is returned for a document without an element, such as
+// empty input or only whitespace or comments, rather than signing or
+// canonicalizing nothing. It wraps ErrMalformedDocument.
+var ErrEmptyDocument = fmt.Errorf("%w: there is no document element", ErrMalformedDocument)
+
+// checkWellFormed scans the whole document so that signing fails with a clear
+// error rather than signing whatever could be read before the problem. Besides
+// the syntax the decoder checks, the end tags must match the start tags, there
+// must be exactly one document element with no text outside of it, attributes
+// must be unique and prefixes must be declared.
+func checkWellFormed(doc []byte, charsetReader func(string, io.Reader) (io.Reader, error)) error {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	decoder.CharsetReader = charsetReader
+	malformed := func(format string, args ...interface{}) error {
+		line, column := decoder.InputPos()
+		return fmt.Errorf("%w on line %d, column %d: %s", ErrMalformedDocument, line, column, fmt.Sprintf(format, args...))
+	}
+	namespaces := &stack{}
+	var open []xml.Name
+	roots := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedDocument, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(open) == 0 {
+				if roots++; roots > 1 {
+					return malformed("a second document element %s", qualifiedName(t.Name))
+				}
+			}
+			frame := &nsFrame{declared: make(map[string]string)}
+			seen := make(map[xml.Name]bool)
+			for _, att := range t.Attr {
+				if seen[att.Name] {
+					return malformed("the attribute %s appears more than once on %s", qualifiedName(att.Name), qualifiedName(t.Name))
+				}
+				seen[att.Name] = true
+				if isNamespaceDeclaration(att.Name) {
+					frame.declared[declaredPrefix(att.Name)] = att.Value
+				}
+			}
+			namespaces.Push(frame)
+			names := []xml.Name{t.Name}
+			for _, att := range t.Attr {
+				if !isNamespaceDeclaration(att.Name) {
+					names = append(names, att.Name)
+				}
+			}
+			for _, name := range names {
+				if name.Space == "" || name.Space == "xml" {
+					continue
+				}
+				if _, ok := lookupNamespace(namespaces, name.Space, false); !ok {
+					return malformed("the prefix of %s is not declared", qualifiedName(name))
+				}
+			}
+			open = append(open, t.Name)
+		case xml.EndElement:
+			if len(open) == 0 {
+				return malformed("the end tag %s has no start tag", qualifiedName(t.Name))
+			}
+			if start := open[len(open)-1]; start != t.Name {
+				return malformed("the end tag %s does not match the start tag %s", qualifiedName(t.Name), qualifiedName(start))
+			}
+			open = open[:len(open)-1]
+			namespaces.Pop()
+		case xml.CharData:
+			if len(open) == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return malformed("text outside of the document element")
+			}
+		}
+	}
+	if len(open) > 0 {
+		return malformed("the element %s is not closed", qualifiedName(open[len(open)-1]))
+	}
+	if roots == 0 {
+		return ErrEmptyDocument
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package xmlsig
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMalformedDocuments(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		doc     string
+		message string
+	}{
+		{"<a><b></a>", "line 1, column 11: the end tag a does not match the start tag b"},
+		{"<a>\n<b>", "line 2, column 4: the element b is not closed"},
+		{"<a></a><b/>", "a second document element b"},
+		{"", "there is no document element"},
+		{"text", "text outside of the document element"},
+		{"<a/>\ntext", "line 2, column 5: text outside of the document element"},
+		{`<a b="1" b="2"/>`, "the attribute b appears more than once on a"},
+		{`<a x:y="1"/>`, "the prefix of x:y is not declared"},
+		{`<x:a/>`, "the prefix of x:a is not declared"},
+		{"</a>", "the end tag a has no start tag"},
+		{"<a>&bogus;</a>", "invalid character entity &bogus;"},
+		{"<a><!-- unterminated </a>", "unexpected EOF"},
+	}
+	for _, test := range tests {
+		_, err := signer.(DocumentSigner).SignDocument([]byte(test.doc))
+		if !errors.Is(err, ErrMalformedDocument) || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("expected an error saying %q for %q but got %v", test.message, test.doc, err)
+		}
+	}
+	for _, doc := range []string{
+		`<?xml version="1.0"?>` + "\n<a xmlns:x=\"urn:x\" x:b=\"1\" b=\"2\"><x:c xml:lang=\"en\"/></a>\n<!-- after -->",
+		`<a xmlns:x="urn:x"><b xmlns:x="urn:other" x:c="1"/></a>`,
+	} {
+		if _, err := signer.(DocumentSigner).SignDocument([]byte(doc)); err != nil {
+			t.Errorf("expected %q to be signed but got %v", doc, err)
+		}
+	}
+}
+
+func TestEmptyDocuments(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{"", " \r\n\t ", "<!-- only a comment -->", `<?xml version="1.0"?>` + "\n"} {
+		if _, err := signer.(DocumentSigner).SignDocument([]byte(doc)); err != ErrEmptyDocument {
+			t.Errorf("expected ErrEmptyDocument signing %q but got %v", doc, err)
+		}
+		if _, err := Canonicalize([]byte(doc)); err != ErrEmptyDocument {
+			t.Errorf("expected ErrEmptyDocument canonicalizing %q but got %v", doc, err)
+		}
+		if _, err := MinifyForSigning([]byte(doc)); err != ErrEmptyDocument {
+			t.Errorf("expected ErrEmptyDocument minifying %q but got %v", doc, err)
+		}
+		var out strings.Builder
+		if err := CanonicalizeTo(&out, []byte(doc), ""); err != ErrEmptyDocument {
+			t.Errorf("expected ErrEmptyDocument canonicalizing %q but got %v", doc, err)
+		}
+	}
+	if _, err := signer.CreateSignature(nil); !errors.Is(err, ErrEmptyDocument) {
+		t.Errorf("expected ErrEmptyDocument signing nil but got %v", err)
+	}
+	if !errors.Is(ErrEmptyDocument, ErrMalformedDocument) {
+		t.Error("expected ErrEmptyDocument to be a malformed document")
+	}
+}
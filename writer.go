@@ -0,0 +1,43 @@
+package xmlsig
+
+import (
+	"bytes"
+	"errors"
+)
+
+// errNotDocumentSigner is returned when a Signer that is not a DocumentSigner
+// is asked to sign a document.
+var errNotDocumentSigner = errors.New("xmlsig signer can not sign documents")
+
+// SignWriter collects an XML document that is written to it incrementally,
+// such as generated content, and signs it once it is complete. The document is
+// buffered in memory until Finalize, as the enveloped Signature can only be
+// added once the whole document has been canonicalized, so a SignWriter saves
+// building a struct for the document but not holding its bytes.
+type SignWriter struct {
+	signer Signer
+	buffer bytes.Buffer
+}
+
+// NewSignWriter creates a SignWriter that signs with the signer.
+func NewSignWriter(signer Signer) *SignWriter {
+	return &SignWriter{signer: signer}
+}
+
+// Write is part of io.Writer.
+func (w *SignWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+// Finalize canonicalizes the document written so far and returns it with an
+// enveloped Signature, as DocumentSigner.SignDocument does, failing if the
+// signer is not a DocumentSigner. The SignWriter is reset so it may be used for
+// another document.
+func (w *SignWriter) Finalize() ([]byte, error) {
+	defer w.buffer.Reset()
+	signer, ok := w.signer.(DocumentSigner)
+	if !ok {
+		return nil, errNotDocumentSigner
+	}
+	return signer.SignDocument(w.buffer.Bytes())
+}
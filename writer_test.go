@@ -0,0 +1,60 @@
+package xmlsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"testing"
+)
+
+func TestSignWriter(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewSignWriter(signer)
+	fmt.Fprint(writer, `<?xml version="1.0"?><items xmlns="urn:items" ID="_items">`)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(writer, `<item n="%d">value %d</item>`, i, i)
+	}
+	fmt.Fprint(writer, `</items>`)
+	signed, err := writer.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := struct {
+		Signature *Signature
+	}{}
+	if err := xml.Unmarshal(signed, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Signature == nil {
+		t.Fatalf("expected a signature in %s", signed)
+	}
+	if doc.Signature.SignedInfo.Reference.URI != "#_items" {
+		t.Fatalf("expected reference to #_items but got %s", doc.Signature.SignedInfo.Reference.URI)
+	}
+	start := bytes.Index(signed, []byte("<Signature"))
+	end := bytes.Index(signed, []byte("</Signature>")) + len("</Signature>")
+	content := append(append([]byte{}, signed[:start]...), signed[end:]...)
+	expected := `<items xmlns="urn:items" ID="_items"><item n="0">value 0</item><item n="1">value 1</item><item n="2">value 2</item></items>`
+	if string(content) != expected {
+		t.Fatalf("expected content of %s but got %s", expected, content)
+	}
+	checkSignature(t, cert, content, doc.Signature)
+}
+
+func TestSignWriterNeedsDocumentSigner(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Embedding the interface hides the optional methods of the signer.
+	writer := NewSignWriter(struct{ Signer }{signer})
+	fmt.Fprint(writer, `<items ID="_items"/>`)
+	if _, err := writer.Finalize(); err != errNotDocumentSigner {
+		t.Fatalf("expected %v but got %v", errNotDocumentSigner, err)
+	}
+}
@@ -2,19 +2,30 @@
 package xmlsig
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
 
 	// import supported crypto hash function
 	_ "crypto/sha1"
 	_ "crypto/sha256"
+	_ "crypto/sha3"
+	_ "crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"time"
 )
 
-// Signer is used to create a Signature for the provided object.
+// Signer is used to create a Signature for the provided object. A Signer is
+// safe for concurrent use, as long as the Logger and CanonicalizeHook of its
+// options are.
 type Signer interface {
 	Sign([]byte) (string, error)
 	CreateSignature(interface{}) (*Signature, error)
@@ -23,13 +34,88 @@ type Signer interface {
 	CreateBinarySecurityToken() *BinarySecurityToken
 }
 
+// DocumentSigner is implemented by the Signers of this package to sign an XML
+// document, returning it with an enveloped Signature.
+type DocumentSigner interface {
+	SignDocument(doc []byte) ([]byte, error)
+}
+
+// FieldSigner is implemented by the Signers of this package to sign a field of
+// a struct, rather than the whole struct, such as the Assertion of a Response.
+type FieldSigner interface {
+	CreateSignatureForField(data interface{}, fieldName string) (*Signature, error)
+}
+
+// CounterSigner is implemented by the Signers of this package to add a
+// counter-signature over the SignatureValue of a signed document.
+type CounterSigner interface {
+	CounterSign(doc []byte) ([]byte, error)
+}
+
+// StandaloneSignatureSigner is implemented by the Signers of this package to
+// return the Signature element of a signed document on its own as well.
+type StandaloneSignatureSigner interface {
+	SignDocumentWithSignature(doc []byte) (document, signature []byte, err error)
+}
+
+// IDSigner is implemented by the Signers of this package to sign the element
+// with an ID nested anywhere in a struct.
+type IDSigner interface {
+	CreateSignatureForID(data interface{}, id string) (*Signature, error)
+}
+
+// OptionsSigner is implemented by the Signers of this package to derive a
+// Signer with other options that shares the same key.
+type OptionsSigner interface {
+	WithOptions(options SignerOptions) (Signer, error)
+}
+
+// EnvelopingSigner is implemented by the Signers of this package to sign
+// binary content enveloped in an Object of the Signature.
+type EnvelopingSigner interface {
+	CreateEnvelopingSignature(data []byte, objectID string) (*Signature, error)
+}
+
 type signer struct {
-	cert      string
-	sigAlg    *algorithm
-	digestAlg *algorithm
-	key       crypto.Signer
-	options   SignerOptions
-	X509cert  *x509.Certificate
+	cert       string
+	chain      []string
+	sigAlg     *algorithm
+	digestAlg  *algorithm
+	canon      *canonicalization
+	refCanon   *canonicalization
+	key        crypto.Signer
+	hmacKey    []byte
+	ski        string
+	x509Digest *X509Digest
+	// keyIdentifier is the KeyIdentifier of the certificate, when the
+	// KeyInfo identifies it by one
+	keyIdentifier *KeyIdentifier
+	options       SignerOptions
+	X509cert      *x509.Certificate
+}
+
+// Logger receives events from the stages of signing and verification, each
+// with alternating keys and values, to trace how a document is processed.
+type Logger func(event string, keyvals ...interface{})
+
+// log sends the event to the logger when there is one.
+func (logger Logger) log(event string, keyvals ...interface{}) {
+	if logger != nil {
+		logger(event, keyvals...)
+	}
+}
+
+// ErrPanic is wrapped by the error returned when processing a document panics,
+// so that unexpected input can't crash the caller.
+var ErrPanic = errors.New("xmlsig recovered from a panic")
+
+// recoverPanic turns a panic into an error wrapping ErrPanic. It must be
+// deferred by the exported functions that process documents.
+func recoverPanic(err *error, logger Logger) {
+	if r := recover(); r != nil {
+		logger.log("panic recovered", "panic", r)
+		*err = fmt.Errorf("%w: %v", ErrPanic, r)
+	}
 }
 
 type algorithm struct {
@@ -37,55 +123,156 @@ type algorithm struct {
 	hash crypto.Hash
 }
 
+// SignerOptions configures a Signer. The SignatureAlgorithm used for the
+// SignedInfo and the DigestAlgorithm used for the reference are independent,
+// so, for example, SHA-256 digests may be combined with an RSA-SHA512 signature.
 type SignerOptions struct {
 	SignatureAlgorithm string
 	DigestAlgorithm    string
 	EmbedIssuerSerial  bool
+	// CanonicalizationAlgorithm is used for the SignedInfo and as the
+	// canonicalization transform of the reference. Exclusive XML
+	// Canonicalization is used by default, because unlike the inclusive
+	// algorithms its output doesn't depend on namespaces declared by the
+	// elements a signed struct is later embedded in.
+	CanonicalizationAlgorithm string
+	// InclusiveNamespaces lists namespace prefixes, or #default for the default
+	// namespace, to include in the InclusiveNamespaces PrefixList of the
+	// reference's exclusive canonicalization transform. They are declared on the
+	// signed element whether or not it uses them.
+	InclusiveNamespaces []string
+	// SignedInfoInclusiveNamespaces is the InclusiveNamespaces PrefixList of the
+	// SignedInfo CanonicalizationMethod, which must be exclusive. SignDocument
+	// and CounterSign render the namespaces in scope where the Signature is
+	// added. CreateSignature can't know where the Signature will be embedded,
+	// so only the namespaces it declares itself are in scope.
+	SignedInfoInclusiveNamespaces []string
+	// SignaturePrefix, when set, is the prefix SignDocument uses for the XML
+	// Signature namespace instead of declaring it as the default namespace of
+	// the Signature. If the document binds the prefix to another namespace, the
+	// first of prefix1, prefix2 and so on that it doesn't bind is used instead.
+	SignaturePrefix string
+	// ApexPrefix, when set, is the prefix the signed element is rendered with
+	// for its namespace, which is declared on it, or #default to render it in
+	// the default namespace instead. Only the signed element is affected, so
+	// with #default its unprefixed descendants declare the default namespace
+	// they were in.
+	// SignDocument returns the document rendered this way. With CreateSignature
+	// the element has to be written as in the CanonicalizedInput of the
+	// Signature for the signature to verify.
+	ApexPrefix string
+	// ReferenceType, when set, is the Type attribute of the reference to the
+	// signed element, such as http://www.w3.org/2000/09/xmldsig#Object, for
+	// profiles that require one. It is part of SignedInfo so it is signed.
+	// CreateSignatureWithReferences takes the Type of each reference instead.
+	ReferenceType string
+	// BinarySecurityTokenID, when set, makes the KeyInfo contain a WS-Security
+	// SecurityTokenReference to the BinarySecurityToken with this ID instead of
+	// X509Data. The token is created with CreateBinarySecurityToken and placed in
+	// the SOAP Security header by the caller.
+	BinarySecurityTokenID string
+	// KeyIdentifier, when set, makes the KeyInfo contain a WS-Security
+	// SecurityTokenReference with a KeyIdentifier of this ValueType, either
+	// KeyIdentifierSKI or KeyIdentifierThumbprint, instead of X509Data, for
+	// verifiers that already have the certificate. A missing
+	// SubjectKeyIdentifier is computed when ComputeSubjectKeyIdentifier is set.
+	KeyIdentifier string
+	// KeyName, when set, is emitted as the KeyName in the KeyInfo so that the
+	// verifier can look up the key by name.
+	KeyName string
+	// CharsetReader, when set, converts documents passed to SignDocument that
+	// declare an encoding other than UTF-8 to UTF-8, as with
+	// xml.Decoder.CharsetReader. The signed document is returned canonicalized,
+	// which is always UTF-8.
+	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+	// OmitKeyInfo leaves the KeyInfo out of signatures, for verifiers that
+	// already know the key. EmptyKeyInfo instead emits an empty KeyInfo
+	// element, as some schemas require one. By default the KeyInfo has the
+	// certificate.
+	OmitKeyInfo  bool
+	EmptyKeyInfo bool
+	// SubjectKeyIdentifier adds the certificate's SubjectKeyIdentifier to the
+	// X509Data as X509SKI, for verifiers that locate the key by it. Creating the
+	// signer fails when the certificate doesn't have the extension unless
+	// ComputeSubjectKeyIdentifier is set, which computes it from the public key
+	// using method 1 of RFC 5280 instead.
+	SubjectKeyIdentifier        bool
+	ComputeSubjectKeyIdentifier bool
+	// X509DigestAlgorithm, when set, is the digest algorithm of an XML
+	// Signature 1.1 X509Digest of the certificate added to the X509Data, for
+	// verifiers that identify the certificate by its digest.
+	X509DigestAlgorithm string
+	// SeparateX509Data puts each certificate of the chain in an X509Data of its
+	// own, after the one for the signing certificate, rather than all of them
+	// in a single X509Data.
+	SeparateX509Data bool
+	// DeterministicSignatures makes ECDSA signatures use the nonces of RFC
+	// 6979, so that signing the same SignedInfo twice gives the same
+	// SignatureValue. The key must be an *ecdsa.PrivateKey on one of the NIST
+	// curves, so a key kept elsewhere, such as in an HSM, is rejected.
+	DeterministicSignatures bool
+	// ExpectedSize, when set, is the expected size in bytes of the canonical
+	// form of what is signed. The buffers for it are allocated with this size
+	// so that signing large documents of a known size doesn't repeatedly grow
+	// them.
+	ExpectedSize int
+	// VerifyAfterSign checks each new signature with a Verifier before returning
+	// it, so canonicalization problems surface when signing rather than when a
+	// partner rejects the document.
+	VerifyAfterSign bool
+	// SignatureID sets the Id of the Signature, and of its SignatureValue with a
+	// -SignatureValue suffix so that the signature can be counter-signed.
+	SignatureID string
+	// SigningTime adds the time of signing to each signature as a
+	// SignatureProperty, which is referenced so that it is signed too. The
+	// time is a Dublin Core date in UTC. It needs SignatureID to be set, as the
+	// property targets the Signature by its Id.
+	SigningTime bool
+	// Clock returns the signing time. It defaults to time.Now.
+	Clock func() time.Time
+	// IDAttributes, when set, are the only attributes whose value is used as the
+	// ID in the reference URI, as with VerifierOptions.IDAttributes.
+	IDAttributes []xml.Name
+	// CanonicalizeHook, when set, runs on the canonical bytes of the reference
+	// before they are digested and of SignedInfo before it is signed.
+	CanonicalizeHook CanonicalizeHook
+	// Canonicalizer, when set, replaces the package's canonicalization of what
+	// the references cover. The verifier must be given the same Canonicalizer.
+	Canonicalizer Canonicalizer
+	// Logger, when set, is told when the reference has been canonicalized and
+	// digested and when the signature has been computed.
+	Logger Logger
+	// WrapBase64 breaks the base64 text of the SignatureValue and X509Certificate
+	// into lines of 76 characters separated by a line feed. By default values are
+	// emitted on a single line without any whitespace.
+	WrapBase64 bool
+	// Indent, when set, pretty-prints the documents SignDocument and CounterSign
+	// return, putting each child element on its own line indented by Indent
+	// per level. Only the parts no reference covers are indented, such as the
+	// KeyInfo, so the signature stays valid.
+	Indent string
+	// XMLDeclaration starts the documents SignDocument and CounterSign return
+	// with <?xml version="1.0" encoding="UTF-8"?> unless they already have an
+	// XML declaration. The declaration is never part of what is signed.
+	XMLDeclaration bool
 }
 
 func pickSignatureAlgorithm(certType x509.PublicKeyAlgorithm, alg string) (*algorithm, error) {
-	var hash crypto.Hash
-	switch certType {
-	case x509.RSA:
-		switch alg {
-		case "":
-			alg = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
-			hash = crypto.SHA1
-		case "http://www.w3.org/2000/09/xmldsig#rsa-sha1":
-			hash = crypto.SHA1
-		case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":
-			hash = crypto.SHA256
-		default:
-			return nil, errors.New("xmlsig does not currently the specfied algorithm for RSA certificates")
-		}
-	case x509.DSA:
-		switch alg {
-		case "":
-			alg = "http://www.w3.org/2000/09/xmldsig#dsa-sha1"
-			hash = crypto.SHA1
-		case "http://www.w3.org/2000/09/xmldsig#dsa-sha1":
-			hash = crypto.SHA1
-		case "http://www.w3.org/2009/xmldsig11#dsa-sha256":
-			hash = crypto.SHA256
-		default:
-			return nil, errors.New("xmlsig does not currently the specfied algorithm for DSA certificates")
-		}
-	case x509.ECDSA:
-		return nil, errors.New("xmlsig does not currently support ECDSA certificates")
-	default:
+	method, known := lookupSignatureMethod(certType, alg)
+	if certType == hmacKey || !known {
 		return nil, errors.New("xmlsig needs some work to support your certificate")
 	}
-	return &algorithm{alg, hash}, nil
+	if method == nil {
+		return nil, fmt.Errorf("xmlsig does not currently the specfied algorithm for %s certificates", certType)
+	}
+	return method, nil
 }
 
 func pickDigestAlgorithm(alg string) (*algorithm, error) {
-	switch alg {
-	case "":
-		fallthrough
-	case "http://www.w3.org/2000/09/xmldsig#sha1":
-		return &algorithm{"http://www.w3.org/2000/09/xmldsig#sha1", crypto.SHA1}, nil
-	case "http://www.w3.org/2001/04/xmlenc#sha256":
-		return &algorithm{"http://www.w3.org/2001/04/xmlenc#sha256", crypto.SHA256}, nil
+	for _, method := range digestMethods {
+		if alg == "" || alg == method.uri {
+			return &algorithm{method.uri, method.hash}, nil
+		}
 	}
 	return nil, errors.New("xmlsig does not support the specified digest algorithm")
 }
@@ -97,67 +284,766 @@ func NewSigner(cert tls.Certificate) (Signer, error) {
 
 // NewSignerWithOptions creates a new Signer with the certificate and options
 func NewSignerWithOptions(cert tls.Certificate, options SignerOptions) (Signer, error) {
-	c := cert.Certificate[0]
-	parsedCert, err := x509.ParseCertificate(c)
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("xmlsig needs a certificate to sign with")
+	}
+	parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	k, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("xmlsig needs a private key that implements crypto.Signer")
+	}
+	return newSigner(parsedCert, nil, k, options)
+}
+
+// ErrNoLeafCertificate is returned by NewSignerWithChain when none of the
+// certificates matches the private key.
+var ErrNoLeafCertificate = errors.New("xmlsig could not find a certificate matching the private key")
+
+// NewSignerWithChain creates a new Signer from an unordered certificate chain,
+// which may include the root, and the private key of one of its certificates.
+// The certificate matching the key is used as the signing certificate and the
+// chain is included in the X509Data ordered from the leaf to the root.
+func NewSignerWithChain(chain []*x509.Certificate, key crypto.Signer, options SignerOptions) (Signer, error) {
+	if key == nil {
+		return nil, errors.New("xmlsig needs a private key to sign with")
+	}
+	leaf, rest, err := orderChain(chain, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return newSigner(leaf, rest, key, options)
+}
+
+// WithOptions returns a Signer that shares the key and certificates of this
+// one but signs with the options instead, so that variations of a signer don't
+// need the key to be loaded again.
+func (s *signer) WithOptions(options SignerOptions) (Signer, error) {
+	if s.hmacKey != nil {
+		return NewHMACSigner(s.hmacKey, options)
+	}
+	derived, err := newSigner(s.X509cert, nil, s.key, options)
+	if err != nil {
+		return nil, err
+	}
+	derived.(*signer).chain = s.chain
+	return derived, nil
+}
+
+func newSigner(cert *x509.Certificate, chain []*x509.Certificate, key crypto.Signer, options SignerOptions) (Signer, error) {
+	sigAlg, err := pickSignatureAlgorithm(cert.PublicKeyAlgorithm, options.SignatureAlgorithm)
 	if err != nil {
 		return nil, err
 	}
-	sigAlg, err := pickSignatureAlgorithm(parsedCert.PublicKeyAlgorithm, options.SignatureAlgorithm)
+	if _, ok := key.(*ecdsa.PrivateKey); options.DeterministicSignatures && !ok {
+		return nil, errors.New("xmlsig needs an *ecdsa.PrivateKey for deterministic signatures")
+	}
+	s, err := configureSigner(sigAlg, options)
 	if err != nil {
 		return nil, err
 	}
+	if options.SubjectKeyIdentifier {
+		ski, err := subjectKeyIdentifier(cert, options.ComputeSubjectKeyIdentifier)
+		if err != nil {
+			return nil, err
+		}
+		s.ski = base64.StdEncoding.EncodeToString(ski)
+	}
+	if options.KeyIdentifier != "" {
+		if options.BinarySecurityTokenID != "" {
+			return nil, errors.New("xmlsig can not reference both a BinarySecurityToken and a KeyIdentifier")
+		}
+		value, err := keyIdentifier(cert, options.KeyIdentifier, options.ComputeSubjectKeyIdentifier)
+		if err != nil {
+			return nil, err
+		}
+		s.keyIdentifier = &KeyIdentifier{
+			ValueType:    options.KeyIdentifier,
+			EncodingType: encodingType,
+			Value:        base64.StdEncoding.EncodeToString(value),
+		}
+	}
+	if options.X509DigestAlgorithm != "" {
+		alg, err := pickDigestAlgorithm(options.X509DigestAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		h := alg.hash.New()
+		h.Write(cert.Raw)
+		s.x509Digest = &X509Digest{Algorithm: alg.name, Value: base64.StdEncoding.EncodeToString(h.Sum(nil))}
+	}
+	s.cert = base64.StdEncoding.EncodeToString(cert.Raw)
+	s.key = key
+	s.X509cert = cert
+	for _, c := range chain {
+		s.chain = append(s.chain, base64.StdEncoding.EncodeToString(c.Raw))
+	}
+	return s, nil
+}
+
+// configureSigner creates a signer using the signature algorithm, with the
+// rest of its algorithms picked from the options.
+func configureSigner(sigAlg *algorithm, options SignerOptions) (*signer, error) {
 	digestAlg, err := pickDigestAlgorithm(options.DigestAlgorithm)
 	if err != nil {
 		return nil, err
 	}
-	k := cert.PrivateKey.(crypto.Signer)
-	return &signer{base64.StdEncoding.EncodeToString(c), sigAlg, digestAlg, k, options, parsedCert}, nil
+	canon, err := pickCanonicalization(options.CanonicalizationAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	refCanon := canon.withoutComments()
+	if len(options.InclusiveNamespaces) > 0 {
+		refCanon, err = refCanon.withPrefixList(strings.Join(options.InclusiveNamespaces, " "))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.IDAttributes) > 0 {
+		refCanon = refCanon.withIDAttributes(options.IDAttributes)
+	}
+	if options.CharsetReader != nil {
+		refCanon = refCanon.withCharsetReader(options.CharsetReader)
+	}
+	if refCanon, err = refCanon.withApexPrefix(options.ApexPrefix); err != nil {
+		return nil, err
+	}
+	if options.ExpectedSize > 0 {
+		refCanon = refCanon.withSizeHint(options.ExpectedSize)
+	}
+	if prefix := options.SignaturePrefix; strings.HasPrefix(strings.ToLower(prefix), "xml") || strings.Contains(prefix, ":") {
+		return nil, fmt.Errorf("xmlsig can not use %s as the signature prefix", prefix)
+	}
+	if options.SigningTime && options.SignatureID == "" {
+		return nil, errors.New("xmlsig needs a SignatureID to add the signing time")
+	}
+	if options.OmitKeyInfo && options.EmptyKeyInfo {
+		return nil, errors.New("xmlsig can not both omit the KeyInfo and emit it empty")
+	}
+	if len(options.SignedInfoInclusiveNamespaces) > 0 {
+		canon, err = canon.withPrefixList(strings.Join(options.SignedInfoInclusiveNamespaces, " "))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &signer{
+		sigAlg:    sigAlg,
+		digestAlg: digestAlg,
+		canon:     canon,
+		refCanon:  refCanon,
+		options:   options,
+	}, nil
+}
+
+// orderChain finds the certificate for the public key and returns it along
+// with the rest of the chain ordered from its issuer up to the root. Any
+// certificates that aren't part of the path follow in their original order.
+func orderChain(chain []*x509.Certificate, public crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	key, ok := public.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, nil, errors.New("xmlsig does not support the type of private key")
+	}
+	var leaf *x509.Certificate
+	remaining := make([]*x509.Certificate, 0, len(chain))
+	for _, c := range chain {
+		if leaf == nil && key.Equal(c.PublicKey) {
+			leaf = c
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	if leaf == nil {
+		return nil, nil, ErrNoLeafCertificate
+	}
+	var ordered []*x509.Certificate
+	for current := leaf; !bytes.Equal(current.RawIssuer, current.RawSubject); {
+		next := -1
+		for i, c := range remaining {
+			if bytes.Equal(c.RawSubject, current.RawIssuer) && current.CheckSignatureFrom(c) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		current = remaining[next]
+		ordered = append(ordered, current)
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return leaf, append(ordered, remaining...), nil
 }
 
 func (s *signer) Algorithm() string {
 	return s.sigAlg.name
 }
 
-func (s *signer) CreateSignature(data interface{}) (*Signature, error) {
-	signature := newSignature()
-	signature.SignedInfo.SignatureMethod.Algorithm = s.sigAlg.name
-	signature.SignedInfo.Reference.DigestMethod.Algorithm = s.digestAlg.name
+func (s *signer) CreateSignature(data interface{}) (_ *Signature, err error) {
+	defer recoverPanic(&err, s.options.Logger)
 	// canonicalize the Item
-	canonData, id, err := canonicalize(data)
+	var canonData bytes.Buffer
+	digest, id, err := s.digestValue(&canonData, data)
 	if err != nil {
 		return nil, err
 	}
+	return s.createEnvelopedSignature(canonData.Bytes(), digest, id, placement{})
+}
+
+// CreateSignatureForField creates a Signature for the named field of data
+// rather than for data as a whole.
+func (s *signer) CreateSignatureForField(data interface{}, fieldName string) (_ *Signature, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	field, start, err := structField(data, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	var canonData bytes.Buffer
+	digest, id, err := s.digestValue(&canonData, fieldElement{field, start})
+	if err != nil {
+		return nil, err
+	}
+	return s.createEnvelopedSignature(canonData.Bytes(), digest, id, placement{})
+}
+
+// CreateSignatureForID creates a Signature for the element of data with the
+// ID, however deeply it is nested, such as a wrapper around the elements to
+// sign. The element is digested along with all of its descendants as it is
+// within data marshalled as XML.
+func (s *signer) CreateSignatureForID(data interface{}, id string) (_ *Signature, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	doc, err := xml.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	index, err := indexDocument(doc, s.options.IDAttributes)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := index.lookupID(id)
+	if err != nil {
+		return nil, err
+	}
+	var canonData bytes.Buffer
+	digest, _, err := s.digestNodes(&canonData, doc, index, subset{pos, -1})
+	if err != nil {
+		return nil, err
+	}
+	return s.createEnvelopedSignature(canonData.Bytes(), digest, id, placement{})
+}
+
+// CreateEnvelopingSignature signs binary content by enveloping it, base64
+// encoded, in an Object with the ID within the Signature. The reference to the
+// Object has the base64 transform, so the digest is of the content itself.
+func (s *signer) CreateEnvelopingSignature(data []byte, objectID string) (_ *Signature, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	if objectID == "" {
+		return nil, errors.New("xmlsig needs an ID for the Object to reference")
+	}
+	signature := s.newSignature()
+	signature.Object = append(signature.Object, Object{
+		ID:       objectID,
+		Encoding: base64Transform,
+		Data:     s.wrap(base64.StdEncoding.EncodeToString(data)),
+	})
+	// with the base64 transform the content is digested without canonicalization
+	digest := s.digest(data)
+	s.options.Logger.log("digest computed", "algorithm", s.digestAlg.name, "length", len(digest))
+	reference := Reference{URI: "#" + objectID, DigestValue: digest}
+	reference.Transforms.Transform = []Algorithm{{Algorithm: base64Transform}}
+	reference.DigestMethod.Algorithm = s.digestAlg.name
+	signature.SignedInfo.Reference = reference
+	if s.options.SigningTime {
+		if err := s.addSigningTime(signature, placement{}); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.sign(signature, placement{}); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// SignDocument canonicalizes the XML document and returns it with an enveloped
+// Signature added as the last child of the document element. The reference
+// targets the ID of the document element, or the whole document if it has none.
+// A document that isn't well-formed fails with an error wrapping
+// ErrMalformedDocument.
+func (s *signer) SignDocument(doc []byte) (_ []byte, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	signed, _, err := s.signDocument(doc)
+	return signed, err
+}
+
+// SignDocumentWithSignature signs the document as SignDocument does and also
+// returns the Signature element on its own, such as for storing it. The
+// Signature is in its exclusive canonical form, so it declares the namespaces
+// it uses and can be parsed with ParseSignature.
+func (s *signer) SignDocumentWithSignature(doc []byte) (_, _ []byte, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	signed, data, err := s.signDocument(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	canon, _ := pickCanonicalization(CanonExclusive)
+	var signature bytes.Buffer
+	if _, err := canon.write(&signature, bytes.NewReader(data), wholeDocument); err != nil {
+		return nil, nil, err
+	}
+	return signed, signature.Bytes(), nil
+}
+
+// signDocument returns the signed document along with the Signature element
+// as it was added to it.
+func (s *signer) signDocument(doc []byte) (_, _ []byte, err error) {
+	if err := checkWellFormed(doc, s.options.CharsetReader); err != nil {
+		return nil, nil, err
+	}
+	var canonData bytes.Buffer
+	canonData.Grow(s.refCanon.sizeHint)
+	digest, id, err := s.digestNodes(&canonData, doc, nil, wholeDocument)
+	if err != nil {
+		return nil, nil, err
+	}
+	scope, err := namespacesInScope(canonData.Bytes(), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	place := placement{scope: scope}
+	if s.options.SignaturePrefix != "" {
+		if place.prefix, err = signaturePrefix(canonData.Bytes(), s.options.SignaturePrefix); err != nil {
+			return nil, nil, err
+		}
+	}
+	signature, err := s.createEnvelopedSignature(canonData.Bytes(), digest, id, place)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := marshalSignature(signature, place.prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := insertElement(canonData.Bytes(), 0, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if signed, err = s.output(signed); err != nil {
+		return nil, nil, err
+	}
+	return signed, data, nil
+}
+
+// output applies the options for how a signed document is written, which
+// don't change what is signed.
+func (s *signer) output(signed []byte) ([]byte, error) {
+	if s.options.Indent != "" {
+		var err error
+		if signed, err = indentUnsigned(signed, s.options.Indent, s.options.IDAttributes); err != nil {
+			return nil, err
+		}
+	}
+	if s.options.XMLDeclaration && !hasXMLDeclaration(signed) {
+		signed = append([]byte(xml.Header), signed...)
+	}
+	return signed, nil
+}
+
+// hasXMLDeclaration reports whether the document starts with an XML declaration.
+func hasXMLDeclaration(doc []byte) bool {
+	return len(doc) > len("<?xml ") && bytes.HasPrefix(doc, []byte("<?xml")) && strings.ContainsRune(" \t\r\n", rune(doc[5]))
+}
+
+// placement describes where a new Signature is added to a document.
+type placement struct {
+	// scope maps the prefixes of the namespaces in scope where the Signature
+	// is added to their namespaces, or is nil when they aren't known.
+	scope map[string]string
+	// prefix is used for the XML Signature namespace, or is empty to declare
+	// it as the default namespace.
+	prefix string
+}
+
+// signaturePrefix returns prefix, or the first of prefix1, prefix2 and so on,
+// that the document doesn't bind to a namespace other than XML Signature.
+func signaturePrefix(doc []byte, prefix string) (string, error) {
+	bound := make(map[string]bool)
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			for _, att := range start.Attr {
+				if att.Name.Space == "xmlns" && att.Value != dsigNamespace {
+					bound[att.Name.Local] = true
+				}
+			}
+		}
+	}
+	candidate := prefix
+	for i := 1; bound[candidate]; i++ {
+		candidate = fmt.Sprintf("%s%d", prefix, i)
+	}
+	return candidate, nil
+}
+
+// marshalSignature marshals a Signature, or one of its elements, writing the
+// elements in the XML Signature namespace with the prefix when there is one.
+func marshalSignature(v interface{}, prefix string) ([]byte, error) {
+	data, err := xml.Marshal(v)
+	if err != nil || prefix == "" {
+		return data, err
+	}
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	defaults := []string{""}
+	var names []xml.Name
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			space := defaults[len(defaults)-1]
+			var attrs []xml.Attr
+			if len(names) == 0 {
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: dsigNamespace})
+			}
+			for _, att := range t.Attr {
+				if att.Name.Space == "" && att.Name.Local == "xmlns" {
+					space = att.Value
+					if space == dsigNamespace {
+						continue
+					}
+				}
+				attrs = append(attrs, att)
+			}
+			name := t.Name
+			if name.Space == "" && space == dsigNamespace {
+				name.Space = prefix
+			}
+			defaults = append(defaults, space)
+			names = append(names, name)
+			fmt.Fprintf(&out, "<%s", qualifiedName(name))
+			for _, att := range attrs {
+				fmt.Fprintf(&out, " %s=\"", qualifiedName(att.Name))
+				attrEscaper.WriteString(&out, att.Value)
+				out.WriteString("\"")
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			fmt.Fprintf(&out, "</%s>", qualifiedName(names[len(names)-1]))
+			defaults = defaults[:len(defaults)-1]
+			names = names[:len(names)-1]
+		case xml.CharData:
+			textEscaper.WriteString(&out, string(t))
+		}
+	}
+}
+
+// CounterSign adds a counter-signature of the outermost Signature in the document.
+// It references the SignatureValue by its Id, so the signature must have been
+// created with the SignatureID option, and is placed in an Object of that
+// Signature, where the enveloped signature transform excludes it.
+func (s *signer) CounterSign(doc []byte) (_ []byte, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	if err := checkWellFormed(doc, nil); err != nil {
+		return nil, err
+	}
+	index, sigPos, signature, err := findSignature(doc, s.options.IDAttributes)
+	if err != nil {
+		return nil, err
+	}
+	id := signature.SignatureValueID
+	if id == "" {
+		return nil, errors.New("xmlsig signature value needs an Id to be counter-signed")
+	}
+	pos, err := index.lookupID(id)
+	if err != nil {
+		return nil, err
+	}
+	// the counter-signature isn't returned, so its canonical form isn't kept
+	digest, _, err := s.digestNodes(nil, doc, index, subset{pos, -1})
+	if err != nil {
+		return nil, err
+	}
+	reference := Reference{URI: "#" + id, DigestValue: digest}
+	reference.Transforms.Transform = []Algorithm{s.refCanon.transform()}
+	scope, err := namespacesInScope(doc, sigPos)
+	if err != nil {
+		return nil, err
+	}
+	// The Object containing the counter-signature declares the default namespace
+	scope[""] = dsigNamespace
+	counter, err := s.createSignature(nil, reference, placement{scope: scope})
+	if err != nil {
+		return nil, err
+	}
+	object, err := xml.Marshal(&Object{Signature: []Signature{*counter}})
+	if err != nil {
+		return nil, err
+	}
+	signed, err := insertElement(doc, sigPos, object)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.VerifyAfterSign {
+		if err := s.verify(signed); err != nil {
+			return nil, err
+		}
+	}
+	return s.output(signed)
+}
+
+// insertSignature adds the signature before the end tag of the document
+// element, using the prefix for the XML Signature namespace if there is one.
+func insertSignature(doc []byte, signature *Signature, prefix string) ([]byte, error) {
+	data, err := marshalSignature(signature, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return insertElement(doc, 0, data)
+}
+
+// insertElement adds the XML data before the end tag of the element at the
+// position in document order.
+func insertElement(doc []byte, position int, data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	parents := &stack{}
+	for i := 0; ; {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err != nil {
+			return nil, err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			parents.Push(i)
+			i++
+		case xml.EndElement:
+			if top, _ := parents.Pop(); top == position {
+				inserted := make([]byte, 0, len(doc)+len(data))
+				inserted = append(inserted, doc[:offset]...)
+				inserted = append(inserted, data...)
+				return append(inserted, doc[offset:]...), nil
+			}
+		}
+	}
+}
+
+// createEnvelopedSignature creates a signature of the canonical data, which has
+// the digest, with an enveloped signature transform that references the data's
+// ID.
+func (s *signer) createEnvelopedSignature(canonData []byte, digest, id string, place placement) (*Signature, error) {
+	reference := newReference(s.refCanon)
+	reference.Type = s.options.ReferenceType
+	reference.DigestValue = digest
 	if id != "" {
-		signature.SignedInfo.Reference.URI = "#" + id
+		reference.URI = "#" + id
+	}
+	signature, err := s.createSignature(canonData, reference, place)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.VerifyAfterSign {
+		if err := s.verifyAfterSign(signature, place.prefix); err != nil {
+			return nil, err
+		}
 	}
+	return signature, nil
+}
+
+// createSignature creates a signature of the canonical data with the reference,
+// whose DigestValue has been computed already. The SignedInfo is canonicalized
+// as it will be written where the Signature is placed, including the namespaces
+// in scope there when they are known.
+func (s *signer) createSignature(canonData []byte, reference Reference, place placement) (*Signature, error) {
+	signature := s.newSignature()
+	reference.DigestMethod.Algorithm = s.digestAlg.name
 
 	// store the canonicalized data
 	signature.CanonicalizedInput = string(canonData)
+	signature.SignedInfo.Reference = reference
+	if s.options.SigningTime {
+		if err := s.addSigningTime(signature, place); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.sign(signature, place); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
 
-	// calculate the digest
-	digest := s.digest(canonData)
-	signature.SignedInfo.Reference.DigestValue = digest
+const dublinCoreNamespace = "http://purl.org/dc/elements/1.1/"
 
-	// canonicalize the SignedInfo
-	canonData, _, err = canonicalize(signature.SignedInfo)
+// addSigningTime adds an Object with the signing time as a SignatureProperty,
+// along with a reference to it so that the time is signed.
+func (s *signer) addSigningTime(signature *Signature, place placement) error {
+	now := time.Now
+	if s.options.Clock != nil {
+		now = s.options.Clock
+	}
+	id := s.options.SignatureID + "-SignatureProperties"
+	properties := &SignatureProperties{
+		ID: id,
+		SignatureProperty: []SignatureProperty{{
+			Target:   "#" + s.options.SignatureID,
+			InnerXML: fmt.Sprintf(`<date xmlns="%s">%s</date>`, dublinCoreNamespace, now().UTC().Format(time.RFC3339)),
+		}},
+	}
+	// the properties are canonicalized as they will appear in the document
+	data, err := marshalSignature(properties, place.prefix)
+	if err != nil {
+		return err
+	}
+	// the ApexPrefix is for the signed element rather than the properties
+	canon, _ := s.refCanon.withApexPrefix("")
+	var canonical bytes.Buffer
+	if s.options.Canonicalizer != nil {
+		_, tagEnd, _, err := elementBounds(data, 0)
+		if err != nil {
+			return err
+		}
+		if data, err = declareScope(data, tagEnd, place.scope); err != nil {
+			return err
+		}
+		canonData, _, err := s.options.Canonicalizer.Canonicalize(data)
+		if err != nil {
+			return err
+		}
+		canonical.Write(canonData)
+	} else if _, err := canon.writeInScope(&canonical, bytes.NewReader(data), wholeDocument, place.scope); err != nil {
+		return err
+	}
+	s.options.Logger.log("canonicalized", "bytes", canonical.Len(), "id", id)
+	digest, err := s.digestCanonical(canonical.Bytes())
 	if err != nil {
+		return err
+	}
+	reference := Reference{URI: "#" + id, DigestValue: digest}
+	reference.Transforms.Transform = []Algorithm{s.refCanon.transform()}
+	reference.DigestMethod.Algorithm = s.digestAlg.name
+	// the signed element's reference comes first
+	signature.SignedInfo.AdditionalReferences = append(signature.SignedInfo.AdditionalReferences, reference)
+	signature.Object = append(signature.Object, Object{SignatureProperties: properties})
+	return nil
+}
+
+// CreateSignatureWithReferences signs a SignedInfo containing the references
+// as they are. Their DigestValue isn't computed or checked, which bypasses what
+// the signature is meant to protect, so this is only for tests and for
+// reproducing another implementation's exact output when debugging interop.
+// References without a DigestMethod get the digest algorithm of the Signer,
+// which must be one created by this package.
+func CreateSignatureWithReferences(with Signer, references ...Reference) (*Signature, error) {
+	s, ok := with.(*signer)
+	if !ok {
+		return nil, errors.New("xmlsig can only sign references with a Signer created by this package")
+	}
+	return s.createSignatureWithReferences(references)
+}
+
+func (s *signer) createSignatureWithReferences(references []Reference) (_ *Signature, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	if len(references) == 0 {
+		return nil, errors.New("xmlsig needs a Reference to sign")
+	}
+	signature := s.newSignature()
+	for i, reference := range references {
+		if reference.DigestMethod.Algorithm == "" {
+			reference.DigestMethod.Algorithm = s.digestAlg.name
+		}
+		if i == 0 {
+			signature.SignedInfo.Reference = reference
+			continue
+		}
+		signature.SignedInfo.AdditionalReferences = append(signature.SignedInfo.AdditionalReferences, reference)
+	}
+	if err := s.sign(signature, placement{}); err != nil {
 		return nil, err
 	}
+	return signature, nil
+}
+
+// newSignature creates a Signature with the signer's algorithms and Id.
+func (s *signer) newSignature() *Signature {
+	signature := newSignature(s.canon)
+	signature.SignedInfo.SignatureMethod.Algorithm = s.sigAlg.name
+	if s.options.SignatureID != "" {
+		signature.ID = s.options.SignatureID
+		signature.SignatureValueID = s.options.SignatureID + "-SignatureValue"
+	}
+	return signature
+}
+
+// sign computes the SignatureValue over the SignedInfo of the signature and
+// adds the KeyInfo.
+func (s *signer) sign(signature *Signature, place placement) error {
+	// canonicalize the SignedInfo
+	signedInfo, err := marshalSignature(signature.SignedInfo, place.prefix)
+	if err != nil {
+		return err
+	}
+	var canonSignedInfo bytes.Buffer
+	canonSignedInfo.Grow(len(signedInfo))
+	if _, err := s.canon.writeInScope(&canonSignedInfo, bytes.NewReader(signedInfo), wholeDocument, place.scope); err != nil {
+		return err
+	}
+	canonData, err := s.options.CanonicalizeHook.apply(canonSignedInfo.Bytes())
+	if err != nil {
+		return err
+	}
 
 	sig, err := s.Sign(canonData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	signature.SignatureValue = sig
+	signature.SignatureValue = s.wrap(sig)
+	s.options.Logger.log("signature computed", "algorithm", s.sigAlg.name)
 
+	switch {
+	case s.options.OmitKeyInfo:
+		signature.KeyInfo.Omitted = true
+		return nil
+	case s.options.EmptyKeyInfo:
+		return nil
+	}
+	signature.KeyInfo.KeyName = s.options.KeyName
+	if s.X509cert == nil {
+		// HMAC signers don't have a certificate for the KeyInfo
+		return nil
+	}
 	x509IssuerSerial := X509IssuerSerial{}
 	x509IssuerSerial.SerialNumber = s.X509cert.SerialNumber
-	issuerName := "emailAddress=" + s.X509cert.EmailAddresses[0] + "," + s.X509cert.Issuer.String()
+	issuerName := s.X509cert.Issuer.String()
+	if len(s.X509cert.EmailAddresses) > 0 {
+		issuerName = "emailAddress=" + s.X509cert.EmailAddresses[0] + "," + issuerName
+	}
 	x509IssuerSerial.IssuerName = issuerName
 
 	x509Data := &X509Data{
-		X509Certificate:  s.cert,
+		X509Certificate:  s.wrap(s.cert),
 		X509IssuerSerial: x509IssuerSerial,
+		X509SKI:          s.ski,
+		X509Digest:       s.x509Digest,
+	}
+	var chainData []interface{}
+	for _, c := range s.chain {
+		if s.options.SeparateX509Data {
+			chainData = append(chainData, &X509Data{X509Certificate: s.wrap(c)})
+			continue
+		}
+		x509Data.X509Chain = append(x509Data.X509Chain, s.wrap(c))
 	}
 
 	// rsaPublicKey := s.X509cert.PublicKey.(*rsa.PublicKey)
@@ -171,7 +1057,19 @@ func (s *signer) CreateSignature(data interface{}) (*Signature, error) {
 	// 	}
 	// }
 
-	signature.KeyInfo.X509Data = x509Data
+	if s.options.BinarySecurityTokenID != "" {
+		signature.KeyInfo.SecurityTokenReference = &SecurityTokenReference{
+			Reference: &TokenReference{
+				URI:       "#" + s.options.BinarySecurityTokenID,
+				ValueType: binaryValueType,
+			},
+		}
+	} else if s.keyIdentifier != nil {
+		signature.KeyInfo.SecurityTokenReference = &SecurityTokenReference{KeyIdentifier: s.keyIdentifier}
+	} else {
+		signature.KeyInfo.X509Data = x509Data
+		signature.KeyInfo.Children = append(signature.KeyInfo.Children, chainData...)
+	}
 	// signature.KeyInfo.KeyValue = KeyValue{
 	// 	RSAKeyValue: RSAKeyValue{
 	// 		Modulus:  strings.TrimRight(base64.StdEncoding.EncodeToString(rsaPublicKey.N.Bytes()), "="),
@@ -179,35 +1077,84 @@ func (s *signer) CreateSignature(data interface{}) (*Signature, error) {
 	// 	},
 	// }
 
-	return signature, nil
+	return nil
 }
 
-func (s *signer) Sign(data []byte) (string, error) {
-	h := s.sigAlg.hash.New()
-	h.Write(data)
-	sum := h.Sum(nil)
-	sig, err := s.key.Sign(rand.Reader, sum, s.sigAlg.hash)
+// verifyAfterSign envelops the signature in the canonical data it was created
+// for and checks the result with a Verifier.
+func (s *signer) verifyAfterSign(signature *Signature, prefix string) error {
+	doc, err := insertSignature([]byte(signature.CanonicalizedInput), signature, prefix)
+	if err != nil {
+		return err
+	}
+	return s.verify(doc)
+}
+
+// verify checks the signed document with a Verifier using the signer's certificate.
+func (s *signer) verify(doc []byte) error {
+	verifier := NewVerifierWithOptions(VerifierOptions{
+		Certificate:      s.X509cert,
+		HMACKey:          s.hmacKey,
+		IDAttributes:     s.options.IDAttributes,
+		CanonicalizeHook: s.options.CanonicalizeHook,
+		Canonicalizer:    s.options.Canonicalizer,
+		Logger:           s.options.Logger,
+	})
+	if err := verifier.Verify(doc); err != nil {
+		return fmt.Errorf("xmlsig signature did not verify after signing: %w", err)
+	}
+	return nil
+}
+
+func (s *signer) Sign(data []byte) (_ string, err error) {
+	defer recoverPanic(&err, s.options.Logger)
+	if s.hmacKey != nil {
+		return base64.StdEncoding.EncodeToString(computeHMAC(s.sigAlg, s.hmacKey, data)), nil
+	}
+	sum := data
+	if s.sigAlg.hash != 0 {
+		h := s.sigAlg.hash.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	}
+	random := rand.Reader
+	public, isECDSA := s.key.Public().(*ecdsa.PublicKey)
+	if s.options.DeterministicSignatures {
+		// ecdsa.PrivateKey uses RFC 6979 nonces without a random source
+		random = nil
+	}
+	sig, err := s.key.Sign(random, sum, s.sigAlg.hash)
 	if err != nil {
 		return "", err
 	}
+	if isECDSA {
+		if sig, err = ecdsaSignatureValue(public, sig); err != nil {
+			return "", err
+		}
+	}
 	return base64.StdEncoding.EncodeToString(sig), nil
 }
 
 const (
 	xMLexcC14Namespace          = "http://www.w3.org/2001/10/xml-exc-c14n#"
 	envelopedSignatureNamespace = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	base64Transform             = "http://www.w3.org/2000/09/xmldsig#base64"
 )
 
-func newSignature() *Signature {
+func newSignature(canon *canonicalization) *Signature {
 	signature := &Signature{}
-	signature.SignedInfo.CanonicalizationMethod.Algorithm = xMLexcC14Namespace
-
-	transforms := &signature.SignedInfo.Reference.Transforms.Transform
-	*transforms = append(*transforms, Algorithm{envelopedSignatureNamespace})
-	*transforms = append(*transforms, Algorithm{xMLexcC14Namespace})
+	signature.SignedInfo.CanonicalizationMethod = canon.transform()
 	return signature
 }
 
+func newReference(canon *canonicalization) Reference {
+	reference := Reference{}
+	transforms := &reference.Transforms.Transform
+	*transforms = append(*transforms, Algorithm{Algorithm: envelopedSignatureNamespace})
+	*transforms = append(*transforms, canon.transform())
+	return reference
+}
+
 func (s *signer) digest(data []byte) string {
 	h := s.digestAlg.hash.New()
 	h.Write(data)
@@ -215,6 +1162,24 @@ func (s *signer) digest(data []byte) string {
 	return base64.StdEncoding.EncodeToString(sum)
 }
 
+// base64LineLength is the maximum line length used when wrapping base64 text.
+const base64LineLength = 76
+
+// wrap breaks base64 text into lines when the signer is configured to do so.
+func (s *signer) wrap(text string) string {
+	if !s.options.WrapBase64 || len(text) <= base64LineLength {
+		return text
+	}
+	var wrapped strings.Builder
+	for len(text) > base64LineLength {
+		wrapped.WriteString(text[:base64LineLength])
+		wrapped.WriteByte('\n')
+		text = text[base64LineLength:]
+	}
+	wrapped.WriteString(text)
+	return wrapped.String()
+}
+
 func (s *signer) ValidateSignature(digest, signedData string) bool {
 	signedBytes := []byte(signedData)
 	digestOfSignedBytes := s.digest(signedBytes)
@@ -223,18 +1188,32 @@ func (s *signer) ValidateSignature(digest, signedData string) bool {
 }
 
 const (
-	encodingType            = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
-	binaryValueTypeSingle   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509v3"
-	binaryValueTypeMultiple = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509PKIPathv1"
+	encodingType    = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+	binaryValueType = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509v3"
 )
 
+// ValueTypes of a WS-Security KeyIdentifier, for the KeyIdentifier option.
+const (
+	KeyIdentifierSKI        = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509SubjectKeyIdentifier"
+	KeyIdentifierThumbprint = "http://docs.oasis-open.org/wss/oasis-wss-soap-message-security-1.1#ThumbprintSHA1"
+)
+
+// CreateBinarySecurityToken returns a token holding the signing certificate.
+// Its ID is the BinarySecurityTokenID option, or binarytoken if that isn't set.
+// The Value is the base64 encoded DER of the certificate with the X509v3
+// ValueType, which is what a SecurityTokenReference to it resolves. Earlier
+// versions encoded the base64 text a second time and declared X509PKIPathv1,
+// which receivers couldn't decode as either type.
 func (s *signer) CreateBinarySecurityToken() *BinarySecurityToken {
-	base64string := base64.StdEncoding.EncodeToString([]byte(s.cert))
+	id := s.options.BinarySecurityTokenID
+	if id == "" {
+		id = "binarytoken"
+	}
 	result := &BinarySecurityToken{
-		Value:        base64string,
+		Value:        s.cert,
 		EncodingType: encodingType,
-		ValueType:    binaryValueTypeMultiple,
-		ID:           "binarytoken",
+		ValueType:    binaryValueType,
+		ID:           id,
 	}
 	return result
 }
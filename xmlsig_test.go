@@ -0,0 +1,1335 @@
+package xmlsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+	testCertErr  error
+)
+
+// testCertificate returns a self-signed RSA certificate shared by the tests.
+func testCertificate(t testing.TB) tls.Certificate {
+	testCertOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber:   big.NewInt(1234),
+			Subject:        pkix.Name{CommonName: "xmlsig test"},
+			EmailAddresses: []string{"test@example.com"},
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	if testCertErr != nil {
+		t.Fatal(testCertErr)
+	}
+	return testCert
+}
+
+type Response struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	ID        string   `xml:",attr"`
+	Issuer    string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Assertion *Assertion
+	Status    Status `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+type Assertion struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID      string   `xml:",attr"`
+	Subject string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+}
+
+type Status struct {
+	ID   string `xml:",attr"`
+	Code string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+}
+
+func TestCreateSignatureForField(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &Response{
+		ID:        "_response",
+		Issuer:    "https://idp.example.com",
+		Assertion: &Assertion{ID: "_assertion", Subject: "user"},
+	}
+	sig, err := signer.(FieldSigner).CreateSignatureForField(response, "Assertion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.SignedInfo.Reference.URI != "#_assertion" {
+		t.Fatalf("expected reference to #_assertion but got %s", sig.SignedInfo.Reference.URI)
+	}
+	// digest the expected exclusive canonical form directly rather than
+	// running the assertion back through the canonicalizer
+	sum := sha1.Sum([]byte(`<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion"><Subject>user</Subject></Assertion>`))
+	if expected := base64.StdEncoding.EncodeToString(sum[:]); sig.SignedInfo.Reference.DigestValue != expected {
+		t.Fatalf("expected digest %s but got %s", expected, sig.SignedInfo.Reference.DigestValue)
+	}
+}
+
+type signedOrder struct {
+	XMLName xml.Name `xml:"urn:order Order"`
+	Header  string   `xml:"urn:order Header"`
+	Body    struct {
+		Items *orderItems
+	} `xml:"urn:order Body"`
+	Signature *Signature
+}
+
+type orderItems struct {
+	XMLName  xml.Name `xml:"urn:order Items"`
+	ID       string   `xml:"ID,attr"`
+	Product  string   `xml:"urn:product Product"`
+	Price    string   `xml:"urn:price Price"`
+	Shipping string   `xml:"urn:shipping Shipping"`
+}
+
+func TestCreateSignatureForID(t *testing.T) {
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := &signedOrder{Header: "unsigned"}
+	order.Body.Items = &orderItems{ID: "_items", Product: "book", Price: "12.50", Shipping: "express"}
+	sig, err := signer.(IDSigner).CreateSignatureForID(order, "_items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.SignedInfo.References()) != 1 || sig.SignedInfo.Reference.URI != "#_items" {
+		t.Fatalf("expected a single reference to #_items but got %+v", sig.SignedInfo.Reference)
+	}
+	// each child keeps its own namespace in the digested wrapper
+	for _, child := range []string{`<Product xmlns="urn:product">book</Product>`, `<Price xmlns="urn:price">12.50</Price>`, `<Shipping xmlns="urn:shipping">express</Shipping>`} {
+		if !strings.Contains(sig.CanonicalizedInput, child) {
+			t.Fatalf("expected %s in %s", child, sig.CanonicalizedInput)
+		}
+	}
+	order.Signature = sig
+	doc, err := xml.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifierWithOptions(VerifierOptions{RequiredReferences: []string{"_items"}})
+	if err := verifier.Verify(doc); err != nil {
+		t.Fatal(err)
+	}
+	// the unsigned header can change, but every child of the wrapper is covered
+	if err := verifier.Verify(bytes.Replace(doc, []byte(">unsigned<"), []byte(">changed<"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{">book<", ">12.50<", ">express<"} {
+		tampered := bytes.Replace(doc, []byte(value), []byte(">tampered<"), 1)
+		if err := verifier.Verify(tampered); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch changing %s but got %v", value, err)
+		}
+	}
+	if _, err := signer.(IDSigner).CreateSignatureForID(order, "_missing"); !errors.Is(err, ErrReferenceNotFound) {
+		t.Fatalf("expected ErrReferenceNotFound but got %v", err)
+	}
+}
+
+func TestCanonicalizeField(t *testing.T) {
+	response := &Response{ID: "_response", Status: Status{ID: "_status", Code: "Success"}}
+	// Status has no XMLName so the element name comes from the field tag
+	actual, id, err := CanonicalizeField(response, "Status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "_status" {
+		t.Fatalf("expected id _status but got %s", id)
+	}
+	expected := `<Status xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="_status"><StatusCode>Success</StatusCode></Status>`
+	if string(actual) != expected {
+		t.Fatalf("expected output of %s but got %s", expected, actual)
+	}
+	if _, _, err := CanonicalizeField(response, "Assertion"); err == nil {
+		t.Fatal("expected an error for a nil field")
+	}
+	if _, _, err := CanonicalizeField(response, "Missing"); err == nil {
+		t.Fatal("expected an error for a missing field")
+	}
+}
+
+func TestBase64Values(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{
+		DigestAlgorithm: "http://www.w3.org/2001/04/xmlenc#sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Assertion{ID: "_1", Subject: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := &Signature{}
+	if err := xml.Unmarshal(data, parsed); err != nil {
+		t.Fatal(err)
+	}
+	digest := parsed.SignedInfo.Reference.DigestValue
+	if strings.IndexFunc(digest, unicode.IsSpace) >= 0 {
+		t.Fatalf("digest value %q contains whitespace", digest)
+	}
+	sum, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sum) != sha256.Size {
+		t.Fatalf("expected a digest of %d bytes but got %d", sha256.Size, len(sum))
+	}
+	if strings.IndexFunc(parsed.SignatureValue, unicode.IsSpace) >= 0 {
+		t.Fatalf("signature value %q contains whitespace", parsed.SignatureValue)
+	}
+}
+
+func TestWrapBase64(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{WrapBase64: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Assertion{ID: "_1", Subject: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{sig.SignatureValue, sig.KeyInfo.X509Data.X509Certificate} {
+		lines := strings.Split(value, "\n")
+		if len(lines) < 2 {
+			t.Fatalf("expected %q to be wrapped", value)
+		}
+		for _, line := range lines {
+			if len(line) == 0 || len(line) > 76 || strings.IndexFunc(line, unicode.IsSpace) >= 0 {
+				t.Fatalf("malformed line %q", line)
+			}
+		}
+		if _, err := base64.StdEncoding.DecodeString(strings.Join(lines, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// issueCertificate creates a certificate for key signed by parent, or a self
+// signed one when parent is nil.
+func issueCertificate(t *testing.T, name string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		EmailAddresses:        []string{name + "@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil || name != "leaf",
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestNewSignerWithChain(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey := testCertificate(t).PrivateKey.(crypto.Signer)
+	root := issueCertificate(t, "root", rootKey, nil, nil)
+	intermediate := issueCertificate(t, "intermediate", intermediateKey, root, rootKey)
+	leaf := issueCertificate(t, "leaf", leafKey, intermediate, intermediateKey)
+
+	signer, err := NewSignerWithChain([]*x509.Certificate{root, leaf, intermediate}, leafKey, SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Assertion{ID: "_1", Subject: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := append([]string{sig.KeyInfo.X509Data.X509Certificate}, sig.KeyInfo.X509Data.X509Chain...)
+	expected := []*x509.Certificate{leaf, intermediate, root}
+	if len(certs) != len(expected) {
+		t.Fatalf("expected %d certificates but got %d", len(expected), len(certs))
+	}
+	for i, c := range certs {
+		der, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(der, expected[i].Raw) {
+			t.Fatalf("certificate %d is not %s", i, expected[i].Subject.CommonName)
+		}
+	}
+
+	if _, err := NewSignerWithChain([]*x509.Certificate{root, intermediate}, leafKey, SignerOptions{}); err != ErrNoLeafCertificate {
+		t.Fatalf("expected ErrNoLeafCertificate but got %v", err)
+	}
+}
+
+func TestSeparateX509Data(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey := testCertificate(t).PrivateKey.(crypto.Signer)
+	root := issueCertificate(t, "root", rootKey, nil, nil)
+	leaf := issueCertificate(t, "leaf", leafKey, root, rootKey)
+	for _, separate := range []bool{false, true} {
+		signer, err := NewSignerWithChain([]*x509.Certificate{root, leaf}, leafKey, SignerOptions{SeparateX509Data: separate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks := bytes.Split(signed, []byte("<X509Data "))[1:]
+		expected := [][]*x509.Certificate{{leaf, root}}
+		if separate {
+			expected = [][]*x509.Certificate{{leaf}, {root}}
+		}
+		if len(blocks) != len(expected) {
+			t.Fatalf("expected %d X509Data elements but got %d in %s", len(expected), len(blocks), signed)
+		}
+		for i, block := range blocks {
+			block = block[:bytes.Index(block, []byte("</X509Data>"))]
+			if count := bytes.Count(block, []byte("<X509Certificate ")); count != len(expected[i]) {
+				t.Fatalf("expected %d certificates in X509Data %d but got %d", len(expected[i]), i, count)
+			}
+			for _, cert := range expected[i] {
+				if !bytes.Contains(block, []byte(base64.StdEncoding.EncodeToString(cert.Raw))) {
+					t.Fatalf("expected %s in X509Data %d", cert.Subject.CommonName, i)
+				}
+			}
+		}
+		if separate && bytes.Count(signed, []byte("<X509IssuerSerial ")) != 1 {
+			t.Fatalf("expected only the signing certificate to have an X509IssuerSerial in %s", signed)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatal(err)
+		}
+		signature, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert, err := signature.certificate(); err != nil || !cert.Equal(leaf) {
+			t.Fatalf("expected the signing certificate to be the leaf but got %v", err)
+		}
+		if chain := signature.KeyInfo.X509Data.X509Chain; len(chain) != 1 || chain[0] != base64.StdEncoding.EncodeToString(root.Raw) {
+			t.Fatalf("expected the root as the rest of the chain but got %d certificates", len(chain))
+		}
+	}
+}
+
+func TestMergeX509Data(t *testing.T) {
+	keyInfo := `<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">` +
+		`<X509Data><X509SKI>c2tp</X509SKI></X509Data>` +
+		`<X509Data><X509Certificate>bGVhZg==</X509Certificate><X509Certificate>cm9vdA==</X509Certificate></X509Data>` +
+		`<X509Data><X509SKI>b3RoZXI=</X509SKI><X509Certificate>bW9yZQ==</X509Certificate></X509Data>` +
+		`</KeyInfo>`
+	var decoded KeyInfo
+	if err := xml.Unmarshal([]byte(keyInfo), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	data := decoded.X509Data
+	if data.X509SKI != "c2tp" {
+		t.Fatalf("expected the SKI of the first X509Data but got %q", data.X509SKI)
+	}
+	if data.X509Certificate != "bGVhZg==" {
+		t.Fatalf("expected the certificate of the second X509Data but got %q", data.X509Certificate)
+	}
+	if len(data.X509Chain) != 2 || data.X509Chain[0] != "cm9vdA==" || data.X509Chain[1] != "bW9yZQ==" {
+		t.Fatalf("expected the rest of the certificates in the chain but got %v", data.X509Chain)
+	}
+}
+
+func TestIndependentDigestAndSignatureAlgorithms(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSignerWithOptions(cert, SignerOptions{
+		SignatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+		DigestAlgorithm:    "http://www.w3.org/2001/04/xmlenc#sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &Assertion{ID: "_1", Subject: "user"}
+	sig, err := signer.CreateSignature(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := sig.SignedInfo.SignatureMethod.Algorithm; alg != "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512" {
+		t.Fatalf("unexpected signature method %s", alg)
+	}
+	if alg := sig.SignedInfo.Reference.DigestMethod.Algorithm; alg != "http://www.w3.org/2001/04/xmlenc#sha256" {
+		t.Fatalf("unexpected digest method %s", alg)
+	}
+	canonData, _, err := canonicalize(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSignature(t, cert, canonData, sig)
+}
+
+// checkSignature confirms the digest and signature value of sig are correct for
+// the canonical data and certificate.
+func checkSignature(t *testing.T, cert tls.Certificate, canonData []byte, sig *Signature) {
+	t.Helper()
+	digestAlg, err := pickDigestAlgorithm(sig.SignedInfo.Reference.DigestMethod.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := digestAlg.hash.New()
+	h.Write(canonData)
+	if expected := base64.StdEncoding.EncodeToString(h.Sum(nil)); sig.SignedInfo.Reference.DigestValue != expected {
+		t.Fatalf("expected digest %s but got %s", expected, sig.SignedInfo.Reference.DigestValue)
+	}
+	sigAlg, err := pickSignatureAlgorithm(x509.RSA, sig.SignedInfo.SignatureMethod.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonData, _, err = canonicalize(sig.SignedInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := base64.StdEncoding.DecodeString(sig.SignatureValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = sigAlg.hash.New()
+	h.Write(canonData)
+	key := cert.PrivateKey.(*rsa.PrivateKey)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, sigAlg.hash, h.Sum(nil), value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecurityTokenReference(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSignerWithOptions(cert, SignerOptions{BinarySecurityTokenID: "X509-token-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Assertion{ID: "_1", Subject: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signer.CreateBinarySecurityToken()
+	if token.ID != "X509-token-1" {
+		t.Fatalf("expected token ID X509-token-1 but got %s", token.ID)
+	}
+	der, err := base64.StdEncoding.DecodeString(token.Value)
+	if err != nil || !bytes.Equal(der, cert.Certificate[0]) {
+		t.Fatal("expected the token to hold the certificate")
+	}
+	if sig.KeyInfo.X509Data != nil {
+		t.Fatal("expected KeyInfo without X509Data")
+	}
+	str := sig.KeyInfo.SecurityTokenReference
+	if str == nil || str.Reference == nil {
+		t.Fatal("expected KeyInfo to contain a SecurityTokenReference")
+	}
+	if str.Reference.URI != "#"+token.ID || str.Reference.ValueType != token.ValueType {
+		t.Fatalf("unexpected reference %s with value type %s", str.Reference.URI, str.Reference.ValueType)
+	}
+	data, err := xml.Marshal(sig.KeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><SecurityTokenReference xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"><Reference xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd" URI="#X509-token-1" ValueType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509v3"></Reference></SecurityTokenReference></KeyInfo>`
+	if string(data) != expected {
+		t.Fatalf("expected KeyInfo of %s but got %s", expected, data)
+	}
+}
+
+func TestBinarySecurityTokenEncoding(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(signer.CreateBinarySecurityToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate is base64 encoded once, as a single X509v3 certificate
+	expected := `<BinarySecurityToken ValueType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509v3" ` +
+		`EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary" wsu:Id="binarytoken">` +
+		base64.StdEncoding.EncodeToString(cert.Certificate[0]) + `</BinarySecurityToken>`
+	if string(data) != expected {
+		t.Fatalf("expected token of %s but got %s", expected, data)
+	}
+}
+
+func TestVerifyAfterSign(t *testing.T) {
+	s, err := NewSignerWithOptions(testCertificate(t), SignerOptions{VerifyAfterSign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`<doc xmlns:unused="urn:unused" ID="_doc"><item>1</item></doc>`)
+	if _, err := s.(DocumentSigner).SignDocument(doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSignature(&Assertion{ID: "_1", Subject: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	// Break the canonicalization used for the reference, so it keeps the
+	// unused namespace that exclusive canonicalization drops
+	broken := *s.(*signer)
+	broken.refCanon = &canonicalization{name: xMLexcC14Namespace}
+	if _, err := broken.SignDocument(doc); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected verification to fail with ErrDigestMismatch but got %v", err)
+	}
+}
+
+func TestSHA3Digests(t *testing.T) {
+	for _, test := range []struct {
+		method DigestAlgorithm
+		sum    func([]byte) []byte
+	}{
+		{"http://www.w3.org/2007/05/xmldsig-more#sha3-256", func(data []byte) []byte { sum := sha3.Sum256(data); return sum[:] }},
+		{"http://www.w3.org/2007/05/xmldsig-more#sha3-384", func(data []byte) []byte { sum := sha3.Sum384(data); return sum[:] }},
+		{"http://www.w3.org/2007/05/xmldsig-more#sha3-512", func(data []byte) []byte { sum := sha3.Sum512(data); return sum[:] }},
+	} {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{
+			SignatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			DigestAlgorithm:    test.method,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signer.CreateSignature(&Assertion{ID: "_1", Subject: "user"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference := sig.SignedInfo.Reference
+		if reference.DigestMethod.Algorithm != string(test.method) {
+			t.Fatalf("expected the digest method %s but got %s", test.method, reference.DigestMethod.Algorithm)
+		}
+		expected := base64.StdEncoding.EncodeToString(test.sum([]byte(sig.CanonicalizedInput)))
+		if reference.DigestValue != expected {
+			t.Fatalf("expected the %s digest %s but got %s", test.method, expected, reference.DigestValue)
+		}
+	}
+}
+
+func TestCreateSignatureWithReferences(t *testing.T) {
+	cert := testCertificate(t)
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := Reference{
+		URI:         "#_partner",
+		DigestValue: "AAECAwQFBgcICQoLDA0ODxAREhM=",
+	}
+	reference.Transforms.Transform = []Algorithm{{Algorithm: xMLexcC14Namespace}}
+	sig, err := CreateSignatureWithReferences(signer, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.SignedInfo.References()) != 1 {
+		t.Fatalf("expected one reference but got %d", len(sig.SignedInfo.References()))
+	}
+	emitted := sig.SignedInfo.Reference
+	if emitted.DigestValue != reference.DigestValue || emitted.URI != reference.URI ||
+		emitted.DigestMethod.Algorithm != "http://www.w3.org/2000/09/xmldsig#sha1" {
+		t.Fatalf("expected the reference to be emitted as supplied but got %+v", emitted)
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`<DigestValue xmlns="http://www.w3.org/2000/09/xmldsig#">AAECAwQFBgcICQoLDA0ODxAREhM=</DigestValue>`)) {
+		t.Fatalf("expected the supplied digest in %s", data)
+	}
+	if _, err := CreateSignatureWithReferences(struct{ Signer }{signer}, reference); err == nil {
+		t.Fatal("expected an error for a Signer from outside the package")
+	}
+	// The SignatureValue is still computed over the SignedInfo
+	signedInfo, _, err := canonicalize(sig.SignedInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := base64.StdEncoding.DecodeString(sig.SignatureValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigAlg, _ := pickSignatureAlgorithm(x509.RSA, sig.SignedInfo.SignatureMethod.Algorithm)
+	if err := checkSignatureValue(parsed.PublicKey, sigAlg, signedInfo, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPerReferenceDigestMethod(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{DigestAlgorithm: DigestSHA384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := map[string]string{
+		"_a": `<item ID="_a">one</item>`,
+		"_b": `<item ID="_b">two</item>`,
+		"_c": `<item ID="_c">three</item>`,
+	}
+	digests := []struct {
+		id     string
+		method DigestAlgorithm
+		sum    func([]byte) []byte
+	}{
+		{"_a", DigestSHA256, func(data []byte) []byte { sum := sha256.Sum256(data); return sum[:] }},
+		{"_b", DigestSHA512, func(data []byte) []byte { sum := sha512.Sum512(data); return sum[:] }},
+		// without a DigestMethod the signer's algorithm is used
+		{"_c", "", func(data []byte) []byte { sum := sha512.Sum384(data); return sum[:] }},
+	}
+	var references []Reference
+	for _, digest := range digests {
+		reference := Reference{URI: "#" + digest.id}
+		reference.Transforms.Transform = []Algorithm{{Algorithm: CanonExclusive}}
+		reference.DigestMethod.Algorithm = digest.method
+		reference.DigestValue = base64.StdEncoding.EncodeToString(digest.sum([]byte(items[digest.id])))
+		references = append(references, reference)
+	}
+	sig, err := CreateSignatureWithReferences(signer, references...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, method := range []DigestAlgorithm{DigestSHA256, DigestSHA512, DigestSHA384} {
+		if emitted := sig.SignedInfo.References()[i].DigestMethod.Algorithm; emitted != method {
+			t.Fatalf("expected reference %d to use %s but got %s", i, method, emitted)
+		}
+	}
+	data, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`<items>` + items["_a"] + items["_b"] + items["_c"] + string(data) + `</items>`)
+	if err := NewVerifier().Verify(doc); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(doc, []byte(">two<"), []byte(">2<"), 1)
+	var refErr *ReferenceError
+	if err := NewVerifier().Verify(tampered); !errors.As(err, &refErr) || refErr.Index != 1 {
+		t.Fatalf("expected the second reference to fail but got %v", err)
+	}
+}
+
+func TestKeyInfoPresence(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		options  SignerOptions
+		contains string
+		missing  string
+	}{
+		{SignerOptions{}, `<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data`, ""},
+		{SignerOptions{EmptyKeyInfo: true}, `<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"></KeyInfo>`, "X509Data"},
+		{SignerOptions{OmitKeyInfo: true}, `</SignatureValue></Signature>`, "KeyInfo"},
+	}
+	for _, test := range tests {
+		signer, err := NewSignerWithOptions(cert, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := &Envelope{ID: "_1234", Data: "Hello, World!"}
+		data := signEnvelope(t, signer, doc)
+		if !bytes.Contains(data, []byte(test.contains)) {
+			t.Fatalf("expected %s in %s", test.contains, data)
+		}
+		if test.missing != "" && bytes.Contains(data, []byte(test.missing)) {
+			t.Fatalf("expected no %s in %s", test.missing, data)
+		}
+		if err := NewVerifierWithOptions(VerifierOptions{Certificate: leaf}).Verify(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewSignerWithOptions(cert, SignerOptions{OmitKeyInfo: true, EmptyKeyInfo: true}); err == nil {
+		t.Fatal("expected an error for both omitting and emptying the KeyInfo")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	cert := testCertificate(t)
+	if _, err := NewSignerWithOptions(tls.Certificate{}, SignerOptions{}); err == nil {
+		t.Fatal("expected an error without a certificate")
+	}
+	if _, err := NewSignerWithOptions(tls.Certificate{Certificate: cert.Certificate, PrivateKey: "not a key"}, SignerOptions{}); err == nil {
+		t.Fatal("expected an error for a private key that can't sign")
+	}
+	if _, err := NewSignerWithChain(nil, nil, SignerOptions{}); err == nil {
+		t.Fatal("expected an error without a private key")
+	}
+
+	// certificates without an email address used to panic
+	key := cert.PrivateKey.(*rsa.PrivateKey)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4321),
+		Subject:      pkix.Name{CommonName: "xmlsig no email"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer := sig.KeyInfo.X509Data.X509IssuerSerial.IssuerName; issuer != "CN=xmlsig no email" {
+		t.Fatalf("expected the issuer without an email address but got %s", issuer)
+	}
+
+	var logged []string
+	panicking := func([]byte) ([]byte, error) { panic("hook failed") }
+	logger := func(event string, keyvals ...interface{}) { logged = append(logged, event) }
+	signer, err = NewSignerWithOptions(cert, SignerOptions{CanonicalizeHook: panicking, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"/>`)); !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected ErrPanic but got %v", err)
+	}
+	if len(logged) == 0 || logged[len(logged)-1] != "panic recovered" {
+		t.Fatalf("expected the panic to be logged but got %v", logged)
+	}
+	signer, err = NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_doc"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifierWithOptions(VerifierOptions{CanonicalizeHook: panicking}).Verify(signed); !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected ErrPanic but got %v", err)
+	}
+}
+
+// latin1Reader converts ISO-8859-1 input to UTF-8.
+func latin1Reader(charset string, input io.Reader) (io.Reader, error) {
+	if !strings.EqualFold(charset, "ISO-8859-1") {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return strings.NewReader(string(runes)), nil
+}
+
+func TestSignDocumentCharset(t *testing.T) {
+	doc := []byte("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<doc ID=\"_doc\">caf\xe9 cr\xe8me</doc>")
+	signer, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.(DocumentSigner).SignDocument(doc); err == nil {
+		t.Fatal("expected an error without a charset reader")
+	}
+	signer, err = NewSignerWithOptions(testCertificate(t), SignerOptions{CharsetReader: latin1Reader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.Valid(signed) || !bytes.HasPrefix(signed, []byte(`<doc ID="_doc">café crème<Signature`)) {
+		t.Fatalf("expected canonical UTF-8 but got %q", signed)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXMLDeclaration(t *testing.T) {
+	plain, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureID: "_sig"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	declaring, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignatureID: "_sig", XMLDeclaration: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{`<doc ID="_d"><item>1</item></doc>`, `<?xml version="1.0"?>` + "\n" + `<doc ID="_d"><item>1</item></doc>`} {
+		without, err := plain.(DocumentSigner).SignDocument([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(without, []byte(`<doc ID="_d">`)) {
+			t.Fatalf("expected no XML declaration in %s", without)
+		}
+		with, err := declaring.(DocumentSigner).SignDocument([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the declaration is added in front of the same signed document
+		if string(with) != xml.Header+string(without) {
+			t.Fatalf("expected %s to be declared but got %s", without, with)
+		}
+		for _, signed := range [][]byte{with, without} {
+			if err := NewVerifier().Verify(signed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a document that is already declared isn't declared again
+	signed, err := plain.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterSigner, err := NewSignerWithOptions(testCertificate(t), SignerOptions{XMLDeclaration: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterSigned, err := counterSigner.(CounterSigner).CounterSign([]byte(xml.Header + string(signed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(counterSigned, []byte("<?xml")) != 1 {
+		t.Fatalf("expected one XML declaration in %s", counterSigned)
+	}
+	if err := NewVerifier().Verify(counterSigned); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignDocumentWithSignature(t *testing.T) {
+	doc := `<doc xmlns="urn:doc" ID="_d"><item>1</item></doc>`
+	for _, prefix := range []string{"", "ds"} {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignaturePrefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, signature, err := signer.(StandaloneSignatureSigner).SignDocumentWithSignature([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewVerifier().Verify(signed); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseSignature(signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.SignedInfo.Reference.URI != "#_d" {
+			t.Fatalf("expected the standalone signature to reference #_d but got %+v", parsed.SignedInfo.Reference)
+		}
+		// the signature is already canonical
+		var canonical bytes.Buffer
+		if err := CanonicalizeTo(&canonical, signature, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(canonical.Bytes(), signature) {
+			t.Fatalf("expected a canonical signature but got %s", signature)
+		}
+		// inserted into the original content, the signature verifies
+		inserted := strings.Replace(doc, "</doc>", string(signature)+"</doc>", 1)
+		if err := NewVerifier().Verify([]byte(inserted)); err != nil {
+			t.Fatalf("expected %s to verify but got %v", inserted, err)
+		}
+	}
+}
+
+func TestApexPrefix(t *testing.T) {
+	const saml = "urn:oasis:names:tc:SAML:2.0:assertion"
+	plain, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixed, err := NewSignerWithOptions(testCertificate(t), SignerOptions{ApexPrefix: "saml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := &Assertion{ID: "_a", Subject: "alice"}
+	expected, err := plain.CreateSignature(assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := prefixed.CreateSignature(assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical := `<saml:Assertion xmlns:saml="` + saml + `" ID="_a"><Subject xmlns="` + saml + `">alice</Subject></saml:Assertion>`
+	if sig.CanonicalizedInput != canonical {
+		t.Fatalf("expected %s but got %s", canonical, sig.CanonicalizedInput)
+	}
+	if sig.SignedInfo.Reference.DigestValue == expected.SignedInfo.Reference.DigestValue {
+		t.Fatal("expected the digest to reflect the apex prefix")
+	}
+	// the document has to render the apex the same way
+	signed, err := insertSignature([]byte(canonical), sig, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	defaulted, err := NewSignerWithOptions(testCertificate(t), SignerOptions{ApexPrefix: "#default", VerifyAfterSign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = defaulted.(DocumentSigner).SignDocument([]byte(`<p:Assertion xmlns:p="` + saml + `" ID="_a"><p:Subject>alice</p:Subject></p:Assertion>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := `<Assertion xmlns="` + saml + `" ID="_a"><p:Subject xmlns:p="` + saml + `">alice</p:Subject>`
+	if !bytes.HasPrefix(signed, []byte(start)) {
+		t.Fatalf("expected the document to start with %s but got %s", start, signed)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// unprefixed descendants stay in the namespace they were in
+	signed, err = defaulted.(DocumentSigner).SignDocument([]byte(`<p:A xmlns:p="urn:a" ID="_1"><Child>x</Child><B xmlns="urn:b"><C/></B></p:A>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = `<A xmlns="urn:a" ID="_1"><Child xmlns="">x</Child><B xmlns="urn:b"><C></C></B>`
+	if !bytes.HasPrefix(signed, []byte(start)) {
+		t.Fatalf("expected the document to start with %s but got %s", start, signed)
+	}
+	c, _ := pickCanonicalization("")
+	if c, err = c.withApexPrefix("#default"); err != nil {
+		t.Fatal(err)
+	}
+	var nested bytes.Buffer
+	doc := `<root xmlns="urn:outer"><p:A xmlns:p="urn:a" ID="_1"><Child/></p:A></root>`
+	if _, err := c.write(&nested, strings.NewReader(doc), subset{1, -1}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<A xmlns="urn:a" ID="_1"><Child xmlns="urn:outer"></Child></A>`; nested.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, nested.String())
+	}
+
+	conflicting, err := NewSignerWithOptions(testCertificate(t), SignerOptions{ApexPrefix: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conflicting.(DocumentSigner).SignDocument([]byte(`<a:doc xmlns:a="urn:a" xmlns:p="urn:p" p:x="1"/>`)); err == nil {
+		t.Fatal("expected an error for a prefix bound to another namespace")
+	}
+	if _, err := conflicting.(DocumentSigner).SignDocument([]byte(`<doc/>`)); err == nil {
+		t.Fatal("expected an error for an element without a namespace")
+	}
+}
+
+func TestReferenceType(t *testing.T) {
+	const objectType = "http://www.w3.org/2000/09/xmldsig#Object"
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{ReferenceType: objectType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := ` URI="#_d" Type="` + objectType + `">`
+	if !bytes.Contains(signed, []byte(reference)) {
+		t.Fatalf("expected %s in %s", reference, signed)
+	}
+	if err := NewVerifier().Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	// the Type is signed as part of SignedInfo
+	changed := bytes.Replace(signed, []byte(objectType), []byte("urn:other"), 1)
+	if err := NewVerifier().Verify(changed); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+}
+
+func TestEnvelopedTransformOrder(t *testing.T) {
+	for _, options := range []SignerOptions{
+		{},
+		{CanonicalizationAlgorithm: CanonInclusive11},
+		{InclusiveNamespaces: []string{"x"}},
+	} {
+		signer, err := NewSignerWithOptions(testCertificate(t), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromStruct, err := signer.CreateSignature(&Assertion{ID: "_a", Subject: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc xmlns:x="urn:x" ID="_d"/>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromDocument, err := ParseSignature(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sig := range []*Signature{fromStruct, fromDocument} {
+			transforms := sig.SignedInfo.Reference.Transforms.Transform
+			canon := sig.SignedInfo.CanonicalizationMethod.Algorithm
+			if len(transforms) != 2 || transforms[0].Algorithm != envelopedSignatureNamespace || transforms[1].Algorithm != canon {
+				t.Fatalf("expected the enveloped signature transform followed by %s but got %+v", canon, transforms)
+			}
+		}
+		// the order is the same in the XML
+		enveloped := bytes.Index(signed, []byte(envelopedSignatureNamespace))
+		canonicalization := bytes.LastIndex(signed, []byte(fromDocument.SignedInfo.CanonicalizationMethod.Algorithm))
+		if enveloped < 0 || canonicalization < enveloped {
+			t.Fatalf("expected the enveloped signature transform first in %s", signed)
+		}
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := issueCertificate(t, "ed25519", key, nil, nil)
+	signer, err := NewSignerWithOptions(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, SignerOptions{
+		DigestAlgorithm: DigestSHA256,
+		KeyName:         "ed25519",
+		VerifyAfterSign: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"><item>1</item></doc>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.SignedInfo.SignatureMethod.Algorithm != SigEd25519 {
+		t.Fatalf("expected the %s signature method but got %s", SigEd25519, sig.SignedInfo.SignatureMethod.Algorithm)
+	}
+	if value, err := base64.StdEncoding.DecodeString(sig.SignatureValue); err != nil || len(value) != ed25519.SignatureSize {
+		t.Fatalf("expected a raw %d byte signature but got %s", ed25519.SignatureSize, sig.SignatureValue)
+	}
+	found, err := NewVerifier().(CertificateVerifier).VerifyAndExtract(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.Equal(cert) {
+		t.Fatal("expected the Ed25519 certificate from the KeyInfo")
+	}
+	resolved := NewVerifierWithOptions(VerifierOptions{KeyResolver: func(string) (crypto.PublicKey, error) {
+		return public, nil
+	}})
+	if err := resolved.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(signed, []byte(sig.SignatureValue), []byte(tamperBase64(sig.SignatureValue)), 1)
+	if err := NewVerifier().Verify(tampered); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature but got %v", err)
+	}
+}
+
+func TestExpectedSize(t *testing.T) {
+	doc := []byte(`<doc ID="_d"><item>1</item></doc>`)
+	var signed [][]byte
+	for _, expected := range []int{0, 1, len(doc), 1 << 20} {
+		signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{ExpectedSize: expected})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := signer.(DocumentSigner).SignDocument(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed = append(signed, data)
+	}
+	for _, data := range signed[1:] {
+		if !bytes.Equal(data, signed[0]) {
+			t.Fatalf("expected the size hint not to change the signed document but got %s", data)
+		}
+	}
+}
+
+type benchAssertion struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID           string   `xml:",attr"`
+	Version      string   `xml:",attr"`
+	IssueInstant string   `xml:",attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *Signature
+	NameID       string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject>NameID"`
+	Conditions   struct {
+		NotBefore    string `xml:",attr"`
+		NotOnOrAfter string `xml:",attr"`
+		Audience     string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction>Audience"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	Attribute []struct {
+		Name  string `xml:",attr"`
+		Value string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement>Attribute"`
+}
+
+// BenchmarkSignSAMLAssertion signs an assertion with a single enveloped
+// reference and SHA-256, which is how the library is mostly used. The results
+// it is tracked against are in testdata/bench.
+func BenchmarkSignSAMLAssertion(b *testing.B) {
+	signer, err := NewSignerWithOptions(testCertificate(b), SignerOptions{DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		b.Fatal(err)
+	}
+	assertion := &benchAssertion{ID: "_a1", Version: "2.0", IssueInstant: "2024-01-01T00:00:00Z", Issuer: "https://idp.example.com", NameID: "alice"}
+	assertion.Conditions.NotBefore = "2024-01-01T00:00:00Z"
+	assertion.Conditions.NotOnOrAfter = "2024-01-01T00:05:00Z"
+	assertion.Conditions.Audience = "https://sp.example.com"
+	for _, name := range []string{"mail", "givenName", "sn", "memberOf"} {
+		assertion.Attribute = append(assertion.Attribute, struct {
+			Name  string `xml:",attr"`
+			Value string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+		}{name, name + " value"})
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		assertion.Signature = nil
+		sig, err := signer.CreateSignature(assertion)
+		if err != nil {
+			b.Fatal(err)
+		}
+		assertion.Signature = sig
+		if _, err := xml.Marshal(assertion); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSignDocumentExpectedSize signs a large document with and without
+// ExpectedSize matching its canonical size, which saves growing the buffer.
+func BenchmarkSignDocumentExpectedSize(b *testing.B) {
+	doc := largeElement()
+	for _, expected := range []int{0, len(doc)} {
+		b.Run(fmt.Sprintf("ExpectedSize=%d", expected), func(b *testing.B) {
+			signer, err := NewSignerWithOptions(testCertificate(b), SignerOptions{ExpectedSize: expected})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := signer.(DocumentSigner).SignDocument(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithOptions(t *testing.T) {
+	base, err := NewSigner(testCertificate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := map[DigestAlgorithm]int{
+		"http://www.w3.org/2001/04/xmlenc#sha256": sha256.Size,
+		"http://www.w3.org/2001/04/xmlenc#sha512": sha512.Size,
+	}
+	for alg, size := range digests {
+		derived, err := base.(OptionsSigner).WithOptions(SignerOptions{DigestAlgorithm: alg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := derived.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference := sig.SignedInfo.Reference
+		if reference.DigestMethod.Algorithm != alg {
+			t.Fatalf("expected %s but got %s", alg, reference.DigestMethod.Algorithm)
+		}
+		if digest, _ := base64.StdEncoding.DecodeString(reference.DigestValue); len(digest) != size {
+			t.Fatalf("expected a %d byte digest for %s but got %d", size, alg, len(digest))
+		}
+	}
+	// the base signer keeps its own options
+	sig, err := base.CreateSignature(&Envelope{ID: "_1234", Data: "Hello, World!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := sig.SignedInfo.Reference.DigestMethod.Algorithm; alg != "http://www.w3.org/2000/09/xmldsig#sha1" {
+		t.Fatalf("expected the base signer to be unchanged but got %s", alg)
+	}
+	if _, err := base.(OptionsSigner).WithOptions(SignerOptions{DigestAlgorithm: "urn:unknown"}); err == nil {
+		t.Fatal("expected an error for an unsupported digest algorithm")
+	}
+}
+
+func TestCreateEnvelopingSignature(t *testing.T) {
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{DigestAlgorithm: DigestSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, 64*1024)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.(EnvelopingSigner).CreateEnvelopingSignature(blob, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := sig.SignedInfo.Reference
+	if transforms := reference.Transforms.Transform; reference.URI != "#image" || len(transforms) != 1 ||
+		transforms[0].Algorithm != "http://www.w3.org/2000/09/xmldsig#base64" {
+		t.Fatalf("expected a reference to the Object with the base64 transform but got %+v", reference)
+	}
+	sum := sha256.Sum256(blob)
+	if reference.DigestValue != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatal("expected the digest to be of the raw content")
+	}
+	doc, err := xml.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(doc); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSignature(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := base64.StdEncoding.DecodeString(parsed.Object[0].Data); err != nil || !bytes.Equal(content, blob) {
+		t.Fatalf("expected the Object to hold the content but got %v", err)
+	}
+
+	blob[0] ^= 1
+	tampered := sig.Object[0]
+	tampered.Data = base64.StdEncoding.EncodeToString(blob)
+	sig.Object[0] = tampered
+	if doc, err = xml.Marshal(sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVerifier().Verify(doc); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch for changed content but got %v", err)
+	}
+}
+
+func TestSignedInfoOrder(t *testing.T) {
+	signedInfo := SignedInfo{
+		Reference:            Reference{URI: "#_a", DigestValue: "YQ=="},
+		AdditionalReferences: []Reference{{URI: "#_b", DigestValue: "Yg=="}},
+	}
+	signedInfo.CanonicalizationMethod.Algorithm = CanonExclusive
+	signedInfo.SignatureMethod.Algorithm = SigRSASHA256
+	signer, err := NewSignerWithOptions(testCertificate(t), SignerOptions{SignaturePrefix: "ds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.(DocumentSigner).SignDocument([]byte(`<doc ID="_d"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := xml.Marshal(signedInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"CanonicalizationMethod", "SignatureMethod", "Reference"}
+	for _, doc := range [][]byte{marshalled, signed} {
+		decoder := xml.NewDecoder(bytes.NewReader(doc))
+		var children []string
+		depth := -1
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				if t.Name == (xml.Name{Space: dsigNamespace, Local: "SignedInfo"}) {
+					depth = 0
+				} else if depth >= 0 {
+					if depth == 0 && t.Name.Space == dsigNamespace {
+						children = append(children, t.Name.Local)
+					}
+					depth++
+				}
+			case xml.EndElement:
+				if depth >= 0 {
+					depth--
+				}
+			}
+		}
+		if len(children) < len(expected) {
+			t.Fatalf("expected the children of SignedInfo in %s", doc)
+		}
+		for i, child := range children {
+			name := expected[len(expected)-1]
+			if i < len(expected) {
+				name = expected[i]
+			}
+			if child != name {
+				t.Fatalf("expected %s as child %d of SignedInfo but got %s in %s", name, i, child, doc)
+			}
+		}
+	}
+}